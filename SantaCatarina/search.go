@@ -231,7 +231,10 @@ func main() {
     checkReads(g)
     return
 
-    db := database.NewDatabase()
+    db, err := database.NewDatabase()
+    if err != nil {
+    	log.Fatal(err)
+    }
 	ids := db.Filter(nil, func(r *database.Record) bool {
 		if r.Host != "Human" {
 			return false
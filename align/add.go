@@ -0,0 +1,118 @@
+package align
+
+import (
+	"fmt"
+	"genomics/genomes"
+	"slices"
+)
+
+// Nts in a sequence added with AddToAlignment that aren't in the reference
+type Insertion struct {
+	Genome int // Which row of the alignment it's in
+	Pos    int // The column it comes before (Length() if it's at the end)
+	Nts    []byte
+}
+
+/*
+The ORFs with their coordinates moved from g's columns to positions in the
+reference with its gaps removed. refCols is where each reference nt is, as in
+AddToAlignment.
+*/
+func ungappedOrfs(orfs genomes.Orfs, refCols []int) genomes.Orfs {
+	// How many reference nts there are before col
+	ungap := func(col int) int {
+		ret, _ := slices.BinarySearch(refCols, col)
+		return ret
+	}
+
+	ret := make(genomes.Orfs, len(orfs))
+	for i, orf := range orfs {
+		orf.Start, orf.End = ungap(orf.Start), ungap(orf.End)
+		if orf.Segments != nil {
+			segments := make([]genomes.Segment, len(orf.Segments))
+			for j, seg := range orf.Segments {
+				segments[j] = genomes.Segment{Start: ungap(seg.Start),
+					End: ungap(seg.End)}
+			}
+			orf.Segments = segments
+		}
+		ret[i] = orf
+	}
+	return ret
+}
+
+/*
+Add other (which don't need to be aligned to anything) to the alignment g, by
+aligning each to g's first genome (the reference). g's columns don't change,
+so positions and ORFs that refer to it are still right, like mafft
+--keeplength. Anything in the new sequences that's not in the reference is
+left out of the alignment and returned as Insertions instead. Columns where
+the reference has a gap are always gaps in the new rows. If codonAware, use
+CodonAlignPair, which needs g to have ORFs. If any of them can't be aligned g
+is left as it was.
+*/
+func AddToAlignment(g *genomes.Genomes,
+	other []*genomes.Genomes, codonAware bool) ([]Insertion, error) {
+	ref := g.Filter(0)
+	ref.RemoveGaps()
+
+	refCols := make([]int, 0, ref.Length())
+	for i, nt := range g.Nts[0] {
+		if nt != '-' {
+			refCols = append(refCols, i)
+		}
+	}
+	refCols = append(refCols, g.Length())
+	ref.Orfs = ungappedOrfs(g.Orfs, refCols)
+
+	ret := make([]Insertion, 0)
+	rows := make([][]byte, 0)
+	names := make([]string, 0)
+	for _, o := range other {
+		for i := 0; i < o.NumGenomes(); i++ {
+			var aligned *genomes.PairwiseAlignment
+			var err error
+			nts := ungapped(o.Nts[i])
+			if codonAware {
+				aligned, err = CodonAlignPair(ref, nts)
+			} else {
+				aligned, err = genomes.AlignPair(ref.Nts[0],
+					nts, &genomes.NucleotideAlignParams)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Can't align %s: %w", o.Names[i], err)
+			}
+
+			which := g.NumGenomes() + len(rows)
+			row := make([]byte, g.Length())
+			for j := range row {
+				row[j] = '-'
+			}
+
+			var r int
+			var insertion []byte
+			for j, nt := range aligned.A {
+				if nt == '-' {
+					insertion = append(insertion, aligned.B[j])
+					continue
+				}
+				if len(insertion) > 0 {
+					ret = append(ret, Insertion{which, refCols[r], insertion})
+					insertion = nil
+				}
+				row[refCols[r]] = aligned.B[j]
+				r++
+			}
+			if len(insertion) > 0 {
+				ret = append(ret, Insertion{which, refCols[r], insertion})
+			}
+
+			rows = append(rows, row)
+			names = append(names, o.Names[i])
+		}
+	}
+
+	g.Nts = append(g.Nts, rows...)
+	g.Names = append(g.Names, names...)
+	return ret, nil
+}
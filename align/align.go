@@ -2,55 +2,276 @@ package align
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"genomics/genomes"
+	"genomics/utils"
 	"os"
 	"os/exec"
-	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Align them with mafft. We assume the first one has the ORFs you want
-func Align(g []*genomes.Genomes,
-	tmpDir string) (*genomes.Genomes, error) {
-	inputName := path.Join(tmpDir, "unaligned.fasta")
-	fd, err := os.Create(inputName)
+/*
+Something that can do a multiple sequence alignment. Each of the genomes in g
+contributes its first sequence, and the result has them in the same order,
+with the names and ORFs of the first one.
+*/
+type Aligner interface {
+	Align(ctx context.Context, g []*genomes.Genomes) (*genomes.Genomes, error)
+}
+
+/*
+Runs an external program to do the alignment. Input and output go through
+temporary files in TmpDir (or the system default if it's empty) which are
+unique to each call, so it's fine to have several going at once. If Timeout
+isn't 0 the program is killed if it takes longer than that.
+*/
+type ExternalAligner struct {
+	Name    string
+	TmpDir  string
+	Timeout time.Duration
+
+	// Makes the arguments for reading from input and writing to output. If
+	// the program writes the alignment to stdout rather than a file,
+	// UseStdout should be true and the output will be redirected there.
+	Args      func(input, output string) []string
+	UseStdout bool
+}
+
+func NewMafftAligner(tmpDir string) *ExternalAligner {
+	return &ExternalAligner{"mafft", tmpDir, 0,
+		func(input, output string) []string {
+			return []string{"--auto", "--quiet", input}
+		}, true}
+}
+
+func NewMuscleAligner(tmpDir string) *ExternalAligner {
+	return &ExternalAligner{"muscle", tmpDir, 0,
+		func(input, output string) []string {
+			return []string{"-align", input, "-output", output}
+		}, false}
+}
+
+func NewClustaloAligner(tmpDir string) *ExternalAligner {
+	return &ExternalAligner{"clustalo", tmpDir, 0,
+		func(input, output string) []string {
+			return []string{"-i", input, "-o", output,
+				"--outfmt=fasta", "--force"}
+		}, false}
+}
+
+/*
+Write the sequences with names that are just their index, since aligners tend
+to mangle names, and some of them change the order.
+*/
+func writeInput(g []*genomes.Genomes, fname string) error {
+	fd, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fp := bufio.NewWriter(fd)
+	for i, g := range g {
+		g.Write(fp, utils.Itoa(i), 0)
+	}
+	return fp.Flush()
+}
+
+// Load what an aligner wrote and put the names and order back
+func readOutput(g []*genomes.Genomes,
+	fname string) (*genomes.Genomes, error) {
+	aligned, err := genomes.TryLoadGenomes(fname, "", false)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
+	if aligned.NumGenomes() != len(g) {
+		return nil, fmt.Errorf("Expected %d aligned sequences but got %d",
+			len(g), aligned.NumGenomes())
+	}
+
+	ret := genomes.NewGenomes(g[0].Orfs, len(g))
+	ret.Code = g[0].Code
+	for i, name := range aligned.Names {
+		j, err := strconv.Atoi(strings.TrimSpace(name))
+		if err != nil || j < 0 || j >= len(g) || ret.Nts[j] != nil {
+			return nil, fmt.Errorf("Unexpected sequence name %s", name)
+		}
+		ret.Nts[j] = aligned.Nts[i]
+		ret.Names[j] = g[j].Names[0]
+	}
+	return ret, nil
+}
+
+func (a *ExternalAligner) Align(ctx context.Context,
+	g []*genomes.Genomes) (*genomes.Genomes, error) {
+	if len(g) == 0 {
+		return nil, errors.New("Nothing to align")
+	}
+	if a.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	tmpFile := func(pattern string) (string, error) {
+		fd, err := os.CreateTemp(a.TmpDir, pattern)
+		if err != nil {
+			return "", err
+		}
 		fd.Close()
-		os.Remove(inputName)
-	}()
+		return fd.Name(), nil
+	}
 
-	fp := bufio.NewWriter(fd)
-	for _, g := range g {
-		g.Write(fp, g.Names[0], 0)
+	inputName, err := tmpFile("unaligned-*.fasta")
+	if err != nil {
+		return nil, err
 	}
-	fp.Flush()
+	defer os.Remove(inputName)
 
-	cmd := exec.Command("mafft", "--auto", "--quiet", inputName)
+	outputName, err := tmpFile("aligned-*.fasta")
 	if err != nil {
 		return nil, err
 	}
+	defer os.Remove(outputName)
 
-	outputName := path.Join(tmpDir, "aligned.fasta")
-	fd2, err := os.Create(outputName)
+	err = writeInput(g, inputName)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		fd2.Close()
-		os.Remove(outputName)
-	}()
-	w := bufio.NewWriter(fd2)
-	cmd.Stdout = w
 
-	err = cmd.Run()
+	cmd := exec.CommandContext(ctx, a.Name, a.Args(inputName, outputName)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	// Don't hang about waiting for anything it started to finish writing
+	// once it's been killed
+	cmd.WaitDelay = time.Second
+
+	if a.UseStdout {
+		fd, createErr := os.Create(outputName)
+		if createErr != nil {
+			return nil, createErr
+		}
+		defer fd.Close()
+		w := bufio.NewWriter(fd)
+		cmd.Stdout = w
+		err = cmd.Run()
+		if err == nil {
+			err = w.Flush()
+		}
+	} else {
+		err = cmd.Run()
+	}
+
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("%s failed: %w: %s", a.Name, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", a.Name, err)
+	}
+
+	return readOutput(g, outputName)
+}
+
+/*
+Does the alignment in-process with AlignPair (or CodonAlignPair if
+CodonAware), aligning everything to the first genome and then merging the
+results. Not as good as a proper multiple aligner if the others are more like
+each other than the first one, but doesn't need anything installed.
+*/
+type LocalAligner struct {
+	CodonAware bool
+}
+
+func (a *LocalAligner) Align(ctx context.Context,
+	g []*genomes.Genomes) (*genomes.Genomes, error) {
+	if len(g) == 0 {
+		return nil, errors.New("Nothing to align")
+	}
+	ref := g[0].Filter(0)
+	ref.Nts[0] = ungapped(ref.Nts[0])
+
+	pairs := make([]*genomes.PairwiseAlignment, len(g)-1)
+	for i, other := range g[1:] {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var err error
+		nts := ungapped(other.Nts[0])
+		if a.CodonAware {
+			pairs[i], err = CodonAlignPair(ref, nts)
+		} else {
+			pairs[i], err = genomes.AlignPair(ref.Nts[0],
+				nts, &genomes.NucleotideAlignParams)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can't align %s: %w", other.Names[0], err)
+		}
+	}
+
+	ret := genomes.NewGenomes(ref.Orfs, len(g))
+	ret.Nts = mergePairwise(ref.Nts[0], pairs)
+	for i, other := range g {
+		ret.Names[i] = other.Names[0]
+	}
+	ret.Code = ref.Code
+	return ret, nil
+}
+
+/*
+For tests. Doesn't really align anything, just pads the sequences with gaps
+at the end so they're all the same length. Records what it was asked to
+align, and returns Err instead if that's set.
+*/
+type FakeAligner struct {
+	Err   error
+	Calls [][]*genomes.Genomes
+}
+
+func (a *FakeAligner) Align(ctx context.Context,
+	g []*genomes.Genomes) (*genomes.Genomes, error) {
+	a.Calls = append(a.Calls, g)
+	if a.Err != nil {
+		return nil, a.Err
+	}
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	w.Flush()
-	ret := genomes.LoadGenomes(outputName, "", false)
-	ret.Orfs = g[0].Orfs
+	if len(g) == 0 {
+		return nil, errors.New("Nothing to align")
+	}
 
+	var length int
+	for _, other := range g {
+		length = utils.Max(length, len(other.Nts[0]))
+	}
+
+	ret := genomes.NewGenomes(g[0].Orfs, len(g))
+	ret.Code = g[0].Code
+	for i, other := range g {
+		nts := make([]byte, length)
+		copy(nts, other.Nts[0])
+		for j := len(other.Nts[0]); j < length; j++ {
+			nts[j] = '-'
+		}
+		ret.Nts[i] = nts
+		ret.Names[i] = other.Names[0]
+	}
 	return ret, nil
 }
+
+// Align them with mafft. We assume the first one has the ORFs you want
+func Align(g []*genomes.Genomes,
+	tmpDir string) (*genomes.Genomes, error) {
+	return NewMafftAligner(tmpDir).Align(context.Background(), g)
+}
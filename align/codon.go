@@ -0,0 +1,389 @@
+package align
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"genomics/genomes"
+	"genomics/utils"
+	"slices"
+)
+
+/*
+How many nts of a coding region we align as proteins at once. Should be a
+multiple of 3.
+*/
+const SEGMENT_LENGTH = 300
+
+// A stretch of the reference we align as codons
+type codingBlock struct {
+	start, end int // in the reference
+	anchor     int // where a codon starts (or ends if reverse)
+	reverse    bool
+	code       *genomes.GeneticCode
+}
+
+func mod3(x int) int {
+	return ((x % 3) + 3) % 3
+}
+
+func (b *codingBlock) sameFrame(other *codingBlock) bool {
+	return b.reverse == other.reverse && b.code == other.code &&
+		mod3(b.anchor-other.anchor) == 0
+}
+
+/*
+One block for each segment of orf, each with its own frame since that carries
+on from the previous segment (see genomes.Orf).
+*/
+func orfBlocks(orf *genomes.Orf, code *genomes.GeneticCode) []codingBlock {
+	segments := orf.Segments
+	if segments == nil {
+		segments = []genomes.Segment{{Start: orf.Start, End: orf.End}}
+	}
+
+	ret := make([]codingBlock, len(segments))
+	var offset int
+	for i, seg := range segments {
+		// How far into the segment the first whole codon starts
+		skip := mod3(-offset)
+		if orf.Reverse {
+			ret[i] = codingBlock{seg.Start, seg.End, seg.End - skip, true, code}
+		} else {
+			ret[i] = codingBlock{seg.Start, seg.End, seg.Start + skip,
+				false, code}
+		}
+		offset += seg.End - seg.Start
+	}
+	return ret
+}
+
+/*
+Work out which parts of the reference are coding from its ORFs (or their
+segments if they have them). Overlapping ones in the same frame are merged into
+one block. Where the frame changes (like at ORF1ab's frameshift, or where
+another gene overlaps in a different frame) the overlap stays with the first
+block and the new frame starts where that ends.
+*/
+func codingBlocks(ref *genomes.Genomes) []codingBlock {
+	pieces := make([]codingBlock, 0)
+	for i := range ref.Orfs {
+		orf := &ref.Orfs[i]
+		code := orf.Code
+		if code == nil {
+			code = ref.GeneticCode()
+		}
+		pieces = append(pieces, orfBlocks(orf, code)...)
+	}
+	slices.SortStableFunc(pieces, func(a, b codingBlock) int {
+		return a.start - b.start
+	})
+
+	blocks := make([]codingBlock, 0)
+	for _, p := range pieces {
+		if p.end > ref.Length() || p.end-p.start < 3 {
+			continue
+		}
+		n := len(blocks)
+		if n > 0 && p.start < blocks[n-1].end {
+			last := &blocks[n-1]
+			if p.end <= last.end {
+				continue
+			}
+			if last.sameFrame(&p) {
+				last.end = p.end
+				continue
+			}
+			p.start = last.end
+		}
+		blocks = append(blocks, p)
+	}
+
+	// Put them in frame, which might leave nothing of the short ones
+	ret := make([]codingBlock, 0, len(blocks))
+	for _, b := range blocks {
+		trimBlock(&b)
+		if b.end-b.start >= 3 {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
+
+// Trim the ends so they're a whole number of codons from the anchor
+func trimBlock(b *codingBlock) {
+	b.start += mod3(b.anchor - b.start)
+	b.end -= mod3(b.end - b.anchor)
+}
+
+// Split nts into codons, leaving out any partial one at the end
+func codons(nts []byte) [][]byte {
+	ret := make([][]byte, 0, len(nts)/3)
+	for i := 0; i+3 <= len(nts); i += 3 {
+		ret = append(ret, nts[i:i+3])
+	}
+	return ret
+}
+
+/*
+Align the coding block ref to other by translating them both, aligning the
+proteins and putting the codons back.
+*/
+func alignBlock(ref, other []byte,
+	block codingBlock) (*genomes.PairwiseAlignment, error) {
+	if block.reverse {
+		ref = genomes.ReverseComplement(ref)
+		other = genomes.ReverseComplement(other)
+	}
+
+	refCodons, otherCodons := codons(ref), codons(other)
+
+	// Anything left over after the last whole codon in other (because of a
+	// frameshift) is an insertion at the end.
+	leftover := other[len(otherCodons)*3:]
+
+	// Codons that don't translate (because of Ns etc.) come back as '-', which
+	// we'd mistake for gaps below
+	translate := func(nts []byte) []byte {
+		ret := block.code.TranslateAlignedShort(nts)
+		for i, aa := range ret {
+			if aa == '-' {
+				ret[i] = 'X'
+			}
+		}
+		return ret
+	}
+	refProt, otherProt := translate(ref), translate(other)
+
+	params := genomes.ProteinAlignParams
+	params.FreeEndGaps = false
+	prot, err := genomes.AlignPair(refProt, otherProt, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := genomes.PairwiseAlignment{Score: prot.Score}
+	gap := []byte("---")
+	var i, j int
+	for k := 0; k < len(prot.A); k++ {
+		if prot.A[k] != '-' {
+			ret.A = append(ret.A, refCodons[i]...)
+			i++
+		} else {
+			ret.A = append(ret.A, gap...)
+		}
+		if prot.B[k] != '-' {
+			ret.B = append(ret.B, otherCodons[j]...)
+			j++
+		} else {
+			ret.B = append(ret.B, gap...)
+		}
+	}
+	for _, nt := range leftover {
+		ret.A = append(ret.A, '-')
+		ret.B = append(ret.B, nt)
+	}
+
+	if block.reverse {
+		ret.A = genomes.ReverseComplement(ret.A)
+		ret.B = genomes.ReverseComplement(ret.B)
+	}
+	return &ret, nil
+}
+
+func ungapped(nts []byte) []byte {
+	ret := make([]byte, 0, len(nts))
+	for _, nt := range nts {
+		if nt != '-' {
+			ret = append(ret, nt)
+		}
+	}
+	return ret
+}
+
+/*
+Align other to the first genome in ref, keeping the ORFs in ref in frame: in
+coding regions we align the translations and then put the codons back, so gaps
+are always whole codons. The non-coding parts are aligned as nucleotides. ref
+mustn't have any gaps in it, and its ORFs must be in its own coordinates.
+RemoveGaps doesn't move the ORFs, so if ref came from an alignment they'll
+need mapping too (see AddToAlignment).
+*/
+func CodonAlignPair(ref *genomes.Genomes,
+	other []byte) (*genomes.PairwiseAlignment, error) {
+	refNts := ref.Nts[0]
+	if slices.Contains(refNts, '-') {
+		return nil, errors.New("Reference has gaps")
+	}
+	other = ungapped(other)
+
+	// First a nucleotide alignment to find which bits of other go with which
+	// bits of the reference.
+	rough, err := genomes.AlignPair(refNts,
+		other, &genomes.NucleotideAlignParams)
+	if err != nil {
+		return nil, err
+	}
+	otherPos := make([]int, len(refNts)+1)
+	var r, o int
+	for k := 0; k < len(rough.A); k++ {
+		if rough.A[k] != '-' {
+			otherPos[r] = o
+			r++
+		}
+		if rough.B[k] != '-' {
+			o++
+		}
+	}
+	// Anything before the first reference nt goes with the first segment
+	otherPos[0] = 0
+	otherPos[len(refNts)] = len(other)
+
+	var ret genomes.PairwiseAlignment
+	add := func(a *genomes.PairwiseAlignment) {
+		ret.A = append(ret.A, a.A...)
+		ret.B = append(ret.B, a.B...)
+		ret.Score += a.Score
+	}
+
+	// The non-coding parts
+	alignNts := func(start, end int) error {
+		a, err := genomes.AlignPair(refNts[start:end],
+			other[otherPos[start]:otherPos[end]],
+			&genomes.NucleotideAlignParams)
+		if err != nil {
+			return err
+		}
+		add(a)
+		return nil
+	}
+
+	var pos int
+	for _, block := range codingBlocks(ref) {
+		if err := alignNts(pos, block.start); err != nil {
+			return nil, err
+		}
+		// Do it a bit at a time so that a frameshift in other (which makes
+		// the rest of its translation garbage) only messes up one segment.
+		// The segments all start in frame since the block is a whole number
+		// of codons either way round.
+		for start := block.start; start < block.end; start += SEGMENT_LENGTH {
+			end := utils.Min(start+SEGMENT_LENGTH, block.end)
+			a, err := alignBlock(refNts[start:end],
+				other[otherPos[start]:otherPos[end]], block)
+			if err != nil {
+				return nil, err
+			}
+			add(a)
+		}
+		pos = block.end
+	}
+	if err := alignNts(pos, len(refNts)); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(ungapped(ret.B), other) {
+		return nil, errors.New("Codon alignment lost some of the sequence")
+	}
+
+	ret.Cigar = cigar(ret.A, ret.B)
+	return &ret, nil
+}
+
+func cigar(a, b []byte) string {
+	ops := make([]byte, len(a))
+	for i := range a {
+		switch {
+		case a[i] == '-':
+			ops[i] = 'I'
+		case b[i] == '-':
+			ops[i] = 'D'
+		default:
+			ops[i] = 'M'
+		}
+	}
+
+	ret := make([]byte, 0)
+	for i := 0; i < len(ops); {
+		j := i
+		for j < len(ops) && ops[j] == ops[i] {
+			j++
+		}
+		ret = append(ret, []byte(utils.Itoa(j-i))...)
+		ret = append(ret, ops[i])
+		i = j
+	}
+	return string(ret)
+}
+
+/*
+Merge pairwise alignments against the same reference into one alignment, by
+putting in enough gaps in the reference at each position for the longest
+insertion any of them has there.
+*/
+func mergePairwise(ref []byte,
+	pairs []*genomes.PairwiseAlignment) [][]byte {
+	// The longest insertion before each reference position
+	insertions := make([]int, len(ref)+1)
+	for _, p := range pairs {
+		var r, run int
+		for k := 0; k < len(p.A); k++ {
+			if p.A[k] == '-' {
+				run++
+				continue
+			}
+			insertions[r] = utils.Max(insertions[r], run)
+			run = 0
+			r++
+		}
+		insertions[r] = utils.Max(insertions[r], run)
+	}
+
+	ret := make([][]byte, len(pairs)+1)
+	for i := 0; i <= len(ref); i++ {
+		for j := 0; j < insertions[i]; j++ {
+			ret[0] = append(ret[0], '-')
+		}
+		if i < len(ref) {
+			ret[0] = append(ret[0], ref[i])
+		}
+	}
+
+	for n, p := range pairs {
+		row := make([]byte, 0, len(ret[0]))
+		var r, run int
+		flush := func() {
+			// Pad the insertion out to the longest one here
+			for ; run < insertions[r]; run++ {
+				row = append(row, '-')
+			}
+			run = 0
+		}
+		for k := 0; k < len(p.A); k++ {
+			if p.A[k] == '-' {
+				row = append(row, p.B[k])
+				run++
+				continue
+			}
+			flush()
+			row = append(row, p.B[k])
+			r++
+		}
+		flush()
+		ret[n+1] = row
+	}
+	return ret
+}
+
+/*
+Like Align, but codon-aware (see CodonAlignPair), and done in-process. The
+first genome is the reference and must have the ORFs. Everything else is
+aligned to it. Insertions are shared out so every row is the same length, and
+since they're whole codons RemoveGaps will get you back to the reference's
+coordinates with everything still in frame.
+*/
+func CodonAlign(g []*genomes.Genomes) (*genomes.Genomes, error) {
+	var aligner LocalAligner
+	aligner.CodonAware = true
+	return aligner.Align(context.Background(), g)
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"genomics/comparison"
+	"genomics/config"
 	"genomics/database"
 	"genomics/genomes"
 	"genomics/mutations"
@@ -463,15 +464,14 @@ func (d *Display) Process(record *database.Record, pu *pileup.Pileup) {
 		contents.ToString(), len(qsLocations))
 }
 
-var ROOT string = "/fs/bowser/genomes/raw_reads/"
-
 func ProcessReads(db *database.Database,
 	ids []database.Id, prefix string,
 	handler ReadHandler) {
+	root := config.Get().Reads
 
 	for _, id := range ids {
 		record := db.Get(id)
-		pu := FindPileup(record, path.Join(ROOT, prefix))
+		pu := FindPileup(record, path.Join(root, prefix))
 		if pu == nil {
 			continue
 		}
@@ -480,7 +480,8 @@ func ProcessReads(db *database.Database,
 }
 
 func ProcessAll(dir string, handler ReadHandler) {
-	matches, _ := filepath.Glob(path.Join(ROOT, dir, "*.txt.gz"))
+	matches, _ := filepath.Glob(path.Join(config.Get().Reads, dir,
+		"*.txt.gz"))
 	for _, m := range matches {
 		pu, err := pileup.Parse2(m)
 		if err != nil {
@@ -686,7 +687,10 @@ func main() {
 		return
 	}
 
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if findSequences {
 		FindSequences(db, class)
@@ -55,6 +55,10 @@ type Comparison struct {
 	Genomes    *genomes.Genomes
 	A, B       int
 	IsProtein  bool
+
+	// Differences involving IUPAC ambiguity codes that could be the same
+	// nt (like R vs A). These aren't counted as mutations.
+	Ambiguous []NtMut
 }
 
 // Returns silent, non-silent and non-orf
@@ -77,6 +81,7 @@ func (c *Comparison) Init(g *genomes.Genomes, a, b int, protein bool) {
 	c.NtMuts = make([]NtMut, 0)
 	c.Insertions = make([]int, 0)
 	c.Deletions = make([]int, 0)
+	c.Ambiguous = make([]NtMut, 0)
 	c.Genomes = g
 	c.A, c.B = a, b
 	c.IsProtein = protein
@@ -142,6 +147,10 @@ func (c *Comparison) Summary(showIndels bool) {
 		S, N, NO, ratio, S+N+NO)
 	fmt.Printf("Insertions: %d Deletions: %d\n",
 		len(c.Insertions), len(c.Deletions))
+	if len(c.Ambiguous) > 0 {
+		fmt.Printf("Compatible ambiguities (not counted): %d\n",
+			len(c.Ambiguous))
+	}
 
 	numMuts := float64(len(c.NtMuts))
 	total := float64(g.Length())
@@ -356,6 +365,20 @@ plot "%s" using 1 title "silent" with lines, \
 	}
 }
 
+func compatibleCodons(a, b string) bool {
+	for i := 0; i < len(a); i++ {
+		if !genomes.NtsCompatible(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Compare genomes a and b. Differences where one of them has an IUPAC ambiguity
+code that's compatible with the other (R vs G say) go in Ambiguous rather than
+being counted as mutations, and Ns are ignored.
+*/
 func Compare(g *genomes.Genomes, a, b int) Comparison {
 	var ret Comparison
 	ret.Init(g, a, b, false)
@@ -371,6 +394,10 @@ func Compare(g *genomes.Genomes, a, b int) Comparison {
 			ret.Insertions = append(ret.Insertions, pos)
 		} else if bNt == '-' {
 			ret.Deletions = append(ret.Deletions, pos)
+		} else if genomes.NtsCompatible(aNt, bNt) {
+			ret.Ambiguous = append(ret.Ambiguous,
+				NtMut{Mut{aNt, bNt, pos}, silence})
+			return false
 		} else {
 			ret.NtMuts = append(ret.NtMuts,
 				NtMut{Mut{aNt, bNt, pos}, silence})
@@ -378,24 +405,35 @@ func Compare(g *genomes.Genomes, a, b int) Comparison {
 		return true
 	}
 
-	// First find the mutations in ORFs
-	for _, aCodon := range genomes.Translate(g, a) {
+	// First find the mutations in ORFs. The codons in both translations come
+	// from the same positions, which aren't always contiguous if the ORFs are
+	// spliced. A nt can be in more than one codon (at a frameshift, or where
+	// ORFs overlap) but we only report it once.
+	seen := make([]bool, g.Length())
+	bTrans := genomes.Translate(g, b)
+	for i, aCodon := range genomes.Translate(g, a) {
 		pos := aCodon.Pos
-		if pos+3 >= len(g.Nts[b]) {
+		if i >= len(bTrans) || bTrans[i].Positions != aCodon.Positions {
 			break
 		}
-		bNts := string(g.Nts[b][pos : pos+3])
+		bCodon := bTrans[i]
 
-		if aCodon.Nts == bNts {
+		if aCodon.Nts == bCodon.Nts {
 			continue
 		}
 
-		var bCodon genomes.Codon
-		bCodon.Init(pos, bNts)
 		var silence utils.Silence
 		var isMut bool
 
 		isMut = aCodon.Aa != '-' && bCodon.Aa != '-'
+
+		// If the codons could be the same once you resolve the ambiguities
+		// then any difference in the translation isn't real either.
+		if isMut && compatibleCodons(aCodon.Nts, bCodon.Nts) {
+			isMut = false
+			silence = utils.SILENT
+		}
+
 		if isMut {
 			if aCodon.Aa == bCodon.Aa {
 				silence = utils.SILENT
@@ -404,12 +442,12 @@ func Compare(g *genomes.Genomes, a, b int) Comparison {
 			}
 		}
 
-		for j, aNt := range []byte(aCodon.Nts) {
-			bNt := bCodon.Nts[j]
-
-			if !handleNtMut(aNt, bNt, silence, pos+j) {
+		for _, ntPos := range aCodon.Positions {
+			if seen[ntPos] {
 				continue
 			}
+			seen[ntPos] = true
+			handleNtMut(g.Nts[a][ntPos], g.Nts[b][ntPos], silence, ntPos)
 		}
 
 		if isMut && silence == utils.NON_SILENT {
@@ -417,15 +455,27 @@ func Compare(g *genomes.Genomes, a, b int) Comparison {
 		}
 	}
 
-	// And now any outside them.
-	start := 0
+	// And now any outside them, up to the end of the last ORF. The introns
+	// of spliced ORFs are outside them too.
+	coding := make([]bool, g.Length())
+	var end int
 	for _, orf := range g.Orfs {
-		for i := start; i < orf.Start; i++ {
-			aNt, bNt := g.Nts[a][i], g.Nts[b][i]
-			handleNtMut(aNt, bNt, utils.NOT_IN_ORF, i)
-
+		for _, seg := range orf.Segments {
+			for i := seg.Start; i < seg.End && i < len(coding); i++ {
+				coding[i] = true
+			}
+		}
+		if orf.Segments == nil {
+			for i := orf.Start; i < orf.End && i < len(coding); i++ {
+				coding[i] = true
+			}
+		}
+		end = utils.Max(end, orf.End)
+	}
+	for i := 0; i < end && i < len(coding); i++ {
+		if !coding[i] {
+			handleNtMut(g.Nts[a][i], g.Nts[b][i], utils.NOT_IN_ORF, i)
 		}
-		start = orf.End
 	}
 
 	slices.Sort(ret.Insertions)
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Where things live on this machine. Each setting comes from (in order of
+preference) whatever the program sets explicitly with Set, an environment
+variable, the config file, and then a default. The config file is JSON with
+the same names as the environment variables but in lower case without the
+GENOMICS_ prefix, e.g. {"genomes": "/data/genomes", "tmp": "/scratch"}, and
+lives in $GENOMICS_CONFIG or genomics/config.json in the user config directory
+(~/.config on Linux). Database, Index and BlastDbDir default to somewhere
+under Genomes so you don't need to set them if you keep things in the usual
+layout.
+*/
+type Config struct {
+	Genomes    string `json:"genomes"`      // Root of all the genome data
+	Database   string `json:"database"`     // The GISAID database gob file
+	Index      string `json:"index"`        // The SARS2 index
+	BlastBin   string `json:"blast_bin"`    // Directory with blastn in it
+	BlastDbDir string `json:"blast_db_dir"` // Prefix for blast databases
+	BlastDb    string `json:"blast_db"`     // Blast db, relative to a genome
+	Tmp        string `json:"tmp"`          // For temporary files
+	Reads      string `json:"reads"`        // Raw reads (fastq and pileups)
+}
+
+const CONFIG_ENV = "GENOMICS_CONFIG"
+
+// The environment variables for each setting
+var envVars = []struct {
+	name  string
+	field func(c *Config) *string
+}{
+	{"GENOMICS_GENOMES", func(c *Config) *string { return &c.Genomes }},
+	{"GENOMICS_DATABASE", func(c *Config) *string { return &c.Database }},
+	{"GENOMICS_INDEX", func(c *Config) *string { return &c.Index }},
+	{"GENOMICS_BLAST_BIN", func(c *Config) *string { return &c.BlastBin }},
+	{"GENOMICS_BLAST_DB_DIR", func(c *Config) *string { return &c.BlastDbDir }},
+	{"GENOMICS_BLAST_DB", func(c *Config) *string { return &c.BlastDb }},
+	{"GENOMICS_TMP", func(c *Config) *string { return &c.Tmp }},
+	{"GENOMICS_READS", func(c *Config) *string { return &c.Reads }},
+}
+
+// Where the config file is (or would be)
+func File() string {
+	if fname := os.Getenv(CONFIG_ENV); fname != "" {
+		return fname
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "genomics", "config.json")
+}
+
+// Read a config file. Anything it doesn't mention is left empty.
+func ReadFile(fname string) (*Config, error) {
+	var ret Config
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, fmt.Errorf("Bad config file %s: %w", fname, err)
+	}
+	return &ret, nil
+}
+
+// Fill in anything that's empty in c from other
+func (c *Config) merge(other *Config) {
+	for _, v := range envVars {
+		if dest := v.field(c); *dest == "" {
+			*dest = *v.field(other)
+		}
+	}
+}
+
+func (c *Config) fillDefaults() {
+	if c.Genomes == "" {
+		c.Genomes = "/fs/f/genomes"
+	}
+	if c.Database == "" {
+		c.Database = filepath.Join(c.Genomes, "GISAID", "gisaid2020.gob")
+	}
+	if c.Index == "" {
+		c.Index = filepath.Join(c.Genomes, "viruses", "SARS2", "index")
+	}
+	if c.BlastBin == "" {
+		c.BlastBin = "/fs/f/Downloads/ncbi-blast-2.16.0+/bin"
+	}
+	if c.BlastDbDir == "" {
+		c.BlastDbDir = c.Genomes
+	}
+	if c.BlastDb == "" {
+		c.BlastDb = "blast/nucl/nt"
+	}
+	if c.Tmp == "" {
+		c.Tmp = os.TempDir()
+	}
+	if c.Reads == "" {
+		c.Reads = "/fs/bowser/genomes/raw_reads"
+	}
+}
+
+/*
+Work out the config from explicit (which can be nil), the environment and the
+config file. It's only an error if the config file is there but we can't
+read it, or GENOMICS_CONFIG names one that isn't there.
+*/
+func TryLoad(explicit *Config) (*Config, error) {
+	var ret Config
+	if explicit != nil {
+		ret = *explicit
+	}
+
+	var env Config
+	for _, v := range envVars {
+		*v.field(&env) = os.Getenv(v.name)
+	}
+	ret.merge(&env)
+
+	// It's fine not to have a config file unless you've said where it is
+	mustExist := os.Getenv(CONFIG_ENV) != ""
+	if fname := File(); fname != "" {
+		file, err := ReadFile(fname)
+		switch {
+		case err == nil:
+			ret.merge(file)
+		case mustExist || !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+
+	ret.fillDefaults()
+	return &ret, nil
+}
+
+var (
+	current *Config
+	mutex   sync.Mutex
+)
+
+/*
+The config for this program, worked out the first time it's needed. Exits if
+the config file is broken.
+*/
+func Get() *Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		c, err := TryLoad(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		current = c
+	}
+	return current
+}
+
+/*
+Override some settings, e.g. from command line flags. Anything empty in c
+still comes from the environment, config file or defaults.
+*/
+func Set(c *Config) error {
+	loaded, err := TryLoad(c)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	current = loaded
+	return nil
+}
+
+// A path relative to the genomes root
+func (c *Config) GenomesPath(elems ...string) string {
+	return filepath.Join(append([]string{c.Genomes}, elems...)...)
+}
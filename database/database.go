@@ -1,13 +1,11 @@
 package database
 
 import (
-	"bufio"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"genomics/config"
 	"genomics/genomes"
 	"genomics/utils"
-	"io"
 	"log"
 	"os"
 	"reflect"
@@ -16,11 +14,6 @@ import (
 	"time"
 )
 
-const (
-	ROOT     = "/fs/f/genomes/GISAID/"
-	GOB_NAME = ROOT + "gisaid2020.gob"
-)
-
 // These are actually just indexes into Database.Records
 type Id int
 
@@ -187,6 +180,9 @@ type Record struct {
 	// The real SRAs, once you unwrap those wrappers. Usually there's only one
 	// but there can be more.
 	SRA []string
+
+	// The metadata file this came from (see Merge)
+	Source string
 }
 
 func (r *Record) ToString() string {
@@ -273,11 +269,96 @@ type AAMutationPos struct {
 	Pos  utils.OneBasedPos
 }
 
+// A nucleotide change without the silence, for indexing
+type NtAllele struct {
+	Pos      utils.OneBasedPos
+	From, To byte
+}
+
+func (m *Mutation) Allele() NtAllele {
+	return NtAllele{m.Pos, m.From, m.To}
+}
+
+type AAAllele struct {
+	Gene     string
+	Pos      utils.OneBasedPos
+	From, To byte
+}
+
+func (m *AAMutation) Allele() AAAllele {
+	return AAAllele{m.Gene, m.Pos, m.From, m.To}
+}
+
+type MatchMode int
+
+const (
+	EXACT_MATCH MatchMode = iota // Same position and same change
+	ANY_CHANGE                   // Anything different at the same position
+)
+
+type RangeEntry struct {
+	Range
+	Id Id
+}
+
+/*
+Index of deletions or insertions so you can find the ones overlapping a
+range. Entries are sorted by Start, and since nothing is longer than
+MaxLength we know where to stop looking.
+*/
+type RangeIndex struct {
+	Entries   []RangeEntry
+	MaxLength utils.OneBasedPos
+}
+
+func (ri *RangeIndex) Add(r Range, id Id) {
+	ri.Entries = append(ri.Entries, RangeEntry{r, id})
+	ri.MaxLength = max(ri.MaxLength, r.End-r.Start)
+}
+
+// Get rid of everything belonging to ids
+func (ri *RangeIndex) Remove(ids IdSet) {
+	ri.Entries = slices.DeleteFunc(ri.Entries, func(e RangeEntry) bool {
+		return ids[e.Id]
+	})
+}
+
+// Call this when you've finished adding things
+func (ri *RangeIndex) Sort() {
+	slices.SortFunc(ri.Entries, func(a, b RangeEntry) int {
+		return int(a.Start - b.Start)
+	})
+}
+
+// Ids with something overlapping r
+func (ri *RangeIndex) Search(r Range) IdSet {
+	ret := make(IdSet)
+	first, _ := slices.BinarySearchFunc(ri.Entries, r.Start-ri.MaxLength,
+		func(e RangeEntry, start utils.OneBasedPos) int {
+			return int(e.Start - start)
+		})
+	for _, e := range ri.Entries[first:] {
+		if e.Start > r.End {
+			break
+		}
+		if e.End >= r.Start {
+			ret[e.Id] = true
+		}
+	}
+	return ret
+}
+
 type Database struct {
 	Records         []Record
 	MutationIndex   map[utils.OneBasedPos]IdSet
 	AAMutationIndex map[AAMutationPos]IdSet
 	AccessionIndex  map[string]Id
+
+	// These know what the change was, not just where it was
+	AlleleIndex    map[NtAllele]IdSet
+	AAAlleleIndex  map[AAAllele]IdSet
+	DeletionIndex  *RangeIndex
+	InsertionIndex *RangeIndex
 }
 
 type NtMutationIndexSearch struct {
@@ -292,6 +373,7 @@ type MutationSearchResult struct {
 
 func NewNtMutationIndexSearch(db *Database,
 	keys []utils.OneBasedPos) *NtMutationIndexSearch {
+	db.EnsureMutationIndices()
 	return &NtMutationIndexSearch{keys, db.MutationIndex}
 }
 
@@ -311,6 +393,7 @@ type AAMutationIndexSearch struct {
 
 func NewAAMutationIndexSearch(db *Database,
 	keys []AAMutationPos) *AAMutationIndexSearch {
+	db.EnsureMutationIndices()
 	return &AAMutationIndexSearch{keys, db.AAMutationIndex}
 }
 
@@ -329,11 +412,39 @@ func (mi *AAMutationIndexSearch) NumKeys() int {
 	return len(mi.keys)
 }
 
+// Search an index keyed by the full change
+type AlleleIndexSearch[K comparable] struct {
+	keys  []K
+	index map[K]IdSet
+}
+
+func (ai *AlleleIndexSearch[K]) Get(i int) (IdSet, bool) {
+	matches, there := ai.index[ai.keys[i]]
+	return matches, there
+}
+
+func (ai *AlleleIndexSearch[K]) NumKeys() int {
+	return len(ai.keys)
+}
+
+func NewNtAlleleIndexSearch(db *Database,
+	keys []NtAllele) *AlleleIndexSearch[NtAllele] {
+	db.EnsureMutationIndices()
+	return &AlleleIndexSearch[NtAllele]{keys, db.AlleleIndex}
+}
+
+func NewAAAlleleIndexSearch(db *Database,
+	keys []AAAllele) *AlleleIndexSearch[AAAllele] {
+	db.EnsureMutationIndices()
+	return &AlleleIndexSearch[AAAllele]{keys, db.AAAlleleIndex}
+}
+
 func (d *Database) Init() {
 	d.Records = make([]Record, 0)
 }
 
 func (d *Database) Add(r *Record) {
+	d.invalidateIndices()
 	r.Id = Id(len(d.Records))
 	d.Records = append(d.Records, *r)
 }
@@ -342,28 +453,113 @@ func (d *Database) Get(id Id) *Record {
 	return &d.Records[id]
 }
 
+func addToIndex[K comparable](index map[K]IdSet, key K, id Id) {
+	if _, there := index[key]; !there {
+		index[key] = make(IdSet)
+	}
+	index[key][id] = true
+}
+
+/*
+Builds the position, allele, deletion and insertion indices. Databases saved
+before there were allele indices will need this doing again after Load.
+*/
 func (d *Database) BuildMutationIndices() {
 	d.MutationIndex = make(map[utils.OneBasedPos]IdSet)
 	d.AAMutationIndex = make(map[AAMutationPos]IdSet)
+	d.AlleleIndex = make(map[NtAllele]IdSet)
+	d.AAAlleleIndex = make(map[AAAllele]IdSet)
+	d.DeletionIndex = new(RangeIndex)
+	d.InsertionIndex = new(RangeIndex)
 
-	for i, r := range d.Records {
-		for _, mut := range r.NucleotideChanges {
-			if _, there := d.MutationIndex[mut.Pos]; !there {
-				d.MutationIndex[mut.Pos] = make(IdSet)
-			}
-			d.MutationIndex[mut.Pos][Id(i)] = true
-		}
+	for i := range d.Records {
+		d.indexRecord(Id(i))
+	}
+	d.DeletionIndex.Sort()
+	d.InsertionIndex.Sort()
+}
 
-		for _, mut := range r.AAChanges {
-			key := AAMutationPos{mut.Gene, mut.Pos}
-			if _, there := d.AAMutationIndex[key]; !there {
-				d.AAMutationIndex[key] = make(IdSet)
-			}
-			d.AAMutationIndex[key][Id(i)] = true
+func removeFromIndex[K comparable](index map[K]IdSet, key K, id Id) {
+	if ids, there := index[key]; there {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(index, key)
 		}
 	}
 }
 
+/*
+Add one record to the mutation indices, which must exist. The range indices
+need sorting afterwards.
+*/
+func (d *Database) indexRecord(id Id) {
+	r := &d.Records[id]
+	for _, mut := range r.NucleotideChanges {
+		addToIndex(d.MutationIndex, mut.Pos, id)
+		addToIndex(d.AlleleIndex, mut.Allele(), id)
+	}
+
+	for _, mut := range r.AAChanges {
+		addToIndex(d.AAMutationIndex, AAMutationPos{mut.Gene, mut.Pos}, id)
+		addToIndex(d.AAAlleleIndex, mut.Allele(), id)
+	}
+
+	for _, del := range r.Deletions {
+		d.DeletionIndex.Add(del, id)
+	}
+
+	for _, ins := range r.Insertions {
+		pos := utils.OneBasedPos(ins.Pos)
+		d.InsertionIndex.Add(Range{pos, pos}, id)
+	}
+}
+
+/*
+The opposite of indexRecord, except that it leaves the range indices alone
+since it's much quicker to do them all at once with RangeIndex.Remove.
+*/
+func (d *Database) unindexRecord(id Id) {
+	r := &d.Records[id]
+	for _, mut := range r.NucleotideChanges {
+		removeFromIndex(d.MutationIndex, mut.Pos, id)
+		removeFromIndex(d.AlleleIndex, mut.Allele(), id)
+	}
+
+	for _, mut := range r.AAChanges {
+		removeFromIndex(d.AAMutationIndex, AAMutationPos{mut.Gene, mut.Pos}, id)
+		removeFromIndex(d.AAAlleleIndex, mut.Allele(), id)
+	}
+}
+
+// Whether the indices that BuildMutationIndices makes are there
+func (d *Database) HaveMutationIndices() bool {
+	return d.MutationIndex != nil && d.AAMutationIndex != nil &&
+		d.AlleleIndex != nil && d.AAAlleleIndex != nil &&
+		d.DeletionIndex != nil && d.InsertionIndex != nil
+}
+
+/*
+Build the mutation indices if we haven't got them yet. The searches all do
+this so you only need it if you're using the indices directly. It isn't safe
+to do this from more than one goroutine at once.
+*/
+func (d *Database) EnsureMutationIndices() {
+	if !d.HaveMutationIndices() {
+		d.BuildMutationIndices()
+	}
+}
+
+// Throw away the indices because the records have changed
+func (d *Database) invalidateIndices() {
+	d.MutationIndex = nil
+	d.AAMutationIndex = nil
+	d.AlleleIndex = nil
+	d.AAAlleleIndex = nil
+	d.DeletionIndex = nil
+	d.InsertionIndex = nil
+	d.AccessionIndex = nil
+}
+
 func (d *Database) BuildAccessionIndex() {
 	d.AccessionIndex = make(map[string]Id)
 
@@ -425,18 +621,65 @@ func (d *Database) SearchByAAMutPosition(pos []AAMutationPos,
 	return d.searchByMutPosition(search, minMatches)
 }
 
+/*
+Search for records with muts. With EXACT_MATCH they have to have the same
+change, e.g. C8782T doesn't match C8782A, and with ANY_CHANGE any change at
+the same position will do.
+*/
+func (d *Database) SearchByMuts(muts Mutations,
+	minMatches int, mode MatchMode) []MutationSearchResult {
+	if mode == ANY_CHANGE {
+		pos := make([]utils.OneBasedPos, len(muts))
+		for i, mut := range muts {
+			pos[i] = mut.Pos
+		}
+		return d.SearchByMutPosition(pos, minMatches)
+	}
+
+	alleles := make([]NtAllele, len(muts))
+	for i, mut := range muts {
+		alleles[i] = mut.Allele()
+	}
+	search := NewNtAlleleIndexSearch(d, alleles)
+	return d.searchByMutPosition(search, minMatches)
+}
+
+// Like SearchByMuts but for amino acid changes
 func (d *Database) SearchByAAMut(muts AAMutations,
-	minMatches int) []MutationSearchResult {
-	pos := make([]AAMutationPos, len(muts))
+	minMatches int, mode MatchMode) []MutationSearchResult {
+	if mode == ANY_CHANGE {
+		pos := make([]AAMutationPos, len(muts))
+		for i, mut := range muts {
+			pos[i].Gene = mut.Gene
+			pos[i].Pos = mut.Pos
+		}
+		return d.SearchByAAMutPosition(pos, minMatches)
+	}
+
+	alleles := make([]AAAllele, len(muts))
 	for i, mut := range muts {
-		pos[i].Gene = mut.Gene
-		pos[i].Pos = mut.Pos
+		alleles[i] = mut.Allele()
 	}
-	search := NewAAMutationIndexSearch(d, pos)
+	search := NewAAAlleleIndexSearch(d, alleles)
 	return d.searchByMutPosition(search, minMatches)
 }
 
+// Records with a deletion overlapping r
+func (d *Database) SearchDeletions(r Range) IdSet {
+	d.EnsureMutationIndices()
+	return d.DeletionIndex.Search(r)
+}
+
+// Records with an insertion within r
+func (d *Database) SearchInsertions(r Range) IdSet {
+	d.EnsureMutationIndices()
+	return d.InsertionIndex.Search(r)
+}
+
 func (d *Database) GetByAccession(accNum ...string) []Id {
+	if d.AccessionIndex == nil {
+		d.BuildAccessionIndex()
+	}
 	ret := make([]Id, 0)
 
 	for _, an := range accNum {
@@ -448,63 +691,49 @@ func (d *Database) GetByAccession(accNum ...string) []Id {
 	return ret
 }
 
+// Save in the current format (see DB_MAGIC)
 func (d *Database) Save(fname string) {
-	fd, err := os.Create(fname)
+	err := d.TrySave(fname)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer fd.Close()
+}
 
-	fp := bufio.NewWriter(fd)
-	enc := gob.NewEncoder(fp)
-	err = enc.Encode(d)
+/*
+Load a database saved with Save, or an old gob one. The indices get built
+when they're first used.
+*/
+func (d *Database) TryLoad(fname string) error {
+	data, err := os.ReadFile(fname)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	fp.Flush()
-}
 
-func (d *Database) Load(fname string) {
-	fd, err := os.Open(fname)
+	if isNativeFormat(data) {
+		err = d.decode(data)
+	} else {
+		err = decodeGob(d, data)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Can't load database %s: %w", fname, err)
 	}
-	defer fd.Close()
+	return nil
+}
 
-	fp := bufio.NewReader(fd)
-	dec := gob.NewDecoder(fp)
-	err = dec.Decode(d)
+func (d *Database) Load(fname string) {
+	err := d.TryLoad(fname)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Start again with just what's in a metadata TSV file (see Merge)
 func (d *Database) Parse(fname string) {
 	d.Init()
-	fp := utils.NewFileReader(fname)
-	defer fp.Close()
-
-loop:
-	for count := 0; ; count++ {
-		line, err := fp.ReadString('\n')
-		switch err {
-		case io.EOF:
-			break loop
-		case nil:
-			break
-		default:
-			log.Fatal("Can't read file")
-		}
-
-		if count == 0 { // skip the headings line
-			continue
-		}
-
-		line = strings.TrimSpace(line)
-
-		var record Record
-		record.Parse(line)
-		d.Add(&record)
+	d.invalidateIndices()
+	_, err := d.Merge(fname, nil)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -595,11 +824,12 @@ func (d *Database) Filter(ids IdSet, fun func(r *Record) bool) IdSet {
 	return ret
 }
 
-func (d *Database) DetermineSilence(reference *genomes.Genomes) {
-	cache := make(map[Mutation]utils.Silence)
+type silenceCache map[Mutation]utils.Silence
 
-	determine := func(mut Mutation) utils.Silence {
-		silence, there := cache[mut]
+func (c silenceCache) determine(reference *genomes.Genomes,
+	r *Record) {
+	for i, mut := range r.NucleotideChanges {
+		silence, there := c[mut]
 		if !there {
 			isSilent, _, err := genomes.IsSilentWithReplacement(reference,
 				int(mut.Pos)-1, 0, 0, []byte{mut.To})
@@ -610,15 +840,16 @@ func (d *Database) DetermineSilence(reference *genomes.Genomes) {
 			} else {
 				silence = utils.NON_SILENT
 			}
-			cache[mut] = silence
+			c[mut] = silence
 		}
-		return silence
+		r.NucleotideChanges[i].Silence = silence
 	}
+}
 
-	for i, r := range d.Records {
-		for j, mut := range r.NucleotideChanges {
-			d.Records[i].NucleotideChanges[j].Silence = determine(mut)
-		}
+func (d *Database) DetermineSilence(reference *genomes.Genomes) {
+	cache := make(silenceCache)
+	for i := range d.Records {
+		cache.determine(reference, &d.Records[i])
 	}
 }
 
@@ -676,8 +907,20 @@ func (d *Database) Reconstruct(id Id,
 	return ret, nil
 }
 
-func NewDatabase() *Database {
+/*
+Load the database from wherever the config says it is (see config.Config).
+*/
+func NewDatabase() (*Database, error) {
+	fname := config.Get().Database
+	if _, err := os.Stat(fname); err != nil {
+		return nil, fmt.Errorf("Can't find the database (set GENOMICS_DATABASE "+
+			"or database in %s): %w", config.File(), err)
+	}
+
 	var ret Database
-	ret.Load(GOB_NAME)
-	return &ret
+	err := ret.TryLoad(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
 }
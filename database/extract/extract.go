@@ -3,13 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"genomics/config"
 	"genomics/database"
 	"genomics/genomes"
+	"log"
 	"os"
+	"path/filepath"
 )
 
-const ROOT = "/fs/f/genomes/viruses/SARS2/"
-
 func main() {
 	var (
 		reconstruct bool
@@ -24,23 +25,39 @@ func main() {
 	flag.BoolVar(&reconstruct, "reconstruct", false, "Reconstruct fasta files")
 	flag.BoolVar(&msa, "msa", false, "Output reconstruction of all inputs"+
 		" as a single multi-sequence alignment")
-	flag.StringVar(&reference, "ref", ROOT+"WH1.fasta", "Reference genome")
-	flag.StringVar(&orfs, "orfs", ROOT+"WH1.orfs", "Reference genome ORFs")
+	root := config.Get().GenomesPath("viruses", "SARS2")
+	flag.StringVar(&reference, "ref", filepath.Join(root, "WH1.fasta"),
+		"Reference genome")
+	flag.StringVar(&orfs, "orfs", filepath.Join(root, "WH1.orfs"),
+		"Reference genome ORFs")
 	flag.StringVar(&prefix, "prefix", "", "Prefix to add to output names")
 	flag.StringVar(&outName, "o", "GISAID-genomes.fasta", "Output name for msa")
 	flag.BoolVar(&check, "strict", true, "Strict checking")
 	flag.Parse()
 
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// EPI_ISL_861438 is an example with some insertions and deletions you can
 	// test on.
 
-	var g, output *genomes.Genomes
+	// Write the msa out as we go rather than holding all of it in memory
+	var g *genomes.Genomes
+	var output *genomes.FastaWriter
 	if reconstruct {
 		g = genomes.LoadGenomes(reference, orfs, false)
 		if msa {
-			output = g.Filter(0)
+			var err error
+			output, err = genomes.CreateFasta(outName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = output.WriteNts(g.Names[0], g.Nts[0])
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
@@ -76,13 +93,18 @@ func main() {
 				continue
 			}
 
-			output.Nts = append(output.Nts, rg.Nts[1])
-			output.Names = append(output.Names, prefix+rg.Names[1])
+			err = output.WriteNts(prefix+rg.Names[1], rg.Nts[1])
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
 	if output != nil {
-		output.SaveMulti(outName)
+		err := output.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 		fmt.Printf("Wrote %s\n", outName)
 	}
 }
@@ -0,0 +1,619 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"genomics/utils"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+The on-disk format. After the magic number and version there's the number of
+records and a table of columns (name and length in bytes), and then the
+columns themselves one after the other. Each column holds one field for all
+the records, so they can be decoded in parallel, and since they're found by
+name a reader skips columns it doesn't know about and leaves fields it can't
+find empty. That means adding a field to Record doesn't break old files, and
+only an incompatible change needs a new DB_VERSION. The indices aren't saved;
+they get built when they're first needed.
+
+Integers are varints. String columns have a dictionary of the distinct values
+followed by an index into it for each record, which makes things like Country
+and Host very small.
+*/
+const (
+	DB_MAGIC   = "GNDB"
+	DB_VERSION = 1
+)
+
+type colWriter struct {
+	buf []byte
+}
+
+func (w *colWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *colWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+/*
+Lists are written with their length plus 1, or 0 if they're nil, so that nil
+and empty ones both come back the way they were.
+*/
+func (w *colWriter) listLength(n int, isNil bool) {
+	if isNil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(n) + 1)
+	}
+}
+
+func (w *colWriter) bytes(b []byte) {
+	w.listLength(len(b), b == nil)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *colWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// Once anything goes wrong err is set and everything returns 0
+type colReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *colReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("Truncated or corrupt column")
+	}
+}
+
+func (r *colReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *colReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// Lengths of things, which mustn't be more than what's left
+func (r *colReader) length() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// Returns -1 for a nil list
+func (r *colReader) listLength() int {
+	n := r.uvarint()
+	if n == 0 {
+		return -1
+	}
+	n--
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail()
+		return -1
+	}
+	return int(n)
+}
+
+func (r *colReader) bytes() []byte {
+	n := r.listLength()
+	if n == -1 {
+		return nil
+	}
+	ret := make([]byte, n)
+	copy(ret, r.data[r.pos:r.pos+n])
+	r.pos += n
+	return ret
+}
+
+func (r *colReader) string() string {
+	n := r.length()
+	if r.err != nil {
+		return ""
+	}
+	ret := string(r.data[r.pos : r.pos+n])
+	r.pos += n
+	return ret
+}
+
+func (r *colReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.fail()
+		return 0
+	}
+	ret := r.data[r.pos]
+	r.pos++
+	return ret
+}
+
+// Dictionary encoding for strings that are often the same
+type stringDict struct {
+	values  []string
+	indices map[string]uint64
+}
+
+func newStringDict() *stringDict {
+	return &stringDict{make([]string, 0), make(map[string]uint64)}
+}
+
+func (d *stringDict) index(s string) uint64 {
+	i, there := d.indices[s]
+	if !there {
+		i = uint64(len(d.values))
+		d.indices[s] = i
+		d.values = append(d.values, s)
+	}
+	return i
+}
+
+func (d *stringDict) write(w *colWriter) {
+	w.uvarint(uint64(len(d.values)))
+	for _, v := range d.values {
+		w.string(v)
+	}
+}
+
+func readStringDict(r *colReader) []string {
+	n := r.length()
+	ret := make([]string, n)
+	for i := range ret {
+		ret[i] = r.string()
+	}
+	return ret
+}
+
+func lookup(r *colReader, dict []string) string {
+	i := r.uvarint()
+	if i >= uint64(len(dict)) {
+		r.fail()
+		return ""
+	}
+	return dict[i]
+}
+
+type dbColumn struct {
+	name   string
+	encode func(w *colWriter, records []Record)
+	decode func(r *colReader, records []Record)
+}
+
+func stringColumn(name string, field func(r *Record) *string) dbColumn {
+	return dbColumn{name,
+		func(w *colWriter, records []Record) {
+			dict := newStringDict()
+			var indices colWriter
+			for i := range records {
+				indices.uvarint(dict.index(*field(&records[i])))
+			}
+			dict.write(w)
+			w.buf = append(w.buf, indices.buf...)
+		},
+		func(r *colReader, records []Record) {
+			dict := readStringDict(r)
+			for i := range records {
+				*field(&records[i]) = lookup(r, dict)
+			}
+		}}
+}
+
+func intColumn(name string, field func(r *Record) *int) dbColumn {
+	return dbColumn{name,
+		func(w *colWriter, records []Record) {
+			for i := range records {
+				w.varint(int64(*field(&records[i])))
+			}
+		},
+		func(r *colReader, records []Record) {
+			for i := range records {
+				*field(&records[i]) = int(r.varint())
+			}
+		}}
+}
+
+// Dates are stored as Unix seconds, with a special value for no date
+const NO_DATE = math.MinInt64
+
+func dateColumn(name string, field func(r *Record) *time.Time) dbColumn {
+	return dbColumn{name,
+		func(w *colWriter, records []Record) {
+			for i := range records {
+				t := *field(&records[i])
+				if t.IsZero() {
+					w.varint(NO_DATE)
+				} else {
+					w.varint(t.Unix())
+				}
+			}
+		},
+		func(r *colReader, records []Record) {
+			for i := range records {
+				v := r.varint()
+				if v == NO_DATE {
+					*field(&records[i]) = time.Time{}
+				} else {
+					*field(&records[i]) = time.Unix(v, 0).UTC()
+				}
+			}
+		}}
+}
+
+/*
+Positions in the lists of mutations etc. are stored as the difference from
+the previous one, since they're nearly always in order and close together.
+*/
+var ntMutsColumn = dbColumn{"NucleotideChanges",
+	func(w *colWriter, records []Record) {
+		for i := range records {
+			muts := records[i].NucleotideChanges
+			w.listLength(len(muts), muts == nil)
+			var prev int64
+			for _, m := range muts {
+				w.varint(int64(m.Pos) - prev)
+				prev = int64(m.Pos)
+				w.buf = append(w.buf, m.From, m.To, byte(m.Silence))
+			}
+		}
+	},
+	func(r *colReader, records []Record) {
+		for i := range records {
+			n := r.listLength()
+			if n == -1 {
+				continue
+			}
+			muts := make(Mutations, n)
+			var prev int64
+			for j := range muts {
+				prev += r.varint()
+				muts[j] = Mutation{utils.OneBasedPos(prev),
+					r.byte(), r.byte(), utils.Silence(r.byte())}
+			}
+			records[i].NucleotideChanges = muts
+		}
+	}}
+
+var aaMutsColumn = dbColumn{"AAChanges",
+	func(w *colWriter, records []Record) {
+		genes := newStringDict()
+		var muts colWriter
+		for i := range records {
+			aaMuts := records[i].AAChanges
+			muts.listLength(len(aaMuts), aaMuts == nil)
+			for _, m := range aaMuts {
+				muts.uvarint(genes.index(m.Gene))
+				muts.varint(int64(m.Pos))
+				muts.buf = append(muts.buf, m.From, m.To, byte(m.Silence))
+			}
+		}
+		genes.write(w)
+		w.buf = append(w.buf, muts.buf...)
+	},
+	func(r *colReader, records []Record) {
+		genes := readStringDict(r)
+		for i := range records {
+			n := r.listLength()
+			if n == -1 {
+				continue
+			}
+			muts := make(AAMutations, n)
+			for j := range muts {
+				gene := lookup(r, genes)
+				pos := utils.OneBasedPos(r.varint())
+				muts[j] = AAMutation{Mutation{pos,
+					r.byte(), r.byte(), utils.Silence(r.byte())}, gene}
+			}
+			records[i].AAChanges = muts
+		}
+	}}
+
+var deletionsColumn = dbColumn{"Deletions",
+	func(w *colWriter, records []Record) {
+		for i := range records {
+			dels := records[i].Deletions
+			w.listLength(len(dels), dels == nil)
+			var prev int64
+			for _, d := range dels {
+				w.varint(int64(d.Start) - prev)
+				w.varint(int64(d.End - d.Start))
+				prev = int64(d.Start)
+			}
+		}
+	},
+	func(r *colReader, records []Record) {
+		for i := range records {
+			n := r.listLength()
+			if n == -1 {
+				continue
+			}
+			dels := make([]Range, n)
+			var prev int64
+			for j := range dels {
+				prev += r.varint()
+				start := utils.OneBasedPos(prev)
+				dels[j] = Range{start, start + utils.OneBasedPos(r.varint())}
+			}
+			records[i].Deletions = dels
+		}
+	}}
+
+var insertionsColumn = dbColumn{"Insertions",
+	func(w *colWriter, records []Record) {
+		for i := range records {
+			insertions := records[i].Insertions
+			w.listLength(len(insertions), insertions == nil)
+			for _, ins := range insertions {
+				w.varint(int64(ins.Pos))
+				w.bytes(ins.Sequence)
+			}
+		}
+	},
+	func(r *colReader, records []Record) {
+		for i := range records {
+			n := r.listLength()
+			if n == -1 {
+				continue
+			}
+			insertions := make([]Insertion, n)
+			for j := range insertions {
+				insertions[j].Pos = int(r.varint())
+				insertions[j].Sequence = r.bytes()
+			}
+			records[i].Insertions = insertions
+		}
+	}}
+
+var sraColumn = dbColumn{"SRA",
+	func(w *colWriter, records []Record) {
+		for i := range records {
+			sras := records[i].SRA
+			w.listLength(len(sras), sras == nil)
+			for _, s := range sras {
+				w.string(s)
+			}
+		}
+	},
+	func(r *colReader, records []Record) {
+		for i := range records {
+			n := r.listLength()
+			if n == -1 {
+				continue
+			}
+			sras := make([]string, n)
+			for j := range sras {
+				sras[j] = r.string()
+			}
+			records[i].SRA = sras
+		}
+	}}
+
+// Every column we know about. Add new ones to the end.
+var dbColumns = []dbColumn{
+	stringColumn("GisaidAccession",
+		func(r *Record) *string { return &r.GisaidAccession }),
+	stringColumn("Isolate", func(r *Record) *string { return &r.Isolate }),
+	dateColumn("SubmissionDate",
+		func(r *Record) *time.Time { return &r.SubmissionDate }),
+	dateColumn("CollectionDate",
+		func(r *Record) *time.Time { return &r.CollectionDate }),
+	stringColumn("PangolinLineage",
+		func(r *Record) *string { return &r.PangolinLineage }),
+	stringColumn("Country", func(r *Record) *string { return &r.Country }),
+	stringColumn("Region", func(r *Record) *string { return &r.Region }),
+	stringColumn("City", func(r *Record) *string { return &r.City }),
+	intColumn("Length", func(r *Record) *int { return &r.Length }),
+	stringColumn("Host", func(r *Record) *string { return &r.Host }),
+	intColumn("Divergence", func(r *Record) *int { return &r.Divergence }),
+	ntMutsColumn,
+	deletionsColumn,
+	insertionsColumn,
+	aaMutsColumn,
+	stringColumn("WhoClade", func(r *Record) *string { return &r.WhoClade }),
+	stringColumn("NextstrainClade",
+		func(r *Record) *string { return &r.NextstrainClade }),
+	stringColumn("Continent", func(r *Record) *string { return &r.Continent }),
+	intColumn("ToBeExcluded", func(r *Record) *int { return &r.ToBeExcluded }),
+	stringColumn("SampleSRA", func(r *Record) *string { return &r.SampleSRA }),
+	sraColumn,
+	stringColumn("Source", func(r *Record) *string { return &r.Source }),
+}
+
+func (d *Database) TrySave(fname string) error {
+	// Encode the columns in parallel since that's where the time goes
+	encoded := make([]colWriter, len(dbColumns))
+	var wg sync.WaitGroup
+	for i, col := range dbColumns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			col.encode(&encoded[i], d.Records)
+		}()
+	}
+	wg.Wait()
+
+	var header colWriter
+	header.buf = append(header.buf, DB_MAGIC...)
+	header.buf = binary.LittleEndian.AppendUint32(header.buf, DB_VERSION)
+	header.uvarint(uint64(len(d.Records)))
+	header.uvarint(uint64(len(dbColumns)))
+	for i, col := range dbColumns {
+		header.string(col.name)
+		header.uvarint(uint64(len(encoded[i].buf)))
+	}
+
+	// Write it somewhere else first so if anything goes wrong we haven't
+	// lost the old one (which might be the gob we're migrating)
+	fd, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := fd.Name()
+
+	err = fd.Chmod(0644)
+	fp := bufio.NewWriter(fd)
+	if err == nil {
+		_, err = fp.Write(header.buf)
+	}
+	for i := 0; err == nil && i < len(encoded); i++ {
+		_, err = fp.Write(encoded[i].buf)
+	}
+	if err == nil {
+		err = fp.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fname)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Is this one of ours rather than an old gob file?
+func isNativeFormat(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(DB_MAGIC))
+}
+
+func (d *Database) decode(data []byte) error {
+	r := colReader{data: data, pos: len(DB_MAGIC)}
+	if len(data) < r.pos+4 {
+		return errors.New("Database file is truncated")
+	}
+	version := binary.LittleEndian.Uint32(data[r.pos:])
+	r.pos += 4
+	if version > DB_VERSION {
+		return fmt.Errorf("Database is version %d but we only understand "+
+			"up to %d", version, DB_VERSION)
+	}
+
+	numRecords := r.length()
+	numColumns := r.length()
+	type section struct {
+		name       string
+		start, end int
+	}
+	sections := make([]section, numColumns)
+	for i := range sections {
+		sections[i].name = r.string()
+		sections[i].end = r.length()
+	}
+	if r.err != nil {
+		return fmt.Errorf("Bad database header: %w", r.err)
+	}
+
+	pos := r.pos
+	for i := range sections {
+		length := sections[i].end
+		if length > len(data)-pos {
+			return errors.New("Database file is truncated")
+		}
+		sections[i].start, sections[i].end = pos, pos+length
+		pos += length
+	}
+
+	known := make(map[string]dbColumn)
+	for _, col := range dbColumns {
+		known[col.name] = col
+	}
+
+	records := make([]Record, numRecords)
+	for i := range records {
+		records[i].Id = Id(i)
+	}
+
+	// Each column only touches its own fields, so they can all be decoded
+	// at once
+	errs := make([]error, len(sections))
+	var wg sync.WaitGroup
+	for i, s := range sections {
+		col, there := known[s.name]
+		if !there {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cr := colReader{data: data[s.start:s.end]}
+			col.decode(&cr, records)
+			if cr.err == nil && cr.pos != len(cr.data) {
+				cr.err = errors.New("Column has extra data")
+			}
+			if cr.err != nil {
+				errs[i] = fmt.Errorf("Column %s: %w", s.name, cr.err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	*d = Database{Records: records}
+	return nil
+}
+
+func decodeGob(d *Database, data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(d)
+}
+
+/*
+Convert an old gob database to the current format. Load can read gob files
+too, so this is just to make loading quicker next time. It's fine for gobName
+and fname to be the same since the gob is only replaced once the new file has
+been written.
+*/
+func MigrateGob(gobName, fname string) error {
+	var d Database
+	err := d.TryLoad(gobName)
+	if err != nil {
+		return err
+	}
+	return d.TrySave(fname)
+}
@@ -0,0 +1,250 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"genomics/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Records with a bit of everything, including the awkward cases
+func testRecords() []Record {
+	date := func(s string) time.Time {
+		ret, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			panic(err)
+		}
+		return ret
+	}
+
+	return []Record{
+		{Id: 0, GisaidAccession: "EPI_ISL_1", Isolate: "hCoV-19/UK/1/2020",
+			SubmissionDate:  date("2021-01-02"),
+			CollectionDate:  date("2020-12-01"),
+			PangolinLineage: "B.1.1.7", Country: "UK", Region: "England",
+			City: "London", Length: 29800, Host: "Human", Divergence: 12,
+			NucleotideChanges: Mutations{
+				{241, 'C', 'T', utils.NOT_IN_ORF},
+				{23403, 'A', 'G', utils.NON_SILENT},
+				{3037, 'C', 'T', utils.SILENT}},
+			Deletions: []Range{{21765, 21770}, {11288, 11296}},
+			Insertions: []Insertion{{22204, []byte("GAGCCAGAA")},
+				{100, []byte{}}},
+			AAChanges: AAMutations{
+				{Mutation{614, 'D', 'G', utils.NON_SILENT}, "S"},
+				{Mutation{203, 'R', 'K', utils.UNKNOWN}, "N"}},
+			WhoClade: "Alpha", NextstrainClade: "20I", Continent: "Europe",
+			SampleSRA: "SRX1", SRA: []string{"SRR1", "SRR2"},
+			Source: "metadata.tsv"},
+
+		// Empty rather than nil lists, no dates and negative numbers
+		{Id: 1, GisaidAccession: "EPI_ISL_2", Country: "UK",
+			Divergence: -3, ToBeExcluded: 1,
+			NucleotideChanges: Mutations{}, Deletions: []Range{},
+			Insertions: []Insertion{}, AAChanges: AAMutations{},
+			SRA: []string{}},
+
+		// nil lists and dates before 1970
+		{Id: 2, GisaidAccession: "Bat1", Host: "Bat",
+			SubmissionDate: date("1969-12-31"),
+			CollectionDate: date("1900-01-01")},
+	}
+}
+
+func saveAndLoad(t *testing.T, d *Database) *Database {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), "db")
+	if err := d.TrySave(fname); err != nil {
+		t.Fatal(err)
+	}
+	var ret Database
+	if err := ret.TryLoad(fname); err != nil {
+		t.Fatal(err)
+	}
+	return &ret
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, records := range [][]Record{testRecords(), {}} {
+		d := Database{Records: records}
+		back := saveAndLoad(t, &d)
+		if !reflect.DeepEqual(back.Records, d.Records) {
+			t.Errorf("Records differ:\n%+v\n%+v", back.Records, d.Records)
+		}
+	}
+}
+
+// Save as if we were a version of the code with different columns
+func saveWithColumns(d *Database, fname string, columns []dbColumn) error {
+	old := dbColumns
+	dbColumns = columns
+	defer func() { dbColumns = old }()
+	return d.TrySave(fname)
+}
+
+func TestFormatUnknownColumns(t *testing.T) {
+	d := Database{Records: testRecords()}
+	fname := filepath.Join(t.TempDir(), "db")
+
+	extra := intColumn("FromTheFuture",
+		func(r *Record) *int { return &r.Length })
+	columns := append([]dbColumn{extra}, dbColumns...)
+	if err := saveWithColumns(&d, fname, columns); err != nil {
+		t.Fatal(err)
+	}
+
+	var back Database
+	if err := back.TryLoad(fname); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Records, d.Records) {
+		t.Error("Unknown column changed the records")
+	}
+}
+
+func TestFormatMissingColumns(t *testing.T) {
+	d := Database{Records: testRecords()}
+	fname := filepath.Join(t.TempDir(), "db")
+
+	// An old file from before we had sources or SRAs
+	columns := make([]dbColumn, 0)
+	for _, col := range dbColumns {
+		if col.name != "Source" && col.name != "SRA" {
+			columns = append(columns, col)
+		}
+	}
+	if err := saveWithColumns(&d, fname, columns); err != nil {
+		t.Fatal(err)
+	}
+
+	var back Database
+	if err := back.TryLoad(fname); err != nil {
+		t.Fatal(err)
+	}
+	for i := range d.Records {
+		d.Records[i].Source = ""
+		d.Records[i].SRA = nil
+	}
+	if !reflect.DeepEqual(back.Records, d.Records) {
+		t.Errorf("Records differ:\n%+v\n%+v", back.Records, d.Records)
+	}
+}
+
+func TestFormatCorrupt(t *testing.T) {
+	d := Database{Records: testRecords()}
+	fname := filepath.Join(t.TempDir(), "db")
+	if err := d.TrySave(fname); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncation should fail, and not panic
+	for n := len(DB_MAGIC); n < len(data); n++ {
+		var back Database
+		if err := back.decode(data[:n]); err == nil {
+			t.Errorf("No error when truncated to %d bytes", n)
+		}
+	}
+
+	// Corruption might happen to give something valid, but mustn't panic
+	for i := len(DB_MAGIC); i < len(data); i++ {
+		for _, b := range []byte{0x00, 0x7f, 0x80, 0xff} {
+			corrupt := bytes.Clone(data)
+			corrupt[i] = b
+			var back Database
+			back.decode(corrupt)
+		}
+	}
+
+	future := bytes.Clone(data)
+	future[len(DB_MAGIC)] = DB_VERSION + 1
+	var back Database
+	if err := back.decode(future); err == nil {
+		t.Error("No error for a newer version")
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := back.TryLoad(garbage); err == nil {
+		t.Error("No error loading garbage")
+	}
+}
+
+func TestFormatSaveFails(t *testing.T) {
+	d := Database{Records: testRecords()}
+	dir := t.TempDir()
+	if err := d.TrySave(filepath.Join(dir, "missing", "db")); err == nil {
+		t.Error("No error saving to a missing directory")
+	}
+
+	// Saving over a file replaces it and doesn't leave anything behind
+	fname := filepath.Join(dir, "db")
+	for i := 0; i < 2; i++ {
+		if err := d.TrySave(fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected just the database but there are %d files",
+			len(entries))
+	}
+}
+
+func TestMigrateGob(t *testing.T) {
+	d := Database{Records: testRecords()}
+	d.BuildAccessionIndex()
+
+	dir := t.TempDir()
+	gobName := filepath.Join(dir, "db.gob")
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gobName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// What you get by loading the gob directly (which loses the difference
+	// between nil and empty lists)
+	var fromGob Database
+	if err := fromGob.TryLoad(gobName); err != nil {
+		t.Fatal(err)
+	}
+
+	// In place, like the migrate tool does by default
+	if err := MigrateGob(gobName, gobName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(gobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNativeFormat(data) {
+		t.Fatal("Migrated database isn't in the new format")
+	}
+
+	var migrated Database
+	if err := migrated.TryLoad(gobName); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migrated.Records, fromGob.Records) {
+		t.Errorf("Records differ:\n%+v\n%+v", migrated.Records,
+			fromGob.Records)
+	}
+	if migrated.GetByAccession("Bat1")[0] != 2 {
+		t.Error("Wrong accession index after migration")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"genomics/comparison"
 	"genomics/genomes"
 	"genomics/utils"
-	"genomics/align"
 	"strings"
 )
 
@@ -116,24 +115,29 @@ func RecordFromAlignment(g *genomes.Genomes, which int,
 	return &record
 }
 
+/*
+Align each of gs to ref (with genomes.AlignPair) and call cb with a record for
+each one. If any of them can't be aligned they're skipped.
+*/
 func RecordsFromUnaligned(gs []*genomes.Genomes, ref *genomes.Genomes,
 	getHost func(i int) string,
 	convertName func(s string) string,
-	cb func (*Record)) {
-
-	alignment := make([]*genomes.Genomes, 2)
-	alignment[0] = ref
+	cb func(*Record)) {
 
 	for _, g := range gs {
-		alignment[1] = g
-		aligned, err := align.Align(alignment, "/fs/f/tmp")
+		pair, err := genomes.AlignPair(ref.Nts[0],
+			g.Nts[0], &genomes.NucleotideAlignParams)
 		if err != nil {
 			continue
 		}
 
+		aligned := genomes.NewGenomes(ref.Orfs, 2)
+		aligned.Nts[0], aligned.Nts[1] = pair.A, pair.B
+		aligned.Names[0], aligned.Names[1] = ref.Names[0], g.Names[0]
+
 		if convertName != nil {
-		aligned.Names[1] = convertName(aligned.Names[1])
-	}
+			aligned.Names[1] = convertName(aligned.Names[1])
+		}
 		cb(RecordFromAlignment(aligned, 1, nil))
 	}
 }
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"fmt"
+	"genomics/genomes"
+	"genomics/utils"
+	"io"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+The metadata fields we know about and what they're called in the various TSV
+files (GISAID's own metadata, Nextstrain's open metadata and our old
+gisaid2020.tsv). Names are compared after normalizeHeading. These are in the
+same order as the columns of the old positional format (see Record), which is
+what we fall back on if there's no heading we recognise as an accession.
+*/
+type metadataField struct {
+	names []string
+	set   func(r *Record, s string)
+}
+
+func parseDate(s string) time.Time {
+	ret, _ := time.Parse(time.DateOnly, s)
+	return ret
+}
+
+var metadataFields = []metadataField{
+	{[]string{"gisaidepiisl", "accessionid", "accession", "epiisl"},
+		func(r *Record, s string) { r.GisaidAccession = s }},
+	{[]string{"strain", "virusname", "isolate"},
+		func(r *Record, s string) { r.Isolate = s }},
+	{[]string{"datesubmitted", "submissiondate"},
+		func(r *Record, s string) { r.SubmissionDate = parseDate(s) }},
+	{[]string{"date", "collectiondate"},
+		func(r *Record, s string) { r.CollectionDate = parseDate(s) }},
+	{[]string{"pangolineage", "pangolinlineage", "lineage"},
+		func(r *Record, s string) { r.PangolinLineage = s }},
+	{[]string{"country"},
+		func(r *Record, s string) { r.Country = s }},
+	{[]string{"division", "state"},
+		func(r *Record, s string) { r.Region = s }},
+	{[]string{"location", "city"},
+		func(r *Record, s string) { r.City = s }},
+	{[]string{"length", "sequencelength"},
+		func(r *Record, s string) { r.Length = Atoi(s) }},
+	{[]string{"host"},
+		func(r *Record, s string) { r.Host = s }},
+	{[]string{"divergence"},
+		func(r *Record, s string) { r.Divergence = Atoi(s) }},
+	{[]string{"substitutions", "ntsubstitutions"},
+		func(r *Record, s string) { r.NucleotideChanges = ParseMutations(s) }},
+	{[]string{"deletions"},
+		func(r *Record, s string) { r.Deletions = ParseRanges(s) }},
+	{[]string{"insertions"},
+		func(r *Record, s string) { r.Insertions = ParseInsertions(s) }},
+	{[]string{"aasubstitutions", "aachanges"},
+		func(r *Record, s string) { r.AAChanges = ParseAAMutations(s) }},
+	{[]string{"whoclade", "cladewho"},
+		func(r *Record, s string) { r.WhoClade = s }},
+	{[]string{"nextstrainclade", "cladenextstrain", "clade"},
+		func(r *Record, s string) { r.NextstrainClade = s }},
+	{[]string{"region", "continent"},
+		func(r *Record, s string) { r.Continent = s }},
+	{[]string{"tobeexcluded", "excluded"},
+		func(r *Record, s string) { r.ToBeExcluded = Atoi(s) }},
+}
+
+// So "Accession ID", "accession_id" and "accession-id" are all the same
+func normalizeHeading(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '_', '-', '.':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(s)))
+}
+
+/*
+Which column each of metadataFields is in, or -1 if it isn't there. The first
+column with a given name wins.
+*/
+func findColumns(headings []string) []int {
+	where := make(map[string]int)
+	for i, h := range headings {
+		name := normalizeHeading(h)
+		if _, there := where[name]; !there {
+			where[name] = i
+		}
+	}
+
+	ret := make([]int, len(metadataFields))
+	for i, f := range metadataFields {
+		ret[i] = -1
+		for _, name := range f.names {
+			if col, there := where[name]; there {
+				ret[i] = col
+				break
+			}
+		}
+	}
+
+	if ret[0] == -1 {
+		for i := range ret {
+			ret[i] = i
+		}
+	}
+	return ret
+}
+
+type MergeStats struct {
+	Added     int
+	Updated   int
+	Unchanged int
+}
+
+func (m *MergeStats) ToString() string {
+	return fmt.Sprintf("%d added, %d updated, %d unchanged",
+		m.Added, m.Updated, m.Unchanged)
+}
+
+/*
+If we don't know the silence of the new mutations, keep whatever we knew
+about the old ones.
+*/
+func copySilence(from, to *Record) {
+	known := make(map[NtAllele]utils.Silence)
+	for _, mut := range from.NucleotideChanges {
+		known[mut.Allele()] = mut.Silence
+	}
+	for i, mut := range to.NucleotideChanges {
+		to.NucleotideChanges[i].Silence = known[mut.Allele()]
+	}
+}
+
+/*
+Merge in a metadata TSV file (which may be gzipped), such as a new GISAID or
+Nextstrain drop. The columns are found from the headings so the file only
+needs the ones it has something to say about, and any it leaves out (and
+things like SRAs that never come from metadata) are left alone for records we
+already have. Records are matched by accession: new ones are added, and ones
+that have changed are updated and get their Source set to the name of the
+file. If the mutation indices have been built only the changed records are
+reindexed. If reference isn't nil it's used to determine the silence of the
+changed records' mutations (see DetermineSilence). If there's an error the
+records before it will have been merged.
+*/
+func (d *Database) Merge(fname string,
+	reference *genomes.Genomes) (MergeStats, error) {
+	var stats MergeStats
+
+	fp, err := utils.OpenFileReader(fname)
+	if err != nil {
+		return stats, err
+	}
+	defer fp.Close()
+
+	if d.AccessionIndex == nil {
+		d.BuildAccessionIndex()
+	}
+	indexed := d.HaveMutationIndices()
+	source := filepath.Base(fname)
+	cache := make(silenceCache)
+
+	var columns []int
+	changed := make(IdSet)
+	removed := make(IdSet)
+
+	// Fix up the indices for whatever we've done, even if we stop early
+	if indexed {
+		defer func() {
+			d.DeletionIndex.Remove(removed)
+			d.InsertionIndex.Remove(removed)
+			for id := range changed {
+				d.indexRecord(id)
+			}
+			d.DeletionIndex.Sort()
+			d.InsertionIndex.Sort()
+		}()
+	}
+
+	for lineNum := 1; ; lineNum++ {
+		line, err := fp.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+		} else if err != nil {
+			return stats, fmt.Errorf("Can't read %s: %w", fname, err)
+		}
+
+		fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if columns == nil {
+			columns = findColumns(fields)
+			continue
+		}
+		if len(fields) == 1 && fields[0] == "" {
+			continue
+		}
+
+		if columns[0] >= len(fields) {
+			return stats, fmt.Errorf("%s line %d: only %d fields",
+				fname, lineNum, len(fields))
+		}
+
+		id, there := d.AccessionIndex[fields[columns[0]]]
+		var record Record
+		if there {
+			// Don't let the silence stuff below scribble on the original
+			record = d.Records[id]
+			record.NucleotideChanges = slices.Clone(record.NucleotideChanges)
+		}
+		for i, f := range metadataFields {
+			col := columns[i]
+			switch {
+			case col == -1:
+				continue
+			case col >= len(fields):
+				return stats, fmt.Errorf("%s line %d: only %d fields",
+					fname, lineNum, len(fields))
+			}
+			f.set(&record, fields[col])
+		}
+		if record.GisaidAccession == "" {
+			return stats, fmt.Errorf("%s line %d: no accession", fname, lineNum)
+		}
+
+		if reference != nil {
+			cache.determine(reference, &record)
+		} else if there {
+			copySilence(&d.Records[id], &record)
+		}
+
+		if !there {
+			record.Id = Id(len(d.Records))
+			record.Source = source
+			d.Records = append(d.Records, record)
+			d.AccessionIndex[record.GisaidAccession] = record.Id
+			changed[record.Id] = true
+			stats.Added++
+		} else if reflect.DeepEqual(record, d.Records[id]) {
+			stats.Unchanged++
+		} else {
+			if indexed {
+				d.unindexRecord(id)
+				removed[id] = true
+			}
+			record.Source = source
+			d.Records[id] = record
+			changed[id] = true
+			stats.Updated++
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,292 @@
+package database
+
+import (
+	"genomics/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Write a TSV file into a temporary directory and return its name
+func writeTSV(t *testing.T, name string, rows ...[]string) string {
+	t.Helper()
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		lines[i] = strings.Join(row, "\t")
+	}
+	fname := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(fname, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// A file in the old positional format, whose headings we don't recognise
+func positionalTSV(t *testing.T) string {
+	headings := make([]string, 19)
+	for i := range headings {
+		headings[i] = "col" + utils.Itoa(i)
+	}
+	return writeTSV(t, "old.tsv", headings,
+		[]string{"EPI_ISL_1", "iso1", "2021-01-02", "2020-12-01", "B.1",
+			"UK", "England", "London", "29800", "Human", "12",
+			"C241T,A23403G", "21765-21770", "22204:GAGCCAGAA",
+			"S:D614G,N:R203K", "Alpha", "20I", "Europe", "0"},
+		[]string{"EPI_ISL_2", "iso2", "2021-02-03", "2020-11-05", "B.1.1",
+			"France", "Ile-de-France", "Paris", "29750", "Human", "9",
+			"C3037T", "", "", "ORF1a:T265I", "", "20A", "Europe", "1"},
+		[]string{"EPI_ISL_3", "iso3", "2021-03-04", "2020-10-06", "A",
+			"China", "Hubei", "Wuhan", "29790", "Human", "3",
+			"T8782C,C28144T", "11288-11296,21991-21993", "", "", "", "19B",
+			"Asia", "0"})
+}
+
+func parsed(t *testing.T) *Database {
+	var d Database
+	d.Init()
+	_, err := d.Merge(positionalTSV(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &d
+}
+
+func byAccession(t *testing.T, d *Database, accession string) *Record {
+	t.Helper()
+	ids := d.GetByAccession(accession)
+	if len(ids) != 1 {
+		t.Fatalf("Found %d records for %s", len(ids), accession)
+	}
+	return d.Get(ids[0])
+}
+
+func sortedRanges(ri *RangeIndex) []RangeEntry {
+	ret := slices.Clone(ri.Entries)
+	slices.SortFunc(ret, func(a, b RangeEntry) int {
+		switch {
+		case a.Start != b.Start:
+			return int(a.Start - b.Start)
+		case a.End != b.End:
+			return int(a.End - b.End)
+		}
+		return int(a.Id - b.Id)
+	})
+	return ret
+}
+
+// Check the indices are the same as if we'd built them from scratch
+func checkIndices(t *testing.T, d *Database) {
+	t.Helper()
+	fresh := Database{Records: d.Records}
+	fresh.BuildMutationIndices()
+
+	if !reflect.DeepEqual(d.MutationIndex, fresh.MutationIndex) ||
+		!reflect.DeepEqual(d.AlleleIndex, fresh.AlleleIndex) ||
+		!reflect.DeepEqual(d.AAMutationIndex, fresh.AAMutationIndex) ||
+		!reflect.DeepEqual(d.AAAlleleIndex, fresh.AAAlleleIndex) {
+		t.Error("Mutation indices differ from a full rebuild")
+	}
+	if !reflect.DeepEqual(sortedRanges(d.DeletionIndex),
+		sortedRanges(fresh.DeletionIndex)) ||
+		!reflect.DeepEqual(sortedRanges(d.InsertionIndex),
+			sortedRanges(fresh.InsertionIndex)) {
+		t.Error("Range indices differ from a full rebuild")
+	}
+	if !slices.IsSortedFunc(d.DeletionIndex.Entries, compareRangeEntries) ||
+		!slices.IsSortedFunc(d.InsertionIndex.Entries, compareRangeEntries) {
+		t.Error("Range indices aren't sorted")
+	}
+}
+
+func compareRangeEntries(a, b RangeEntry) int {
+	return int(a.Start - b.Start)
+}
+
+func TestMergePositional(t *testing.T) {
+	d := parsed(t)
+	if len(d.Records) != 3 {
+		t.Fatalf("Got %d records", len(d.Records))
+	}
+
+	r := byAccession(t, d, "EPI_ISL_1")
+	if r.Isolate != "iso1" || r.Country != "UK" || r.Region != "England" ||
+		r.City != "London" || r.Continent != "Europe" || r.Length != 29800 ||
+		r.Divergence != 12 || r.NextstrainClade != "20I" ||
+		r.WhoClade != "Alpha" || r.Source != "old.tsv" {
+		t.Errorf("Wrong fields: %+v", r)
+	}
+	if r.NucleotideChanges.ToString() != "C241T,A23403G" ||
+		r.AAChanges.ToString() != "S:D614G,N:R203K" ||
+		r.DeletionsSummary() != "D21765-21770" || len(r.Insertions) != 1 {
+		t.Errorf("Wrong mutations: %+v", r)
+	}
+	if byAccession(t, d, "EPI_ISL_2").ToBeExcluded != 1 {
+		t.Error("Wrong ToBeExcluded")
+	}
+}
+
+func TestMergeHeadings(t *testing.T) {
+	var d Database
+	d.Init()
+
+	// Reordered, renamed and only some of the columns, with no newline at
+	// the end
+	fname := filepath.Join(t.TempDir(), "metadata.tsv")
+	err := os.WriteFile(fname, []byte(
+		"Virus name\tAccession ID\tCollection date\tPango lineage\t"+
+			"division\tregion\tsubstitutions\n"+
+			"iso9\tEPI_ISL_9\t2022-05-06\tBA.2\tBavaria\tEurope\tC241T\n"+
+			"iso10\tEPI_ISL_10\t2022-05-07\tBA.5\tTexas\tNorth America\t"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := d.Merge(fname, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (MergeStats{2, 0, 0}) {
+		t.Errorf("Wrong stats %s", stats.ToString())
+	}
+
+	r := byAccession(t, &d, "EPI_ISL_10")
+	if r.Isolate != "iso10" || r.PangolinLineage != "BA.5" ||
+		r.Region != "Texas" || r.Continent != "North America" ||
+		r.CollectionDate.Format("2006-01-02") != "2022-05-07" ||
+		r.Source != "metadata.tsv" {
+		t.Errorf("Wrong fields: %+v", r)
+	}
+}
+
+func TestMergeUpsert(t *testing.T) {
+	d := parsed(t)
+	d.Records[0].SRA = []string{"SRR1234"}
+
+	fname := writeTSV(t, "new.tsv",
+		[]string{"accession", "lineage", "country"},
+		[]string{"EPI_ISL_1", "B.1.1.7", "UK"},
+		[]string{"EPI_ISL_2", "B.1.1", "France"},
+		[]string{"EPI_ISL_4", "XBB", "India"})
+
+	stats, err := d.Merge(fname, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (MergeStats{1, 1, 1}) {
+		t.Errorf("Wrong stats %s", stats.ToString())
+	}
+
+	r := byAccession(t, d, "EPI_ISL_1")
+	if r.Id != 0 || r.PangolinLineage != "B.1.1.7" || r.Source != "new.tsv" {
+		t.Errorf("Didn't update: %+v", r)
+	}
+	if r.City != "London" || !slices.Equal(r.SRA, []string{"SRR1234"}) ||
+		r.NucleotideChanges.ToString() != "C241T,A23403G" {
+		t.Errorf("Lost fields that weren't in the file: %+v", r)
+	}
+
+	if r := byAccession(t, d, "EPI_ISL_2"); r.Source != "old.tsv" {
+		t.Errorf("Unchanged record has source %s", r.Source)
+	}
+	if r := byAccession(t, d, "EPI_ISL_4"); r.Id != 3 || r.Country != "India" {
+		t.Errorf("Didn't add: %+v", r)
+	}
+}
+
+func TestMergeUnchanged(t *testing.T) {
+	d := parsed(t)
+	d.BuildMutationIndices()
+	for i := range d.Records {
+		for j := range d.Records[i].NucleotideChanges {
+			d.Records[i].NucleotideChanges[j].Silence = utils.NON_SILENT
+		}
+	}
+	before := slices.Clone(d.Records)
+
+	// With and without the mutations, which shouldn't lose their silence
+	for _, headings := range [][]string{
+		{"accession", "country"},
+		{"accession", "country", "substitutions"}} {
+		rows := [][]string{headings}
+		for _, r := range before {
+			row := []string{r.GisaidAccession, r.Country}
+			if len(headings) == 3 {
+				row = append(row, r.NucleotideChanges.ToString())
+			}
+			rows = append(rows, row)
+		}
+
+		stats, err := d.Merge(writeTSV(t, "same.tsv", rows...), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != (MergeStats{0, 0, 3}) {
+			t.Errorf("Wrong stats %s", stats.ToString())
+		}
+		if !reflect.DeepEqual(d.Records, before) {
+			t.Error("Records changed")
+		}
+		checkIndices(t, d)
+	}
+}
+
+func TestMergeReindex(t *testing.T) {
+	d := parsed(t)
+	d.BuildMutationIndices()
+
+	fname := writeTSV(t, "new.tsv",
+		[]string{"accession", "substitutions", "deletions", "insertions",
+			"aaSubstitutions"},
+		[]string{"EPI_ISL_1", "C241T,G28881A", "", "100:AAA",
+			"S:D614G"},
+		[]string{"EPI_ISL_3", "T8782C", "11288-11296", "", "N:R203K"},
+		[]string{"EPI_ISL_5", "A23403G", "21765-21770,6000", "22204:GA",
+			"S:N501Y"})
+
+	stats, err := d.Merge(fname, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (MergeStats{1, 2, 0}) {
+		t.Errorf("Wrong stats %s", stats.ToString())
+	}
+	checkIndices(t, d)
+
+	ids := d.SearchDeletions(Range{21760, 21766})
+	if len(ids) != 1 || !ids[byAccession(t, d, "EPI_ISL_5").Id] {
+		t.Errorf("Wrong deletion search result %v", ids)
+	}
+}
+
+func TestMergeError(t *testing.T) {
+	d := parsed(t)
+	d.BuildMutationIndices()
+
+	fname := writeTSV(t, "bad.tsv",
+		[]string{"accession", "substitutions", "deletions"},
+		[]string{"EPI_ISL_1", "C3037T", "100-200"},
+		[]string{"EPI_ISL_6", "A23403G", "300-400"},
+		[]string{"EPI_ISL_2"})
+
+	_, err := d.Merge(fname, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("Expected an error on line 4, got %v", err)
+	}
+
+	// What it did before the error should still be properly indexed
+	checkIndices(t, d)
+	if byAccession(t, d, "EPI_ISL_1").NucleotideChanges.ToString() !=
+		"C3037T" {
+		t.Error("Didn't merge the rows before the error")
+	}
+
+	if _, err := d.Merge(filepath.Join(t.TempDir(), "missing.tsv"),
+		nil); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
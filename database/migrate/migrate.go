@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"genomics/config"
+	"genomics/database"
+	"log"
+)
+
+/*
+Convert an old gob database to the current format. By default it converts
+the configured database in place.
+*/
+func main() {
+	var inName, outName string
+
+	flag.StringVar(&inName, "i", "", "Gob database (default from config)")
+	flag.StringVar(&outName, "o", "", "Output (default the same as -i)")
+	flag.Parse()
+
+	if inName == "" {
+		inName = config.Get().Database
+	}
+	if outName == "" {
+		outName = inName
+	}
+
+	err := database.MigrateGob(inName, outName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %s\n", outName)
+}
@@ -5,6 +5,7 @@ import (
 	"genomics/database"
 	"genomics/stats"
 	"genomics/utils"
+	"log"
 	"slices"
 	"strings"
 	"time"
@@ -507,7 +508,10 @@ func ORF8LI(db *database.Database) {
 }
 
 func main() {
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
 	// EarlyReads(db)
 	// NonHuman(db)
 	// EarlyLineages(db)
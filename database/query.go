@@ -0,0 +1,624 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"genomics/utils"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+A small query language for the database, so you don't need to write a new
+Filter closure for every question. Some examples:
+
+	S:D614G and not C8782T
+	host = Human and collected < 2020-03-01 and (country = China or
+		country = "Hong Kong")
+	lineage ~ "B.1.1.*" and del:21765-21770
+	ORF8:10 and nmuts <= 3
+
+Terms are:
+
+	C8782T              that exact nucleotide change
+	pos:8782            any nucleotide change at 8782
+	S:D614G             that exact amino acid change
+	S:614               any amino acid change at S:614
+	del:21765-21770     a deletion overlapping that range (or del:21765)
+	ins:22204           an insertion somewhere in that range (or position)
+	field op value      compare a field of the record
+
+The string fields are accession, isolate, lineage, country, region, city,
+host, who, nextstrain, continent and source and they can be compared with =
+and != (ignoring case) or ~ which does a glob match. The numeric fields are
+length, divergence, nmuts, naamuts, ndeletions, ninsertions and nsras, and the
+dates (YYYY-MM-DD) are collected and submitted. They can all be compared with
+=, !=, <, <=, > and >=. Terms are combined with and, or, not and brackets.
+Mutation terms, deletions and insertions are looked up in the indices rather
+than scanning every record.
+*/
+type Query struct {
+	Source string
+	root   queryNode
+}
+
+type queryNode interface {
+	// Which of candidates (nil means all the records) match
+	eval(d *Database, candidates IdSet) IdSet
+
+	// Whether this can be done with the indices, which is a lot quicker
+	indexed() bool
+}
+
+// Only the ids in both. nil for a means everything.
+func intersect(a, b IdSet) IdSet {
+	if a == nil {
+		return b
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	ret := make(IdSet)
+	for id := range a {
+		if b[id] {
+			ret[id] = true
+		}
+	}
+	return ret
+}
+
+func (d *Database) all() IdSet {
+	ret := make(IdSet, len(d.Records))
+	for i := range d.Records {
+		ret[Id(i)] = true
+	}
+	return ret
+}
+
+type andNode []queryNode
+
+func (n andNode) eval(d *Database, candidates IdSet) IdSet {
+	// Do the quick ones first so the rest have fewer records to look at
+	children := slices.Clone(n)
+	slices.SortStableFunc(children, func(a, b queryNode) int {
+		switch {
+		case a.indexed() && !b.indexed():
+			return -1
+		case !a.indexed() && b.indexed():
+			return 1
+		}
+		return 0
+	})
+
+	ret := candidates
+	for _, c := range children {
+		ret = c.eval(d, ret)
+		if len(ret) == 0 {
+			break
+		}
+	}
+	return ret
+}
+
+func (n andNode) indexed() bool {
+	for _, c := range n {
+		if c.indexed() {
+			return true
+		}
+	}
+	return false
+}
+
+type orNode []queryNode
+
+func (n orNode) eval(d *Database, candidates IdSet) IdSet {
+	ret := make(IdSet)
+	for _, c := range n {
+		for id := range c.eval(d, candidates) {
+			ret[id] = true
+		}
+	}
+	return ret
+}
+
+func (n orNode) indexed() bool {
+	for _, c := range n {
+		if !c.indexed() {
+			return false
+		}
+	}
+	return true
+}
+
+type notNode struct {
+	child queryNode
+}
+
+func (n notNode) eval(d *Database, candidates IdSet) IdSet {
+	if candidates == nil {
+		candidates = d.all()
+	}
+	exclude := n.child.eval(d, candidates)
+	ret := make(IdSet)
+	for id := range candidates {
+		if !exclude[id] {
+			ret[id] = true
+		}
+	}
+	return ret
+}
+
+func (n notNode) indexed() bool {
+	return false
+}
+
+/*
+Only the ids in set that are also in candidates (or all of them if candidates
+is nil). Always makes a new set, since set is usually one of the indices.
+*/
+func restrict(candidates, set IdSet) IdSet {
+	ret := make(IdSet)
+	for id := range intersect(candidates, set) {
+		ret[id] = true
+	}
+	return ret
+}
+
+// A nucleotide change. anyChange means any change at Pos will do.
+type ntMutNode struct {
+	mut       Mutation
+	anyChange bool
+}
+
+func (n ntMutNode) eval(d *Database, candidates IdSet) IdSet {
+	if n.anyChange {
+		return restrict(candidates, d.MutationIndex[n.mut.Pos])
+	}
+	return restrict(candidates, d.AlleleIndex[n.mut.Allele()])
+}
+
+func (n ntMutNode) indexed() bool {
+	return true
+}
+
+type aaMutNode struct {
+	mut       AAMutation
+	anyChange bool
+}
+
+func (n aaMutNode) eval(d *Database, candidates IdSet) IdSet {
+	if n.anyChange {
+		key := AAMutationPos{n.mut.Gene, n.mut.Pos}
+		return restrict(candidates, d.AAMutationIndex[key])
+	}
+	return restrict(candidates, d.AAAlleleIndex[n.mut.Allele()])
+}
+
+func (n aaMutNode) indexed() bool {
+	return true
+}
+
+// Anything else has to look at each record
+type filterNode func(r *Record) bool
+
+func (n filterNode) eval(d *Database, candidates IdSet) IdSet {
+	return d.Filter(candidates, n)
+}
+
+func (n filterNode) indexed() bool {
+	return false
+}
+
+// Deletions overlapping r or insertions within it
+type rangeNode struct {
+	r         Range
+	insertion bool
+}
+
+func (n rangeNode) eval(d *Database, candidates IdSet) IdSet {
+	if n.insertion {
+		return intersect(candidates, d.SearchInsertions(n.r))
+	}
+	return intersect(candidates, d.SearchDeletions(n.r))
+}
+
+func (n rangeNode) indexed() bool {
+	return true
+}
+
+type queryField struct {
+	str  func(r *Record) string
+	num  func(r *Record) int
+	date func(r *Record) time.Time
+}
+
+var queryFields = map[string]queryField{
+	"accession":  {str: func(r *Record) string { return r.GisaidAccession }},
+	"isolate":    {str: func(r *Record) string { return r.Isolate }},
+	"lineage":    {str: func(r *Record) string { return r.PangolinLineage }},
+	"country":    {str: func(r *Record) string { return r.Country }},
+	"region":     {str: func(r *Record) string { return r.Region }},
+	"city":       {str: func(r *Record) string { return r.City }},
+	"host":       {str: func(r *Record) string { return r.Host }},
+	"who":        {str: func(r *Record) string { return r.WhoClade }},
+	"nextstrain": {str: func(r *Record) string { return r.NextstrainClade }},
+	"continent":  {str: func(r *Record) string { return r.Continent }},
+	"source":     {str: func(r *Record) string { return r.Source }},
+
+	"length":     {num: func(r *Record) int { return r.Length }},
+	"divergence": {num: func(r *Record) int { return r.Divergence }},
+	"nmuts":      {num: func(r *Record) int { return len(r.NucleotideChanges) }},
+	"naamuts":    {num: func(r *Record) int { return len(r.AAChanges) }},
+	"ndeletions": {num: func(r *Record) int { return len(r.Deletions) }},
+	"ninsertions": {num: func(r *Record) int {
+		return len(r.Insertions)
+	}},
+	"nsras": {num: func(r *Record) int { return len(r.SRA) }},
+
+	"collected": {date: func(r *Record) time.Time { return r.CollectionDate }},
+	"submitted": {date: func(r *Record) time.Time { return r.SubmissionDate }},
+}
+
+// Turn the result of a comparison into whether op is satisfied
+func compareOp(op string, cmp int) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func fieldNode(name, op, value string) (queryNode, error) {
+	field, there := queryFields[strings.ToLower(name)]
+	if !there {
+		return nil, fmt.Errorf("Unknown field %s", name)
+	}
+
+	switch {
+	case field.str != nil:
+		switch op {
+		case "=", "!=":
+			want := op == "="
+			return filterNode(func(r *Record) bool {
+				return strings.EqualFold(field.str(r), value) == want
+			}), nil
+		case "~":
+			pattern := strings.ToLower(value)
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("Bad pattern %s: %w", value, err)
+			}
+			return filterNode(func(r *Record) bool {
+				matched, _ := path.Match(pattern, strings.ToLower(field.str(r)))
+				return matched
+			}), nil
+		}
+		return nil, fmt.Errorf("Can't use %s with %s", op, name)
+	case field.num != nil:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, not %s", name, value)
+		}
+		if op == "~" {
+			return nil, fmt.Errorf("Can't use %s with %s", op, name)
+		}
+		return filterNode(func(r *Record) bool {
+			v := field.num(r)
+			var cmp int
+			switch {
+			case v < n:
+				cmp = -1
+			case v > n:
+				cmp = 1
+			}
+			return compareOp(op, cmp)
+		}), nil
+	default:
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a date (YYYY-MM-DD), not %s",
+				name, value)
+		}
+		if op == "~" {
+			return nil, fmt.Errorf("Can't use %s with %s", op, name)
+		}
+		return filterNode(func(r *Record) bool {
+			return compareOp(op, field.date(r).Compare(t))
+		}), nil
+	}
+}
+
+func parseQueryRange(s string) (Range, error) {
+	var ret Range
+	fields := strings.Split(s, "-")
+	if len(fields) > 2 {
+		return ret, fmt.Errorf("Invalid range %s", s)
+	}
+	start, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return ret, fmt.Errorf("Invalid range %s", s)
+	}
+	end := start
+	if len(fields) == 2 {
+		end, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return ret, fmt.Errorf("Invalid range %s", s)
+		}
+	}
+	return Range{utils.OneBasedPos(start), utils.OneBasedPos(end)}, nil
+}
+
+/*
+Parse something like D614G (or just 614 if anyChange is allowed) into a
+Mutation.
+*/
+func parseQueryMutation(s string) (Mutation, bool, error) {
+	var ret Mutation
+	if pos, err := strconv.Atoi(s); err == nil {
+		ret.Pos = utils.OneBasedPos(pos)
+		return ret, true, nil
+	}
+
+	n := len(s)
+	if n < 3 {
+		return ret, false, fmt.Errorf("Invalid mutation %s", s)
+	}
+	pos, err := strconv.Atoi(s[1 : n-1])
+	if err != nil || unicode.IsDigit(rune(s[0])) ||
+		unicode.IsDigit(rune(s[n-1])) {
+		return ret, false, fmt.Errorf("Invalid mutation %s", s)
+	}
+	ret = Mutation{utils.OneBasedPos(pos), s[0], s[n-1], 0}
+	return ret, false, nil
+}
+
+// A term that isn't a field comparison
+func termNode(s string) (queryNode, error) {
+	prefix, rest, hasColon := strings.Cut(s, ":")
+	if !hasColon {
+		// Allow the silence markers Mutation.ToString adds, so you can paste
+		// its output straight in
+		s = strings.TrimRight(s, "*@")
+		mut, anyChange, err := parseQueryMutation(s)
+		if err != nil {
+			return nil, err
+		}
+		if anyChange {
+			return nil, fmt.Errorf("Use pos:%s for any change at a position", s)
+		}
+		return ntMutNode{mut, false}, nil
+	}
+
+	switch strings.ToLower(prefix) {
+	case "pos":
+		pos, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid position %s", rest)
+		}
+		return ntMutNode{Mutation{Pos: utils.OneBasedPos(pos)}, true}, nil
+	case "del":
+		r, err := parseQueryRange(rest)
+		if err != nil {
+			return nil, err
+		}
+		return rangeNode{r, false}, nil
+	case "ins":
+		r, err := parseQueryRange(rest)
+		if err != nil {
+			return nil, err
+		}
+		return rangeNode{r, true}, nil
+	}
+
+	mut, anyChange, err := parseQueryMutation(rest)
+	if err != nil {
+		return nil, err
+	}
+	return aaMutNode{AAMutation{mut, prefix}, anyChange}, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+func isQueryOp(s string) bool {
+	switch s {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+		return true
+	}
+	return false
+}
+
+func tokenizeQuery(s string) ([]queryToken, error) {
+	ret := make([]queryToken, 0)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')':
+			ret = append(ret, queryToken{s[i : i+1], false})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end == -1 {
+				return nil, errors.New("Unterminated string in query")
+			}
+			ret = append(ret, queryToken{s[i+1 : i+1+end], true})
+			i += end + 2
+		case strings.IndexByte("=!<>~", c) != -1:
+			op := s[i : i+1]
+			if i+1 < len(s) && s[i+1] == '=' {
+				op = s[i : i+2]
+			}
+			if !isQueryOp(op) {
+				return nil, fmt.Errorf("Unknown operator %s in query", op)
+			}
+			ret = append(ret, queryToken{op, false})
+			i += len(op)
+		default:
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) &&
+				strings.IndexByte("()\"'=!<>~", s[i]) == -1 {
+				i++
+			}
+			ret = append(ret, queryToken{s[start:i], false})
+		}
+	}
+	return ret, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// Is the next token the keyword (or bracket) s?
+func (p *queryParser) isNext(s string) bool {
+	t, ok := p.peek()
+	return ok && !t.quoted && strings.EqualFold(t.text, s)
+}
+
+func (p *queryParser) or() (queryNode, error) {
+	ret := make(orNode, 0)
+	for {
+		n, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+		if !p.isNext("or") {
+			break
+		}
+		p.pos++
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *queryParser) and() (queryNode, error) {
+	ret := make(andNode, 0)
+	for {
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+		if !p.isNext("and") {
+			break
+		}
+		p.pos++
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *queryParser) not() (queryNode, error) {
+	if p.isNext("not") {
+		p.pos++
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.atom()
+}
+
+func (p *queryParser) atom() (queryNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("Unexpected end of query")
+	}
+	p.pos++
+
+	if !t.quoted {
+		switch {
+		case t.text == "(":
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isNext(")") {
+				return nil, errors.New("Missing ) in query")
+			}
+			p.pos++
+			return n, nil
+		case t.text == ")" || isQueryOp(t.text):
+			return nil, fmt.Errorf("Unexpected %s in query", t.text)
+		}
+	}
+
+	// Is it a comparison?
+	if op, ok := p.peek(); ok && !op.quoted && isQueryOp(op.text) {
+		p.pos++
+		value, ok := p.peek()
+		if !ok {
+			return nil, fmt.Errorf("Missing value after %s %s", t.text, op.text)
+		}
+		p.pos++
+		return fieldNode(t.text, op.text, value.text)
+	}
+
+	return termNode(t.text)
+}
+
+func ParseQuery(s string) (*Query, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty query")
+	}
+
+	p := queryParser{tokens, 0}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %s in query", p.tokens[p.pos].text)
+	}
+	return &Query{s, root}, nil
+}
+
+// Which records match. Builds the mutation indices if there aren't any yet.
+func (q *Query) Run(d *Database) IdSet {
+	d.EnsureMutationIndices()
+	return q.root.eval(d, nil)
+}
+
+func (d *Database) Query(s string) (IdSet, error) {
+	q, err := ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(d), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"genomics/database"
+	"genomics/utils"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func insertions(r *database.Record) string {
+	s := make([]string, len(r.Insertions))
+	for i, ins := range r.Insertions {
+		s[i] = fmt.Sprintf("%d:%s", ins.Pos, string(ins.Sequence))
+	}
+	return strings.Join(s, ",")
+}
+
+func writeTSV(w *bufio.Writer, r *database.Record) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		r.GisaidAccession,
+		r.CollectionDate.Format(time.DateOnly),
+		r.Country,
+		r.Region,
+		r.City,
+		r.Host,
+		r.PangolinLineage,
+		r.NucleotideChanges.ToString(),
+		r.AAChanges.ToString(),
+		r.DeletionsSummary(),
+		insertions(r),
+		r.SRAs(),
+		r.Isolate)
+}
+
+func main() {
+	var (
+		dbName string
+		tsv    bool
+		count  bool
+	)
+
+	flag.StringVar(&dbName, "db", "", "Database file (default from config)")
+	flag.BoolVar(&tsv, "tsv", false, "Output TSV rather than summaries")
+	flag.BoolVar(&count, "count", false, "Just output the number of matches")
+	flag.Parse()
+
+	if len(flag.Args()) == 0 {
+		log.Fatal("Usage: query [options] 'S:D614G and not C8782T'")
+	}
+
+	q, err := database.ParseQuery(strings.Join(flag.Args(), " "))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var db *database.Database
+	if dbName != "" {
+		db = new(database.Database)
+		err = db.TryLoad(dbName)
+	} else {
+		db, err = database.NewDatabase()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ids := utils.FromSet(q.Run(db))
+	if count {
+		fmt.Println(len(ids))
+		return
+	}
+	db.Sort(ids, database.COLLECTION_DATE)
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if tsv {
+		fmt.Fprintln(w, "Accession\tCollected\tCountry\tRegion\tCity\tHost\t"+
+			"Lineage\tNt changes\tAA changes\tDeletions\tInsertions\tSRAs\t"+
+			"Isolate")
+	}
+	for _, id := range ids {
+		r := db.Get(id)
+		if tsv {
+			writeTSV(w, r)
+		} else {
+			fmt.Fprintln(w, r.Summary())
+		}
+	}
+}
@@ -3,24 +3,72 @@ package main
 import (
 	"flag"
 	"fmt"
+	"genomics/config"
 	"genomics/database"
 	"genomics/genomes"
+	"log"
+	"path/filepath"
 	"strings"
 )
 
+// The reference we work out silence against, with the ORFs from -orfs
+func loadReference(orfs string) *genomes.Genomes {
+	return genomes.LoadGenomes("../../fasta/WH1.fasta", orfs, false)
+}
+
+/*
+Update the existing database with new metadata drops rather than starting
+again.
+*/
+func mergeFiles(fnames []string, orfs string) {
+	if len(fnames) == 0 {
+		log.Fatal("Usage: regob -merge metadata.tsv.gz...")
+	}
+
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ref := loadReference(orfs)
+
+	for _, fname := range fnames {
+		fmt.Printf("Merging %s\n", fname)
+		stats, err := db.Merge(fname, ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", stats.ToString())
+	}
+
+	fmt.Printf("Saving %s\n", config.Get().Database)
+	db.Save(config.Get().Database)
+
+	fmt.Printf("Done\n")
+}
+
 func main() {
 	var (
 		fastaName string
 		orfs      string
 		fname     string
+		merge     bool
 	)
 
 	flag.StringVar(&fastaName, "fasta", "", "Fasta name")
 	flag.StringVar(&orfs, "orfs", "../../fasta/WH1.orfs", "ORFs file")
 	flag.StringVar(&fname,
-		"tsv", database.ROOT+"gisaid2020.tsv.gz", "Include genomes from TSV")
+		"tsv", filepath.Join(filepath.Dir(config.Get().Database),
+			"gisaid2020.tsv.gz"), "Include genomes from TSV")
+	flag.BoolVar(&merge, "merge", false,
+		"Merge the metadata files given as arguments into the existing database")
 	flag.Parse()
 
+	if merge {
+		mergeFiles(flag.Args(), orfs)
+		return
+	}
+
 	if fname == "none" {
 		fname = ""
 	}
@@ -31,14 +79,15 @@ func main() {
 		fmt.Printf("Parsing %s\n", fname)
 		db.Parse(fname)
 
-		ref := genomes.LoadGenomes("../../fasta/WH1.fasta",
-			"../../fasta/WH1.orfs", false)
-		db.DetermineSilence(ref)
+		db.DetermineSilence(loadReference(orfs))
 	}
 
 	if fastaName != "" {
 		fmt.Printf("Adding in SARS2 relatives from FASTA file\n")
-		g := genomes.LoadGenomes(fastaName, orfs, false)
+		g, err := genomes.TryLoadGenomes(fastaName, orfs, false)
+		if err != nil {
+			log.Fatalf("Can't add relatives: %s", err)
+		}
 
 		getHost := func(i int) string {
 			if strings.Contains(g.Names[i], "Pangolin") {
@@ -55,8 +104,8 @@ func main() {
 	db.BuildAccessionIndex()
 	db.AddSRAs("read_info2.txt.gz")
 
-	fmt.Printf("Saving %s\n", database.GOB_NAME)
-	db.Save(database.GOB_NAME)
+	fmt.Printf("Saving %s\n", config.Get().Database)
+	db.Save(config.Get().Database)
 
 	fmt.Printf("Done\n")
 }
@@ -17,10 +17,13 @@ type Codon struct {
 
 type Translation []Codon
 
-func newDegeneracyTable() map[string]int {
+// The same thing for every genetic code we know about
+var degeneracyTables map[*genomes.GeneticCode]map[string]int
+
+func newDegeneracyTable(code *genomes.GeneticCode) map[string]int {
 	ret := make(map[string]int)
-	for k, v := range genomes.CodonTable {
-		for _, syn := range genomes.ReverseCodonTable[v] {
+	for k, v := range code.Codons {
+		for _, syn := range code.Reverse[v] {
 			if syn[:2] == k[:2] {
 				ret[k]++
 			}
@@ -30,18 +33,39 @@ func newDegeneracyTable() map[string]int {
 }
 
 func init() {
-	DegeneracyTable = newDegeneracyTable()
+	degeneracyTables = make(map[*genomes.GeneticCode]map[string]int)
+	for _, code := range genomes.GeneticCodes() {
+		degeneracyTables[code] = newDegeneracyTable(code)
+	}
+	DegeneracyTable = degeneracyTables[genomes.StandardCode]
+}
+
+// The degeneracy table for a particular genetic code
+func GetDegeneracyTable(code *genomes.GeneticCode) map[string]int {
+	return degeneracyTables[code]
 }
 
 func AddDegeneracy(t genomes.Translation) Translation {
+	return AddDegeneracyWithCode(t, genomes.StandardCode)
+}
+
+func AddDegeneracyWithCode(t genomes.Translation,
+	code *genomes.GeneticCode) Translation {
+	table := GetDegeneracyTable(code)
 	ret := make([]Codon, len(t))
 	for i, c := range t {
-		ret[i] = Codon{c, DegeneracyTable[c.Nts]}
+		ret[i] = Codon{c, table[c.Nts]}
 	}
 	return ret
 }
 
+// Translate using whichever code applies to each ORF in the genome
 func Translate(genome *genomes.Genomes, which int) Translation {
 	t := genomes.Translate(genome, which)
-	return AddDegeneracy(t)
+	ret := make([]Codon, len(t))
+	for i, c := range t {
+		table := GetDegeneracyTable(genome.CodeAt(c.Pos))
+		ret[i] = Codon{c, table[c.Nts]}
+	}
+	return ret
 }
@@ -69,7 +69,7 @@ func main() {
 	aas := extractRanges(g, ranges, reverse)
 
 	var orfs genomes.Orfs
-	p := genomes.Genomes{aas, g.Names, orfs}
+	p := genomes.Genomes{aas, g.Names, orfs, nil}
 
 	switch format {
 	case "fasta":
@@ -0,0 +1,415 @@
+package genomes
+
+import (
+	"fmt"
+	"genomics/utils"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+Parse a GenBank/INSDC location like 266..21555, complement(28274..29533) or
+join(266..13468,13468..21555) into an ORF, which will have Segments if there
+was more than one piece. Partial markers (< and >) are ignored. Positions are
+1-based and inclusive in the location, and we convert them to our usual
+0-based half-open ones.
+*/
+func parseLocation(loc string, name string) (Orf, error) {
+	loc = strings.ReplaceAll(loc, " ", "")
+	parseErr := fmt.Errorf("%w in location: <%s>", ErrParse, loc)
+
+	var reverse, joined bool
+	for {
+		if s, found := strings.CutPrefix(loc, "complement("); found {
+			loc = strings.TrimSuffix(s, ")")
+			reverse = !reverse
+			continue
+		}
+		if s, found := strings.CutPrefix(loc, "join("); found {
+			loc = strings.TrimSuffix(s, ")")
+			joined = true
+			continue
+		}
+		if s, found := strings.CutPrefix(loc, "order("); found {
+			loc = strings.TrimSuffix(s, ")")
+			joined = true
+			continue
+		}
+		break
+	}
+
+	// This is for join(complement(a..b),complement(c..d)) which means the
+	// same thing as complement(join(c..d,a..b)).
+	var innerReverse int
+	segments := make([]Segment, 0)
+
+	for _, segment := range strings.Split(loc, ",") {
+		if s, found := strings.CutPrefix(segment, "complement("); found {
+			segment = strings.TrimSuffix(s, ")")
+			innerReverse++
+		}
+		segment = strings.Map(func(r rune) rune {
+			if r == '<' || r == '>' {
+				return -1
+			}
+			return r
+		}, segment)
+
+		ends := strings.Split(segment, "..")
+		start, err := strconv.Atoi(ends[0])
+		if err != nil {
+			return Orf{}, parseErr
+		}
+		end := start
+		if len(ends) == 2 {
+			end, err = strconv.Atoi(ends[1])
+			if err != nil {
+				return Orf{}, parseErr
+			}
+		}
+		segments = append(segments, Segment{start - 1, end})
+	}
+
+	switch innerReverse {
+	case 0:
+		// complement(join(...)) lists the segments in forward order but the
+		// last one gets read first.
+		if reverse {
+			slices.Reverse(segments)
+		}
+	case len(segments):
+		reverse = !reverse
+	default:
+		return Orf{}, fmt.Errorf("%w: mixed strands in <%s>", ErrParse, loc)
+	}
+
+	if !joined && len(segments) != 1 {
+		return Orf{}, parseErr
+	}
+	return orfFromSegments(segments, name, reverse), nil
+}
+
+// Turn the segments for a single ORF, in the order they're read, into an Orf
+func orfFromSegments(segments []Segment, name string, reverse bool) Orf {
+	ret := Orf{segments[0].Start, segments[0].End, name, reverse, nil, nil}
+	if len(segments) == 1 {
+		return ret
+	}
+	for _, seg := range segments {
+		ret.Start = utils.Min(ret.Start, seg.Start)
+		ret.End = utils.Max(ret.End, seg.End)
+	}
+	ret.Segments = segments
+	return ret
+}
+
+/*
+The code for a transl_table qualifier or attribute. Leave it nil when it's the
+standard one (or missing) so the Genomes' code applies.
+*/
+func translTable(value string) (*GeneticCode, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad transl_table <%s>", ErrParse, value)
+	}
+	if id == 1 {
+		return nil, nil
+	}
+	return GetGeneticCode(id)
+}
+
+func sortOrfs(orfs Orfs) {
+	slices.SortStableFunc(orfs, func(a, b Orf) int {
+		return a.Start - b.Start
+	})
+}
+
+/*
+Load the CDS features from the first record in a GenBank flat file as ORFs.
+Each one is named after its /gene qualifier, or /locus_tag or /product if it
+doesn't have one. Joined CDSs (like ORF1ab) come back as a single ORF with
+Segments, and a /transl_table qualifier sets the ORF's Code. Note that NCBI
+files often contain overlapping CDSs (ORF1a and ORF1ab for example) which you
+may want to remove.
+*/
+func LoadGenBankOrfs(fname string) (Orfs, error) {
+	type feature struct {
+		loc        string
+		qualifiers map[string]string
+		line       int
+	}
+
+	var (
+		features   []*feature
+		current    *feature
+		inFeatures bool
+		inLocation bool
+		qualifier  string // The one we're currently reading
+		lineNum    int
+		loadErr    error
+	)
+
+	qualPat := regexp.MustCompile(`^/([^=]+)(?:=(.*))?$`)
+
+	err := utils.TryLines(fname, func(line string, err error) bool {
+		lineNum++
+		if err != nil {
+			loadErr = &LoadError{fname, lineNum, err}
+			return false
+		}
+		line = strings.TrimRight(line, "\r")
+
+		if !inFeatures {
+			inFeatures = strings.HasPrefix(line, "FEATURES")
+			return true
+		}
+
+		// Anything in the first column means the feature table is over
+		if len(line) > 0 && line[0] != ' ' {
+			return false
+		}
+
+		if len(line) > 5 && line[5] != ' ' {
+			// A new feature key. We only care about CDSs.
+			fields := strings.Fields(line)
+			current = nil
+			if fields[0] == "CDS" && len(fields) > 1 {
+				current = &feature{fields[1], make(map[string]string), lineNum}
+				features = append(features, current)
+				inLocation = true
+			}
+			return true
+		}
+
+		if current == nil {
+			return true
+		}
+
+		content := strings.TrimSpace(line)
+		if strings.HasPrefix(content, "/") {
+			inLocation = false
+			m := qualPat.FindStringSubmatch(content)
+			if m == nil {
+				return true
+			}
+			qualifier = m[1]
+			current.qualifiers[qualifier] = strings.Trim(m[2], `"`)
+			return true
+		}
+
+		if inLocation {
+			current.loc += content
+		} else if qualifier != "" {
+			value := current.qualifiers[qualifier] + " " + content
+			current.qualifiers[qualifier] = strings.Trim(value, `" `)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	ret := make(Orfs, 0)
+	for _, f := range features {
+		var name string
+		for _, q := range []string{"gene", "locus_tag", "product"} {
+			if name = f.qualifiers[q]; name != "" {
+				break
+			}
+		}
+		orf, err := parseLocation(f.loc, name)
+		if err != nil {
+			return nil, &LoadError{fname, f.line, err}
+		}
+		orf.Code, err = translTable(f.qualifiers["transl_table"])
+		if err != nil {
+			return nil, &LoadError{fname, f.line, err}
+		}
+		ret = append(ret, orf)
+	}
+	sortOrfs(ret)
+	return ret, nil
+}
+
+/*
+Load the CDS features from a GFF3 file as ORFs. CDS lines sharing the same ID
+are segments of the same feature (that's how GFF3 represents joins), and we
+return them as a single ORF with Segments. Names come from the gene, Name or ID
+attributes in that order of preference, and transl_table sets the ORF's Code.
+*/
+func LoadGff3Orfs(fname string) (Orfs, error) {
+	type feature struct {
+		segments []Segment
+		name     string
+		reverse  bool
+		code     *GeneticCode
+	}
+
+	var (
+		features = make([]*feature, 0)
+		byId     = make(map[string]*feature)
+		lineNum  int
+		loadErr  error
+	)
+
+	err := utils.TryLines(fname, func(line string, err error) bool {
+		lineNum++
+		if err != nil {
+			loadErr = &LoadError{fname, lineNum, err}
+			return false
+		}
+		line = strings.TrimRight(line, "\r")
+
+		// Some files have the sequences tacked on at the end
+		if strings.HasPrefix(line, "##FASTA") {
+			return false
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9 {
+			loadErr = &LoadError{fname, lineNum,
+				fmt.Errorf("%w: expected 9 columns", ErrParse)}
+			return false
+		}
+		if fields[2] != "CDS" {
+			return true
+		}
+
+		start, err := strconv.Atoi(fields[3])
+		if err != nil {
+			loadErr = &LoadError{fname, lineNum, ErrParse}
+			return false
+		}
+		end, err := strconv.Atoi(fields[4])
+		if err != nil {
+			loadErr = &LoadError{fname, lineNum, ErrParse}
+			return false
+		}
+
+		attributes := make(map[string]string)
+		for _, attr := range strings.Split(fields[8], ";") {
+			k, v, found := strings.Cut(attr, "=")
+			if !found {
+				continue
+			}
+			if unescaped, err := url.PathUnescape(v); err == nil {
+				v = unescaped
+			}
+			attributes[strings.TrimSpace(k)] = v
+		}
+
+		var name string
+		for _, a := range []string{"gene", "Name", "ID"} {
+			if name = attributes[a]; name != "" {
+				break
+			}
+		}
+
+		seg := Segment{start - 1, end}
+		id := attributes["ID"]
+		if f, there := byId[id]; there && id != "" {
+			f.segments = append(f.segments, seg)
+			return true
+		}
+
+		code, err := translTable(attributes["transl_table"])
+		if err != nil {
+			loadErr = &LoadError{fname, lineNum, err}
+			return false
+		}
+
+		f := &feature{[]Segment{seg}, name, fields[6] == "-", code}
+		features = append(features, f)
+		if id != "" {
+			byId[id] = f
+		}
+		return true
+	})
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	ret := make(Orfs, len(features))
+	for i, f := range features {
+		// The segments of a reverse feature are read from the last one
+		slices.SortStableFunc(f.segments, func(a, b Segment) int {
+			if f.reverse {
+				return b.Start - a.Start
+			}
+			return a.Start - b.Start
+		})
+		ret[i] = orfFromSegments(f.segments, f.name, f.reverse)
+		ret[i].Code = f.code
+	}
+
+	sortOrfs(ret)
+	return ret, nil
+}
+
+/*
+Write the ORFs out in the same format LoadOrfs reads, with a transl_table=n
+after the name of any that have their own Code.
+*/
+func (orfs Orfs) Write(w io.Writer) error {
+	for _, orf := range orfs {
+		segments := slices.Clone(orf.segments())
+		if orf.Reverse {
+			slices.Reverse(segments)
+		}
+
+		ranges := make([]string, len(segments))
+		for i, seg := range segments {
+			ranges[i] = fmt.Sprintf("%d..%d", seg.Start+1, seg.End)
+		}
+
+		loc := strings.Join(ranges, ",")
+		if len(segments) > 1 {
+			loc = fmt.Sprintf("join(%s)", loc)
+		}
+		if orf.Reverse {
+			loc = fmt.Sprintf("complement(%s)", loc)
+		}
+
+		// The name has to be one field to survive being read back in
+		name := strings.Join(strings.Fields(orf.Name), "_")
+
+		fields := []string{loc}
+		if name != "" {
+			fields = append(fields, name)
+		}
+		if orf.Code != nil {
+			fields = append(fields, fmt.Sprintf("transl_table=%d", orf.Code.Id))
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(fields, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (orfs Orfs) Save(fname string) error {
+	fd, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return orfs.Write(fd)
+}
@@ -0,0 +1,47 @@
+package genomes
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOrfsRoundTrip(t *testing.T) {
+	mito, err := GetGeneticCode(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orfs := Orfs{
+		{Start: 265, End: 21555, Name: "ORF1ab",
+			Segments: []Segment{{265, 13468}, {13467, 21555}}},
+		{Start: 21562, End: 25384, Name: "S"},
+		{Start: 100, End: 400, Name: "COX1", Code: mito},
+		{Start: 500, End: 900, Reverse: true, Code: mito},
+		{Start: 1000, End: 1600, Name: "spliced", Reverse: true,
+			Segments: []Segment{{1300, 1600}, {1000, 1200}}},
+	}
+
+	fname := filepath.Join(t.TempDir(), "test.orfs")
+	if err := orfs.Save(fname); err != nil {
+		t.Fatal(err)
+	}
+	back, err := TryLoadOrfs(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, orfs) {
+		t.Errorf("ORFs differ:\n%+v\n%+v", back, orfs)
+	}
+}
+
+func TestOrfsBadTable(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "bad.orfs")
+	err := os.WriteFile(fname, []byte("1..300 x transl_table=99\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLoadOrfs(fname); err == nil {
+		t.Error("No error for an unknown transl_table")
+	}
+}
@@ -0,0 +1,226 @@
+package genomes
+
+import (
+	"fmt"
+	"slices"
+)
+
+/*
+A genetic code, like one of NCBI's translation tables. The standard one is the
+same as CodonTable and ReverseCodonTable. You can set one on a Genomes, or on
+individual Orfs (which takes priority), for mitochondrial sequences etc.
+*/
+type GeneticCode struct {
+	Id      int // NCBI's transl_table number
+	Name    string
+	Codons  map[string]byte
+	Reverse map[byte][]string
+}
+
+/*
+Return the amino acid for a codon, or '-' if it isn't a proper codon. Codons
+with IUPAC ambiguity codes in them (like AAR or YTG) translate if everything
+they could be translates to the same thing.
+*/
+func (c *GeneticCode) Translate(codon string) byte {
+	aa, there := c.Codons[codon]
+	if there {
+		return aa
+	}
+
+	expanded := ExpandCodon(codon)
+	if len(expanded) == 0 {
+		return '-'
+	}
+	aa = c.Codons[expanded[0]]
+	for _, e := range expanded[1:] {
+		if c.Codons[e] != aa {
+			return '-'
+		}
+	}
+	return aa
+}
+
+/*
+Assume nts are codon aligned and return a translation, with one amino-acid
+letter per nt, so something like LLLRRRIII
+*/
+func (c *GeneticCode) TranslateAligned(nts []byte) []byte {
+	ret := make([]byte, len(nts))
+
+	for i := 0; i < len(nts)-3+1; i += 3 {
+		aa := c.Translate(string(nts[i : i+3]))
+		for j := 0; j < 3; j++ {
+			ret[i+j] = aa
+		}
+	}
+	return ret
+}
+
+/*
+Assume nts are codon aligned and return a translation, with one amino-acid
+letter per aa, so something like LRI
+*/
+func (c *GeneticCode) TranslateAlignedShort(nts []byte) []byte {
+	ret := make([]byte, 0)
+
+	for i := 0; i < len(nts)-3+1; i += 3 {
+		ret = append(ret, c.Translate(string(nts[i:i+3])))
+	}
+	return ret
+}
+
+/*
+NCBI's compact representation of each table: the amino acids for all 64 codons
+with the bases in the order TCAG, so TTT, TTC, TTA, TTG, TCT...
+*/
+var ncbiCodes = []struct {
+	id   int
+	name string
+	aas  string
+}{
+	{1, "Standard",
+		"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{2, "Vertebrate Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSS**VVVVAAAADDEEGGGG"},
+	{3, "Yeast Mitochondrial",
+		"FFLLSSSSYY**CCWWTTTTPPPPHHQQRRRRIIMMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{4, "Mold, Protozoan, and Coelenterate Mitochondrial and " +
+		"Mycoplasma/Spiroplasma",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{5, "Invertebrate Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSSSVVVVAAAADDEEGGGG"},
+	{6, "Ciliate, Dasycladacean and Hexamita Nuclear",
+		"FFLLSSSSYYQQCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{9, "Echinoderm and Flatworm Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+	{10, "Euplotid Nuclear",
+		"FFLLSSSSYY**CCCWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{11, "Bacterial, Archaeal and Plant Plastid",
+		"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{12, "Alternative Yeast Nuclear",
+		"FFLLSSSSYY**CC*WLLLSPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{13, "Ascidian Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSGGVVVVAAAADDEEGGGG"},
+	{14, "Alternative Flatworm Mitochondrial",
+		"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+	{15, "Blepharisma Nuclear",
+		"FFLLSSSSYY*QCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{16, "Chlorophycean Mitochondrial",
+		"FFLLSSSSYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{21, "Trematode Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+	{22, "Scenedesmus obliquus Mitochondrial",
+		"FFLLSS*SYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{23, "Thraustochytrium Mitochondrial",
+		"FF*LSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{24, "Rhabdopleuridae Mitochondrial",
+		"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+	{25, "Candidate Division SR1 and Gracilibacteria",
+		"FFLLSSSSYY**CCGWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{26, "Pachysolen tannophilus Nuclear",
+		"FFLLSSSSYY**CC*WLLLAPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{27, "Karyorelict Nuclear",
+		"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{28, "Condylostoma Nuclear",
+		"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{29, "Mesodinium Nuclear",
+		"FFLLSSSSYYYYCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{30, "Peritrich Nuclear",
+		"FFLLSSSSYYEECC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{31, "Blastocrithidia Nuclear",
+		"FFLLSSSSYYEECCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{32, "Balanophoraceae Plastid",
+		"FFLLSSSSYY*WCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+	{33, "Cephalodiscidae Mitochondrial",
+		"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+}
+
+var geneticCodes map[int]*GeneticCode
+
+// The standard code, which is what you get unless you ask for something else
+var StandardCode *GeneticCode
+
+func newReverseTable(codons map[string]byte) map[byte][]string {
+	ret := make(map[byte][]string)
+
+	for k, v := range codons {
+		ret[v] = append(ret[v], k)
+	}
+
+	// Map iteration order is random so make this deterministic
+	for _, v := range ret {
+		slices.Sort(v)
+	}
+	return ret
+}
+
+func newGeneticCode(id int, name string, aas string) *GeneticCode {
+	bases := "TCAG"
+	codons := make(map[string]byte)
+	for i := 0; i < 64; i++ {
+		codon := []byte{bases[i/16], bases[(i/4)%4], bases[i%4]}
+		codons[string(codon)] = aas[i]
+	}
+	return &GeneticCode{id, name, codons, newReverseTable(codons)}
+}
+
+// Get one of NCBI's translation tables by its number
+func GetGeneticCode(id int) (*GeneticCode, error) {
+	ret, there := geneticCodes[id]
+	if !there {
+		return nil, fmt.Errorf("No genetic code %d", id)
+	}
+	return ret, nil
+}
+
+// All the ones we know about, in order
+func GeneticCodes() []*GeneticCode {
+	ret := make([]*GeneticCode, len(ncbiCodes))
+	for i, c := range ncbiCodes {
+		ret[i] = geneticCodes[c.id]
+	}
+	return ret
+}
+
+/*
+Which code to use for the ORF. Its own if it has one, otherwise the genome's,
+otherwise the standard one.
+*/
+func (g *Genomes) codeFor(orf *Orf) *GeneticCode {
+	if orf != nil && orf.Code != nil {
+		return orf.Code
+	}
+	return g.GeneticCode()
+}
+
+// The code that applies to the genomes as a whole
+func (g *Genomes) GeneticCode() *GeneticCode {
+	if g.Code != nil {
+		return g.Code
+	}
+	return StandardCode
+}
+
+// The code used to translate whatever is at pos
+func (g *Genomes) CodeAt(pos int) *GeneticCode {
+	orf, _, err := g.Orfs.findCoding(pos)
+	if err != nil {
+		return g.GeneticCode()
+	}
+	return g.codeFor(orf)
+}
+
+func init() {
+	geneticCodes = make(map[int]*GeneticCode)
+	for _, c := range ncbiCodes {
+		geneticCodes[c.id] = newGeneticCode(c.id, c.name, c.aas)
+	}
+
+	// Use the same maps for the standard code as everything that predates
+	// all this, so they can't get out of step.
+	ReverseCodonTable = newReverseTable(CodonTable)
+	StandardCode = &GeneticCode{1, geneticCodes[1].Name,
+		CodonTable, ReverseCodonTable}
+	geneticCodes[1] = StandardCode
+}
@@ -0,0 +1,208 @@
+package genomes
+
+import (
+	"bufio"
+	"fmt"
+	"genomics/utils"
+	"io"
+	"os"
+	"strings"
+)
+
+// One sequence from a FASTA file
+type FastaRecord struct {
+	Name   string   // The whole header line without the >
+	Fields []string // Name split into fields if you asked for that
+	Nts    []byte
+}
+
+// Make a single genome out of a record, so you can translate it etc.
+func (r *FastaRecord) ToGenomes(orfs Orfs) *Genomes {
+	ret := NewGenomes(orfs, 1)
+	ret.Nts[0] = r.Nts
+	ret.Names[0] = r.Name
+	if len(ret.Orfs) == 0 {
+		ret.ResetOrfs()
+	}
+	return ret
+}
+
+/*
+Reads a FASTA file one record at a time, so you can get through files that are
+far too big to load all at once with LoadGenomes (tens of thousands of GISAID
+sequences, or a whole mammal genome). Only the current record is kept in
+memory.
+*/
+type FastaReader struct {
+	fname    string
+	fp       *utils.FileReader // nil if we were given a Reader
+	r        *bufio.Reader
+	lineNum  int
+	nextName string // The header line we already read for the next record
+	haveNext bool
+	done     bool
+
+	split bool
+	sep   string
+}
+
+func NewFastaReader(r io.Reader) *FastaReader {
+	return &FastaReader{r: bufio.NewReader(r)}
+}
+
+// Open a (possibly gzipped) FASTA file for streaming
+func OpenFasta(fname string) (*FastaReader, error) {
+	fp, err := utils.OpenFileReader(fname)
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+	return &FastaReader{fname: fname, fp: fp, r: fp.Reader}, nil
+}
+
+/*
+Split each header into FastaRecord.Fields on sep. GISAID headers for example are
+separated with "|". An empty sep means split on whitespace.
+*/
+func (f *FastaReader) SplitHeaders(sep string) {
+	f.split = true
+	f.sep = sep
+}
+
+func (f *FastaReader) Close() {
+	if f.fp != nil {
+		f.fp.Close()
+	}
+}
+
+func (f *FastaReader) newRecord(name string) *FastaRecord {
+	ret := &FastaRecord{Name: name, Nts: make([]byte, 0)}
+	if f.split {
+		if f.sep == "" {
+			ret.Fields = strings.Fields(name)
+		} else {
+			ret.Fields = strings.Split(name, f.sep)
+		}
+	}
+	return ret
+}
+
+/*
+Return the next record. At the end you get io.EOF. Other errors are
+*LoadErrors.
+*/
+func (f *FastaReader) Next() (*FastaRecord, error) {
+	if f.done {
+		return nil, io.EOF
+	}
+
+	var ret *FastaRecord
+	if f.haveNext {
+		ret = f.newRecord(f.nextName)
+		f.haveNext = false
+	}
+
+	for {
+		line, err := f.r.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if line == "" {
+				f.done = true
+				if ret == nil {
+					return nil, io.EOF
+				}
+				return ret, nil
+			}
+		case nil:
+			break
+		default:
+			return nil, &LoadError{f.fname, f.lineNum + 1, err}
+		}
+		f.lineNum++
+
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ">") {
+			name := line[1:]
+			if ret == nil {
+				ret = f.newRecord(name)
+				continue
+			}
+			f.nextName, f.haveNext = name, true
+			return ret, nil
+		}
+
+		if ret == nil {
+			if line == "" {
+				continue
+			}
+			// Sequence before any header. Be lenient and give it no name.
+			ret = f.newRecord("")
+		}
+		ret.Nts = append(ret.Nts, []byte(strings.ToUpper(line))...)
+	}
+}
+
+/*
+Call fun for each record in a FASTA file. Return false from fun to stop early.
+*/
+func ForEachFasta(fname string, fun func(r *FastaRecord) bool) error {
+	f, err := OpenFasta(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		r, err := f.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fun(r) {
+			return nil
+		}
+	}
+}
+
+// Writes records out one at a time, to go with FastaReader
+type FastaWriter struct {
+	fd *os.File // nil if we were given a Writer
+	w  *bufio.Writer
+}
+
+func NewFastaWriter(w io.Writer) *FastaWriter {
+	return &FastaWriter{w: bufio.NewWriter(w)}
+}
+
+func CreateFasta(fname string) (*FastaWriter, error) {
+	fd, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &FastaWriter{fd, bufio.NewWriter(fd)}, nil
+}
+
+func (w *FastaWriter) WriteNts(name string, nts []byte) error {
+	_, err := fmt.Fprintf(w.w, ">%s\n", name)
+	if err != nil {
+		return err
+	}
+	return utils.TryWrap(w.w, nts)
+}
+
+func (w *FastaWriter) Write(r *FastaRecord) error {
+	return w.WriteNts(r.Name, r.Nts)
+}
+
+// Flush, and close the file if we opened it
+func (w *FastaWriter) Close() error {
+	err := w.w.Flush()
+	if w.fd != nil {
+		closeErr := w.fd.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,472 @@
+package genomes
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"slices"
+)
+
+/*
+An FM-index of a single sequence, which lets you search for patterns of any
+length, with or without mismatches, without scanning the whole thing. Building
+one needs about 9 bytes of memory per nt, and the sequence must be shorter than
+2^31 nts, so for a mammalian genome load it unmerged and index each chromosome
+separately. Once it's built it's much smaller than that, and you can Save it
+and load it again with LoadFMIndex.
+*/
+type FMIndex struct {
+	alphabet []byte   // The symbols in the sequence, sorted
+	rank     [256]int // Maps each symbol to its position in alphabet + 1
+	bwt      []byte   // The Burrows-Wheeler transform, as ranks
+	c        []int    // How many symbols in the sequence are less than each one
+	occ      []int32  // Checkpoints of how often each symbol appears in bwt
+	marked   []uint64 // Which entries of the suffix array we kept
+	markRank []int32  // How many are marked before each word of marked
+	samples  []int32  // The suffix array entries we kept
+	length   int      // Of the sequence (not counting the terminator)
+}
+
+const (
+	fmOccInterval = 64
+	fmSampleRate  = 32
+)
+
+/*
+Suffix array construction by induced sorting (Nong, Zhang and Chan's SA-IS). t
+must end with a 0 which appears nowhere else, and all its values must be less
+than k.
+*/
+func sais(t []int32, sa []int32, k int) {
+	n := len(t)
+	stype := make([]bool, n)
+	stype[n-1] = true
+	for i := n - 2; i >= 0; i-- {
+		stype[i] = t[i] < t[i+1] || (t[i] == t[i+1] && stype[i+1])
+	}
+	isLMS := func(i int) bool {
+		return i > 0 && stype[i] && !stype[i-1]
+	}
+
+	counts := make([]int32, k)
+	for _, c := range t {
+		counts[c]++
+	}
+	bkt := make([]int32, k)
+	buckets := func(ends bool) {
+		var sum int32
+		for i, c := range counts {
+			sum += c
+			if ends {
+				bkt[i] = sum
+			} else {
+				bkt[i] = sum - c
+			}
+		}
+	}
+
+	induce := func() {
+		buckets(false)
+		for i := 0; i < n; i++ {
+			j := sa[i] - 1
+			if sa[i] > 0 && !stype[j] {
+				sa[bkt[t[j]]] = j
+				bkt[t[j]]++
+			}
+		}
+		buckets(true)
+		for i := n - 1; i >= 0; i-- {
+			j := sa[i] - 1
+			if sa[i] > 0 && stype[j] {
+				bkt[t[j]]--
+				sa[bkt[t[j]]] = j
+			}
+		}
+	}
+
+	// Sort the LMS substrings
+	for i := range sa {
+		sa[i] = -1
+	}
+	buckets(true)
+	for i := 1; i < n; i++ {
+		if isLMS(i) {
+			bkt[t[i]]--
+			sa[bkt[t[i]]] = int32(i)
+		}
+	}
+	induce()
+
+	// Put the sorted LMS substrings at the start and name them
+	n1 := 0
+	for i := 0; i < n; i++ {
+		if isLMS(int(sa[i])) {
+			sa[n1] = sa[i]
+			n1++
+		}
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+
+	name, prev := 0, -1
+	for i := 0; i < n1; i++ {
+		pos := int(sa[i])
+		diff := false
+		for d := 0; ; d++ {
+			if prev == -1 || t[pos+d] != t[prev+d] ||
+				stype[pos+d] != stype[prev+d] {
+				diff = true
+				break
+			} else if d > 0 && (isLMS(pos+d) || isLMS(prev+d)) {
+				break
+			}
+		}
+		if diff {
+			name++
+			prev = pos
+		}
+		sa[n1+pos/2] = int32(name - 1)
+	}
+	for i, j := n-1, n-1; i >= n1; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+
+	// Sort the LMS suffixes, recursing if the names aren't unique yet
+	s1, sa1 := sa[n-n1:], sa[:n1]
+	if name < n1 {
+		sais(s1, sa1, name)
+	} else {
+		for i := 0; i < n1; i++ {
+			sa1[s1[i]] = int32(i)
+		}
+	}
+
+	// And use them to induce the whole thing
+	for i, j := 1, 0; i < n; i++ {
+		if isLMS(i) {
+			s1[j] = int32(i)
+			j++
+		}
+	}
+	for i := 0; i < n1; i++ {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	buckets(true)
+	for i := n1 - 1; i >= 0; i-- {
+		j := sa[i]
+		sa[i] = -1
+		bkt[t[j]]--
+		sa[bkt[t[j]]] = j
+	}
+	induce()
+}
+
+// Build an FM-index of the which'th genome in g
+func NewFMIndex(g *Genomes, which int) (*FMIndex, error) {
+	nts := g.Nts[which]
+	if len(nts) >= math.MaxInt32 {
+		return nil, errors.New("Sequence too long for an FM-index")
+	}
+
+	var f FMIndex
+	f.length = len(nts)
+
+	var present [256]bool
+	for _, nt := range nts {
+		present[nt] = true
+	}
+	for i, there := range present {
+		if there {
+			f.alphabet = append(f.alphabet, byte(i))
+			f.rank[i] = len(f.alphabet)
+		}
+	}
+	k := len(f.alphabet) + 1
+
+	n := len(nts) + 1
+	t := make([]int32, n)
+	for i, nt := range nts {
+		t[i] = int32(f.rank[nt])
+	}
+	sa := make([]int32, n)
+	sais(t, sa, k)
+
+	f.bwt = make([]byte, n)
+	for i, s := range sa {
+		if s > 0 {
+			f.bwt[i] = byte(t[s-1])
+		}
+	}
+
+	f.c = make([]int, k+1)
+	for _, s := range t {
+		f.c[s+1]++
+	}
+	for i := 1; i <= k; i++ {
+		f.c[i] += f.c[i-1]
+	}
+
+	nBlocks := n/fmOccInterval + 1
+	f.occ = make([]int32, nBlocks*k)
+	counts := make([]int32, k)
+	for i := 0; i < n; i++ {
+		if i%fmOccInterval == 0 {
+			copy(f.occ[(i/fmOccInterval)*k:], counts)
+		}
+		counts[f.bwt[i]]++
+	}
+	if n%fmOccInterval == 0 {
+		copy(f.occ[(n/fmOccInterval)*k:], counts)
+	}
+
+	nWords := n/64 + 1
+	f.marked = make([]uint64, nWords)
+	f.markRank = make([]int32, nWords)
+	f.samples = make([]int32, 0, n/fmSampleRate+1)
+	for i, s := range sa {
+		if s%fmSampleRate == 0 {
+			f.marked[i/64] |= 1 << (i % 64)
+			f.samples = append(f.samples, s)
+		}
+	}
+	var total int32
+	for i, w := range f.marked {
+		f.markRank[i] = total
+		total += int32(bits.OnesCount64(w))
+	}
+
+	return &f, nil
+}
+
+func (f *FMIndex) k() int {
+	return len(f.alphabet) + 1
+}
+
+// How many times does symbol (a rank) appear in bwt[:i]?
+func (f *FMIndex) occurrences(symbol byte, i int) int {
+	block := i / fmOccInterval
+	ret := int(f.occ[block*f.k()+int(symbol)])
+	for j := block * fmOccInterval; j < i; j++ {
+		if f.bwt[j] == symbol {
+			ret++
+		}
+	}
+	return ret
+}
+
+// Narrow a suffix array position to the one with symbol in front of it
+func (f *FMIndex) lf(symbol byte, i int) int {
+	return f.c[symbol] + f.occurrences(symbol, i)
+}
+
+// Where in the sequence does the suffix at suffix array position i start?
+func (f *FMIndex) locate(i int) int {
+	var steps int
+	for f.marked[i/64]&(1<<(i%64)) == 0 {
+		i = f.lf(f.bwt[i], i)
+		steps++
+	}
+	below := f.marked[i/64] & (1<<(i%64) - 1)
+	sample := int(f.markRank[i/64]) + bits.OnesCount64(below)
+	return int(f.samples[sample]) + steps
+}
+
+/*
+Backward search for needle with up to maxMismatches substitutions, calling fun
+with each suffix array range that matches.
+*/
+func (f *FMIndex) search(needle []byte,
+	maxMismatches int, fun func(lo, hi, mismatches int)) {
+	k := f.k()
+
+	var recurse func(j, lo, hi, mismatches int)
+	recurse = func(j, lo, hi, mismatches int) {
+		if lo >= hi {
+			return
+		}
+		if j < 0 {
+			fun(lo, hi, mismatches)
+			return
+		}
+
+		want := f.rank[needle[j]]
+		if want != 0 {
+			s := byte(want)
+			recurse(j-1, f.lf(s, lo), f.lf(s, hi), mismatches)
+		}
+		if mismatches == maxMismatches {
+			return
+		}
+		for symbol := 1; symbol < k; symbol++ {
+			if symbol == want {
+				continue
+			}
+			s := byte(symbol)
+			recurse(j-1, f.lf(s, lo), f.lf(s, hi), mismatches+1)
+		}
+	}
+	recurse(len(needle)-1, 0, f.length+1, 0)
+}
+
+// How many times does needle appear exactly?
+func (f *FMIndex) Count(needle []byte) int {
+	var ret int
+	f.search(needle, 0, func(lo, hi, _ int) {
+		ret += hi - lo
+	})
+	return ret
+}
+
+func (f *FMIndex) Length() int {
+	return f.length
+}
+
+// What we actually save, since gob only deals with exported fields
+type fmIndexFile struct {
+	Alphabet []byte
+	Bwt      []byte
+	Occ      []int32
+	Marked   []uint64
+	Samples  []int32
+	Length   int
+}
+
+func (f *FMIndex) Save(fname string) error {
+	fd, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := gob.NewEncoder(fd)
+	err = enc.Encode(fmIndexFile{f.alphabet,
+		f.bwt, f.occ, f.marked, f.samples, f.length})
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func LoadFMIndex(fname string) (*FMIndex, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var file fmIndexFile
+	dec := gob.NewDecoder(fd)
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't load FM-index %s: %w", fname, err)
+	}
+
+	f := &FMIndex{alphabet: file.Alphabet, bwt: file.Bwt, occ: file.Occ,
+		marked: file.Marked, samples: file.Samples, length: file.Length}
+
+	// The rest is cheap to work out again
+	for i, a := range f.alphabet {
+		f.rank[a] = i + 1
+	}
+	k := f.k()
+	f.c = make([]int, k+1)
+	for _, s := range f.bwt {
+		f.c[s+1]++
+	}
+	for i := 1; i <= k; i++ {
+		f.c[i] += f.c[i-1]
+	}
+	f.markRank = make([]int32, len(f.marked))
+	var total int32
+	for i, w := range f.marked {
+		f.markRank[i] = total
+		total += int32(bits.OnesCount64(w))
+	}
+	return f, nil
+}
+
+/*
+Search an FMIndex for a needle of any length, allowing up to maxMismatches
+substitutions. Matches come out in the order they appear in the genome.
+*/
+type FMSearch struct {
+	index      *FMIndex
+	positions  []int
+	mismatches []int
+	i          int
+}
+
+func (s *FMSearch) Init(index *FMIndex, needle []byte, maxMismatches int) {
+	s.index = index
+
+	type match struct {
+		pos, mismatches int
+	}
+	matches := make([]match, 0)
+
+	if len(needle) > 0 {
+		index.search(needle, maxMismatches, func(lo, hi, mismatches int) {
+			for i := lo; i < hi; i++ {
+				matches = append(matches,
+					match{index.locate(i), mismatches})
+			}
+		})
+	}
+
+	slices.SortFunc(matches, func(a, b match) int {
+		return a.pos - b.pos
+	})
+
+	s.positions = make([]int, len(matches))
+	s.mismatches = make([]int, len(matches))
+	for i, m := range matches {
+		s.positions[i] = m.pos
+		s.mismatches[i] = m.mismatches
+	}
+	s.Start()
+}
+
+func (s *FMSearch) Start() {
+	s.i = 0
+}
+
+func (s *FMSearch) Get() (int, error) {
+	if s.i < len(s.positions) {
+		return s.positions[s.i], nil
+	}
+	return 0, errors.New("Off end")
+}
+
+// How many mismatches there were in the current match (0 if we're off the end)
+func (s *FMSearch) Mismatches() int {
+	if s.i < len(s.mismatches) {
+		return s.mismatches[s.i]
+	}
+	return 0
+}
+
+func (s *FMSearch) IsForwards() bool {
+	return true
+}
+
+func (s *FMSearch) Next() {
+	s.i++
+}
+
+func (s *FMSearch) End() bool {
+	return s.i >= len(s.positions)
+}
+
+func (s *FMSearch) GenomeLength() int {
+	return s.index.length
+}
@@ -22,6 +22,7 @@ type Genomes struct {
 	Nts   [][]byte
 	Names []string
 	Orfs  Orfs
+	Code  *GeneticCode // nil means the standard code
 }
 
 func NewGenomes(orfs Orfs, numGenomes int) *Genomes {
@@ -29,28 +30,73 @@ func NewGenomes(orfs Orfs, numGenomes int) *Genomes {
 		orfs = Orfs{}
 	}
 	return &Genomes{make([][]byte, numGenomes),
-		make([]string, numGenomes), orfs}
+		make([]string, numGenomes), orfs, nil}
+}
+
+var (
+	ErrUnaligned  = errors.New("Genomes are not aligned")
+	ErrInvalidClu = errors.New("Invalid clu file")
+	ErrParse      = errors.New("Parse error")
+)
+
+/*
+Returned by the Try... loaders so that callers processing lots of files can
+report which one was bad and where rather than just dying. Line is 1-based and
+is 0 if the problem wasn't with any particular line (for example the file
+couldn't be opened).
+*/
+type LoadError struct {
+	Fname string
+	Line  int
+	Err   error
+}
+
+func (e *LoadError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Fname, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Fname, e.Line, e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
 }
 
 func load(fname string, orfsName string,
-	merge bool, allowUnaligned bool) *Genomes {
+	merge bool, allowUnaligned bool) (*Genomes, error) {
 	var orfs Orfs
 
 	if orfsName != "" {
-		orfs = LoadOrfs(orfsName)
+		var err error
+		orfs, err = TryLoadOrfs(orfsName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ret := NewGenomes(orfs, 0)
 
-	fp := utils.NewFileReader(fname)
+	fp, err := utils.OpenFileReader(fname)
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
 	defer fp.Close()
 
 	length := -1
 	currentRow := make([]byte, 0)
+	lineNum := 0
+
+	unaligned := func(lineNum int) error {
+		return &LoadError{fname, lineNum,
+			fmt.Errorf("%w: %d has length %d != %d",
+				ErrUnaligned, len(ret.Nts)+1, len(currentRow), length)}
+	}
+
 loop:
 	// If working with huge genomes uncomment this for faster debugging!
 	// for i := 0; i < 1000; i++ {
 	for {
+		lineNum++
 		line, err := fp.ReadString('\n')
 		switch err {
 		case io.EOF:
@@ -58,7 +104,7 @@ loop:
 		case nil:
 			break
 		default:
-			log.Fatal("Can't read file")
+			return nil, &LoadError{fname, lineNum, err}
 		}
 
 		line = strings.TrimSpace(line)
@@ -73,12 +119,8 @@ loop:
 			if !merge && len(currentRow) > 0 {
 				if length == -1 {
 					length = len(currentRow)
-				} else {
-					if len(currentRow) != length && !allowUnaligned {
-						log.Fatalf("Genomes are not aligned: "+
-							"%d has length %d != %d\n",
-							len(ret.Nts)+1, len(currentRow), length)
-					}
+				} else if len(currentRow) != length && !allowUnaligned {
+					return nil, unaligned(lineNum)
 				}
 				ret.Nts = append(ret.Nts, currentRow)
 				currentRow = make([]byte, 0)
@@ -88,13 +130,17 @@ loop:
 		line = strings.ToUpper(line)
 		currentRow = append(currentRow, []byte(line)...)
 	}
+	if !merge && length != -1 &&
+		len(currentRow) != length && !allowUnaligned {
+		return nil, unaligned(lineNum)
+	}
 	ret.Nts = append(ret.Nts, currentRow)
 
 	if len(ret.Orfs) == 0 {
-		ret.Orfs = []Orf{{0, ret.Length(), "", false}}
+		ret.Orfs = []Orf{{0, ret.Length(), "", false, nil, nil}}
 	}
 
-	return ret
+	return ret, nil
 }
 
 /*
@@ -107,25 +153,59 @@ that). orfsName can be empty string if you don't have any ORFs which is
 fine if you don't plan on doing any translation.
 */
 func LoadGenomes(fname string, orfsName string, merge bool) *Genomes {
+	ret, err := TryLoadGenomes(fname, orfsName, merge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+// Like LoadGenomes but returns an error (usually a *LoadError) instead of
+// exiting if anything goes wrong.
+func TryLoadGenomes(fname string, orfsName string,
+	merge bool) (*Genomes, error) {
 	return load(fname, orfsName, merge, false)
 }
 
 func LoadUnaligned(fname string, orfsName string, merge bool) []*Genomes {
-	g := load(fname, orfsName, merge, true)
-	return g.Dealign()
+	ret, err := TryLoadUnaligned(fname, orfsName, merge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+func TryLoadUnaligned(fname string, orfsName string,
+	merge bool) ([]*Genomes, error) {
+	g, err := load(fname, orfsName, merge, true)
+	if err != nil {
+		return nil, err
+	}
+	return g.Dealign(), nil
 }
 
 // Load genomes from a clu file
 func LoadClu(fname string, orfsName string) *Genomes {
+	ret, err := TryLoadClu(fname, orfsName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+func TryLoadClu(fname string, orfsName string) (*Genomes, error) {
 	pat := regexp.MustCompile(`[GACT-]+`)
 
-	var nameIt int
+	var nameIt, lineNum int
+	var loadErr error
 	nts := make(map[string][]byte)
 	names := make([]string, 0)
 
-	utils.Lines(fname, func(line string, err error) bool {
+	err := utils.TryLines(fname, func(line string, err error) bool {
+		lineNum++
 		if err != nil {
-			log.Fatal(err)
+			loadErr = &LoadError{fname, lineNum, err}
+			return false
 		}
 
 		fields := strings.Fields(line)
@@ -147,7 +227,8 @@ func LoadClu(fname string, orfsName string) *Genomes {
 			names = append(names, name)
 			nts[name] = make([]byte, 0)
 			if len(names) != nameIt+1 {
-				log.Fatal("Invalid clu file")
+				loadErr = &LoadError{fname, lineNum, ErrInvalidClu}
+				return false
 			}
 		} else {
 			name = names[nameIt]
@@ -157,10 +238,19 @@ func LoadClu(fname string, orfsName string) *Genomes {
 		nameIt++
 		return true
 	})
+	if err != nil {
+		return nil, &LoadError{fname, 0, err}
+	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
 
 	var orfs Orfs
 	if orfsName != "" {
-		orfs = LoadOrfs(orfsName)
+		orfs, err = TryLoadOrfs(orfsName)
+		if err != nil {
+			return nil, err
+		}
 	}
 	ret := NewGenomes(orfs, len(names))
 	ret.Names = names
@@ -168,7 +258,7 @@ func LoadClu(fname string, orfsName string) *Genomes {
 	for i, name := range names {
 		ret.Nts[i] = nts[name]
 	}
-	return ret
+	return ret, nil
 }
 
 func (g *Genomes) CheckOrfs() error {
@@ -257,6 +347,7 @@ func (g *Genomes) SaveSelected(fname string, which ...int) error {
 // Make a deep copy (of the nts-- the names are just shallow copied)
 func (g *Genomes) Clone() *Genomes {
 	ret := NewGenomes(g.Orfs, g.NumGenomes())
+	ret.Code = g.Code
 	for i := 0; i < len(g.Nts); i++ {
 		ret.Nts[i] = make([]byte, len(g.Nts[i]))
 		copy(ret.Nts[i], g.Nts[i])
@@ -270,6 +361,7 @@ func (g *Genomes) Clone() *Genomes {
 // Make a shallow copy that matches the specified genomes
 func (g *Genomes) Filter(which ...int) *Genomes {
 	ret := NewGenomes(g.Orfs, len(which))
+	ret.Code = g.Code
 
 	for i, w := range which {
 		ret.Nts[i] = g.Nts[w]
@@ -283,6 +375,7 @@ func (g *Genomes) Filter(which ...int) *Genomes {
 func (g *Genomes) FilterOut(which ...int) *Genomes {
 	bad := utils.ToSet(which)
 	ret := NewGenomes(g.Orfs, g.NumGenomes()-len(bad))
+	ret.Code = g.Code
 
 	for i, j := 0, 0; i < g.NumGenomes(); i++ {
 		if !bad[i] {
@@ -312,6 +405,7 @@ func (g *Genomes) RemovePartial(threshold int) *Genomes {
 // filter but it would be annoying.
 func (g *Genomes) Swap(a, b int) *Genomes {
 	ret := NewGenomes(g.Orfs, g.NumGenomes())
+	ret.Code = g.Code
 	for i := 0; i < g.NumGenomes(); i++ {
 		ret.Nts[i] = g.Nts[i]
 		ret.Names[i] = g.Names[i]
@@ -348,105 +442,51 @@ func (g *Genomes) Combine(other *Genomes) error {
 }
 
 /*
-How many differences are there looking at length bytes from pos in a and
-comparing them to length bytes from pos+offset in b?
+Align each genome in other to the first genome in g with AlignPair, and add
+them to g. Anything in other that isn't in g's first genome is left out, so
+that g's columns (and so its ORFs) don't change. Use the align package if you
+want to keep the insertions.
 */
-func countDifferences(a []byte, b []byte, pos, offset, length int) int {
-	var ret int
-
-	aSpace := len(a) - (pos + length)
-	bSpace := len(b) - (pos + offset + length)
-	space := utils.Min(aSpace, bSpace)
-	if space < 0 {
-		length += space
-	}
-
-	for i := 0; i < length; i++ {
-		if a[pos+i] != b[pos+offset+i] {
-			ret++
+func (g *Genomes) AlignCombine(other *Genomes) error {
+	ref := g.Nts[0]
+	refNts := make([]byte, 0, len(ref))
+	refCols := make([]int, 0, len(ref))
+	for i, nt := range ref {
+		if nt != '-' {
+			refNts = append(refNts, nt)
+			refCols = append(refCols, i)
 		}
 	}
 
-	return ret
-}
-
-// Insert '-' into other, or cut pieces out of other, to make it match ref
-func align(ref []byte, other []byte) []byte {
-	// Assuming things don't match up at pos, would it help to put a gap into a
-	// here?
-	needGap := func(pos int) bool {
-		// We need a gap if things aren't already back on track a little down
-		// the road.
-		return countDifferences(other, ref, pos+20, 0, 20) > 2
-	}
-
-	// Would putting a gap this long in to a at pos be a good idea?
-	tryGap := func(pos, length int, a, b []byte) bool {
-		return countDifferences(a, b, pos+20, length, 20) <= 2
-	}
-
-	// Actually put a gap in
-	insertGap := func(pos, length int) {
-		other = append(other[:pos],
-			append(make([]byte, length), other[pos:]...)...)
-		for i := pos; i < pos+length; i++ {
-			other[i] = '-'
+	rows := make([][]byte, other.NumGenomes())
+	for i := 0; i < other.NumGenomes(); i++ {
+		nts := make([]byte, 0, len(other.Nts[i]))
+		for _, nt := range other.Nts[i] {
+			if nt != '-' {
+				nts = append(nts, nt)
+			}
 		}
-	}
-
-	removeSection := func(pos, length int) {
-		other = append(other[:pos], other[pos+length:]...)
-	}
 
-	for i := 0; ; i++ {
-		if i >= len(ref) || i >= len(other) {
-			break
-		}
-		if other[i] == ref[i] {
-			continue
-		}
-		if !needGap(i) {
-			continue
+		aligned, err := AlignPair(refNts, nts, &NucleotideAlignParams)
+		if err != nil {
+			return fmt.Errorf("Can't align %s: %w", other.Names[i], err)
 		}
 
-		for j := 1; j < 1000; j++ {
-			if tryGap(i, j, other, ref) {
-				insertGap(i, j)
-				i += j
-				break
-			}
-			if tryGap(i, j, ref, other) {
-				removeSection(i, j)
-				i += j
-				break
-			}
+		row := make([]byte, len(ref))
+		for j, _ := range row {
+			row[j] = '-'
 		}
-	}
-	return other
-}
-
-/*
-This is basically rubbish. Import align again and use that (which uses mafft)
-*/
-func (g *Genomes) AlignCombine(other *Genomes) error {
-	for i := 0; i < other.NumGenomes(); i++ {
-
-		other.Nts[i] = align(g.Nts[0], other.Nts[i])
-		n := len(other.Nts[i])
-
-		// If other is too long at this point, just skip it. We'll see how
-		// often this happens.
-		if n > len(g.Nts[0]) {
-			log.Printf("Alignment of %d failed.\n", i)
-			continue
-		} else {
-			for j := 0; j < len(g.Nts[0])-n; j++ {
-				other.Nts[i] = append(other.Nts[i], '-')
+		var r int
+		for j, nt := range aligned.A {
+			if nt != '-' {
+				row[refCols[r]] = aligned.B[j]
+				r++
 			}
 		}
-
-		g.Nts = append(g.Nts, other.Nts[i])
+		rows[i] = row
 	}
+
+	g.Nts = append(g.Nts, rows...)
 	g.Names = append(g.Names, other.Names...)
 	return nil
 }
@@ -515,6 +555,7 @@ func (g *Genomes) Dealign() []*Genomes {
 	for i := 0; i < g.NumGenomes(); i++ {
 		var orfs Orfs
 		ret[i] = NewGenomes(orfs, 1)
+		ret[i].Code = g.Code
 		nts := make([]byte, 0)
 		for j := 0; j < len(g.Nts[i]); j++ {
 			if g.Nts[i][j] != '-' {
@@ -558,12 +599,42 @@ percentage). protein = true if this is a protein sequence rather than a
 nucleotide one.
 */
 func (g *Genomes) SequenceSimilarity(a, b int, protein bool) float64 {
+	return g.sequenceSimilarity(a, b, protein, false)
+}
+
+/*
+Like SequenceSimilarity but IUPAC ambiguity codes count as matches when they're
+compatible with what's in the other genome (so R matches A or G, and X matches
+any amino acid). Positions where a is ambiguous are included too, except for
+Ns (or Xs in a protein) which tell you nothing.
+*/
+func (g *Genomes) AmbiguousSequenceSimilarity(a, b int,
+	protein bool) float64 {
+	return g.sequenceSimilarity(a, b, protein, true)
+}
+
+func (g *Genomes) sequenceSimilarity(a, b int,
+	protein bool, ambiguous bool) float64 {
 	var same, total int
 
 	var isValid func(c byte) bool
-	if protein {
+	var compatible func(a, b byte) bool
+
+	switch {
+	case protein && ambiguous:
+		isValid = func(c byte) bool {
+			_, there := iupacAas[c]
+			return there || isValidAA(c)
+		}
+		compatible = AasCompatible
+	case protein:
 		isValid = isValidAA
-	} else {
+	case ambiguous:
+		isValid = func(c byte) bool {
+			return c != 'N' && ExpandNt(c) != ""
+		}
+		compatible = NtsCompatible
+	default:
 		isValid = isValidNt
 	}
 
@@ -574,6 +645,8 @@ func (g *Genomes) SequenceSimilarity(a, b int, protein bool) float64 {
 		total++
 		if g.Nts[a][i] == g.Nts[b][i] {
 			same++
+		} else if compatible != nil && compatible(g.Nts[a][i], g.Nts[b][i]) {
+			same++
 		}
 	}
 	return float64(same) / float64(total)
@@ -912,10 +985,47 @@ func (g *Genomes) IsProtein() bool {
 	return prot > 0
 }
 
+/*
+Truncate a spliced ORF, keeping it in frame by dropping any partial codon at
+the start.
+*/
+func truncateSegments(orf Orf, start, end int) (Orf, bool) {
+	segments := make([]Segment, 0)
+	var dropped int // How much of the coding sequence we've cut off the start
+
+	for _, seg := range orf.Segments {
+		s, e := utils.Max(seg.Start, start), utils.Min(seg.End, end)
+		if len(segments) == 0 && e > s {
+			s += (3 - (dropped+s-seg.Start)%3) % 3
+		}
+		if e <= s {
+			if len(segments) == 0 {
+				dropped += seg.End - seg.Start
+			}
+			continue
+		}
+		segments = append(segments, Segment{s - start, e - start})
+	}
+
+	if len(segments) == 0 {
+		return Orf{}, false
+	}
+	ret := orfFromSegments(segments, orf.Name, false)
+	ret.Code = orf.Code
+	return ret, true
+}
+
 func TruncateOrfs(orfs Orfs, start, end int) Orfs {
 	ret := make(Orfs, 0)
 	newLen := end - start
 	for _, orf := range orfs {
+		if orf.Segments != nil {
+			if truncated, ok := truncateSegments(orf, start, end); ok {
+				ret = append(ret, truncated)
+			}
+			continue
+		}
+
 		newStart := orf.Start - start
 
 		if newStart < 0 {
@@ -930,13 +1040,13 @@ func TruncateOrfs(orfs Orfs, start, end int) Orfs {
 		if newEnd <= newStart {
 			continue
 		}
-		ret = append(ret, Orf{newStart, newEnd, orf.Name, false})
+		ret = append(ret, Orf{newStart, newEnd, orf.Name, false, nil, orf.Code})
 	}
 	return ret
 }
 
 func (g *Genomes) ResetOrfs() {
-	g.Orfs = []Orf{Orf{0, g.Length(), "", false}}
+	g.Orfs = []Orf{Orf{0, g.Length(), "", false, nil, nil}}
 }
 
 /*
@@ -968,6 +1078,7 @@ func (g *Genomes) Dedupe() *Genomes {
 	}
 
 	ret := NewGenomes(g.Orfs, g.NumGenomes()-len(dupes))
+	ret.Code = g.Code
 	j := 0
 	for i, _ := range g.Nts {
 		if !dupes[i] {
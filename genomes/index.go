@@ -1,124 +1,575 @@
 package genomes
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"genomics/utils"
 	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 )
 
-type indexData map[string][]int
+/*
+The index is a single binary file in the index directory, laid out like this
+(everything little-endian):
+
+	header:    magic "GIDX", version, wordLen, posWidth (all uint32),
+	           genomeLen, numWords, numRecords, recordsStart (uint64)
+	words:     numWords entries sorted by word, each the word itself
+	           (wordLen bytes), then where its positions start and how many
+	           there are (uint64 each, counted in positions not bytes)
+	positions: all the positions for all the words, each posWidth bytes (4
+	           unless the genome is too long for that), sorted within each word
+	records:   at recordsStart, for each sequence we indexed its offset and
+	           length (uint64), and then its name (uint32 length then the
+	           bytes)
+
+Positions are offsets into all the records concatenated, which is the same as
+what you get if you load the FASTA file with merge set. Words that would span
+two records aren't indexed.
+
+We mmap it so opening even a human genome index is instant. Indices in the old
+format (one text file per word plus an "info" file) can still be searched.
+*/
+const (
+	INDEX_NAME    = "index.bin"
+	INDEX_MAGIC   = "GIDX"
+	INDEX_VERSION = 2
+
+	indexHeaderLen = 48
+)
+
+var ErrBadIndex = errors.New("Invalid index")
+
+// Positions as they are in the index, decoded as you ask for them
+type positionList struct {
+	data  []byte
+	width int
+}
+
+func (p positionList) Len() int {
+	if p.width == 0 {
+		return 0
+	}
+	return len(p.data) / p.width
+}
+
+func (p positionList) At(i int) int {
+	if p.width == 4 {
+		return int(binary.LittleEndian.Uint32(p.data[i*4:]))
+	}
+	return int(binary.LittleEndian.Uint64(p.data[i*8:]))
+}
+
+func newPositionList(positions []int) positionList {
+	data := make([]byte, len(positions)*8)
+	for i, pos := range positions {
+		binary.LittleEndian.PutUint64(data[i*8:], uint64(pos))
+	}
+	return positionList{data, 8}
+}
+
+// How many times each word appears in one chunk of the genome
+type wordCounts map[string]*int
+
+// One of the sequences (a chromosome or contig say) that went into the index
+type IndexRecord struct {
+	Name   string
+	Offset int // Where it starts in the positions the index uses
+	Length int
+}
 
 type Index struct {
-	root      string    // Where we store the files
-	data      indexData // Maps patterns to their positions
-	wordLen   int       // The word length we're using (usually 6)
-	count     int       // Number of positions so far recorded
-	genomeLen int
+	root      string // The directory we store it in
+	wordLen   int    // The word length we're using (usually 6)
+	genomeLen int    // Of all the records together
+	records   []IndexRecord
+
+	// Only used while building
+	nts     [][]byte     // for each record
+	chunks  [][2]int     // start and end of each chunk we do in parallel
+	counts  []wordCounts // one for each chunk
+	words   []string     // sorted
+	verbose bool
+
+	// Only used once it's been opened for searching
+	file      *mappedFile
+	posWidth  int
+	numWords  int
+	table     []byte
+	positions []byte
+	legacy    bool // The old one-file-per-word format
 }
 
-func (index *Index) saveMetadata() {
-	fname := fmt.Sprintf("%s/info", index.root)
+func (index *Index) entryLen() int {
+	return index.wordLen + 16
+}
+
+/*
+Count the words in each chunk of the genome in parallel. We don't write
+anything until you call Save. Each genome in genome is a separate record (they
+don't need to be aligned), so load a multi-sequence FASTA file with
+LoadUnaligned, or with merge set if you want it all treated as one sequence.
+*/
+func (index *Index) Build(genome *Genomes,
+	root string, length int, verbose bool) {
+	index.root = root
+	index.wordLen = length
+	index.verbose = verbose
+
+	index.nts = genome.Nts
+	index.records = make([]IndexRecord, len(genome.Nts))
+	index.genomeLen = 0
+	for i, nts := range genome.Nts {
+		var name string
+		if i < len(genome.Names) {
+			name = genome.Names[i]
+		}
+		index.records[i] = IndexRecord{name, index.genomeLen, len(nts)}
+		index.genomeLen += len(nts)
+	}
+
+	n := index.genomeLen
+	nChunks := runtime.NumCPU()
+	chunkLen := n/nChunks + 1
+
+	index.chunks = make([][2]int, 0, nChunks)
+	for start := 0; start < n; start += chunkLen {
+		index.chunks = append(index.chunks,
+			[2]int{start, utils.Min(start+chunkLen, n)})
+	}
+	index.counts = make([]wordCounts, len(index.chunks))
+
+	index.parallel("Counted", func(i int, chunk [2]int) {
+		counts := make(wordCounts)
+		index.forEachWord(chunk, func(word []byte, pos int) {
+			count, there := counts[string(word)]
+			if !there {
+				count = new(int)
+				counts[string(word)] = count
+			}
+			*count++
+		})
+		index.counts[i] = counts
+	})
+
+	words := make(map[string]bool)
+	for _, counts := range index.counts {
+		for k, _ := range counts {
+			words[k] = true
+		}
+	}
+	index.words = utils.FromSet(words)
+	slices.Sort(index.words)
+}
+
+/*
+Call fun for every word that starts in chunk and doesn't run off the end of
+its record.
+*/
+func (index *Index) forEachWord(chunk [2]int, fun func(word []byte, pos int)) {
+	length := index.wordLen
+	for i, r := range index.records {
+		start := utils.Max(chunk[0], r.Offset)
+		end := utils.Min(chunk[1], r.Offset+r.Length-length+1)
+		nts := index.nts[i]
+		for j := start; j < end; j++ {
+			k := j - r.Offset
+			fun(nts[k:k+length], j)
+		}
+	}
+}
+
+// Call fun on each chunk in its own goroutine
+func (index *Index) parallel(verb string, fun func(i int, chunk [2]int)) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	done := 0
+
+	for i, chunk := range index.chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fun(i, chunk)
+			if index.verbose {
+				mutex.Lock()
+				done++
+				fmt.Printf("%s %d/%d chunks\n", verb, done, len(index.chunks))
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+/*
+Write the index out. Each chunk writes its positions straight into the mmapped
+file, into the slots after the ones for the same word from the chunks before
+it, so they come out sorted without us needing to hold them all in memory.
+*/
+func (index *Index) save() error {
+	err := os.MkdirAll(index.root, 0755)
+	if err != nil {
+		return err
+	}
+
+	posWidth := 4
+	if index.genomeLen > math.MaxUint32 {
+		posWidth = 8
+	}
+
+	// Where each chunk should write the next position for each word
+	cursors := make([]map[string]int, len(index.chunks))
+	for i, _ := range cursors {
+		cursors[i] = make(map[string]int)
+	}
+
+	var total int
+	for _, word := range index.words {
+		for i, counts := range index.counts {
+			cursors[i][word] = total
+			if count, there := counts[word]; there {
+				total += *count
+			}
+		}
+	}
+
+	tableLen := len(index.words) * index.entryLen()
+	recordsStart := indexHeaderLen + tableLen + total*posWidth
+	size := recordsStart
+	for _, r := range index.records {
+		size += 20 + len(r.Name)
+	}
+
+	fname := filepath.Join(index.root, INDEX_NAME)
 	fd, err := os.Create(fname)
 	if err != nil {
-		log.Fatal("Can't write index metadata")
+		return err
 	}
 	defer fd.Close()
 
-	w := bufio.NewWriter(fd)
-	fmt.Fprintf(w, "genomeLen: %d wordLen: %d\n",
-		index.genomeLen, index.wordLen)
-	w.Flush()
+	err = fd.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+
+	m, err := mapFile(fd, size, true)
+	if err != nil {
+		return err
+	}
+	data := m.Data
+
+	copy(data, INDEX_MAGIC)
+	binary.LittleEndian.PutUint32(data[4:], INDEX_VERSION)
+	binary.LittleEndian.PutUint32(data[8:], uint32(index.wordLen))
+	binary.LittleEndian.PutUint32(data[12:], uint32(posWidth))
+	binary.LittleEndian.PutUint64(data[16:], uint64(index.genomeLen))
+	binary.LittleEndian.PutUint64(data[24:], uint64(len(index.words)))
+	binary.LittleEndian.PutUint64(data[32:], uint64(len(index.records)))
+	binary.LittleEndian.PutUint64(data[40:], uint64(recordsStart))
+
+	records := data[recordsStart:]
+	for _, r := range index.records {
+		binary.LittleEndian.PutUint64(records, uint64(r.Offset))
+		binary.LittleEndian.PutUint64(records[8:], uint64(r.Length))
+		binary.LittleEndian.PutUint32(records[16:], uint32(len(r.Name)))
+		copy(records[20:], r.Name)
+		records = records[20+len(r.Name):]
+	}
+
+	table := data[indexHeaderLen : indexHeaderLen+tableLen]
+	for i, word := range index.words {
+		entry := table[i*index.entryLen():]
+		copy(entry, word)
+
+		// The first chunk's cursor is where the word starts
+		var count int
+		for _, counts := range index.counts {
+			if c, there := counts[word]; there {
+				count += *c
+			}
+		}
+		binary.LittleEndian.PutUint64(entry[index.wordLen:],
+			uint64(cursors[0][word]))
+		binary.LittleEndian.PutUint64(entry[index.wordLen+8:], uint64(count))
+	}
+
+	positions := data[indexHeaderLen+tableLen : recordsStart]
+
+	index.parallel("Wrote", func(i int, chunk [2]int) {
+		cursor := cursors[i]
+		index.forEachWord(chunk, func(word []byte, pos int) {
+			k := cursor[string(word)]
+			if posWidth == 4 {
+				binary.LittleEndian.PutUint32(positions[k*4:], uint32(pos))
+			} else {
+				binary.LittleEndian.PutUint64(positions[k*8:], uint64(pos))
+			}
+			cursor[string(word)] = k + 1
+		})
+	})
+
+	err = m.Close()
+	if err != nil {
+		return err
+	}
+	return fd.Close()
 }
 
-func (index *Index) loadMetadata() {
+func (index *Index) Save() {
+	err := index.save()
+	if err != nil {
+		log.Fatalf("Can't save index: %s", err)
+	}
+	index.nts = nil
+	index.counts = nil
+}
+
+func (index *Index) Init(root string, wordLen int) {
+	index.root = root
+	index.wordLen = wordLen
+}
+
+func (index *Index) WordLen() int {
+	return index.wordLen
+}
+
+func (index *Index) GenomeLength() int {
+	return index.genomeLen
+}
+
+func (index *Index) Records() []IndexRecord {
+	return index.records
+}
+
+/*
+Which record is pos (an offset into all of them concatenated) in? Returns its
+index in Records, or -1 if pos is off the end.
+*/
+func (index *Index) findRecord(pos int) int {
+	i := sort.Search(len(index.records), func(i int) bool {
+		r := index.records[i]
+		return r.Offset+r.Length > pos
+	})
+	if i == len(index.records) || pos < 0 {
+		return -1
+	}
+	return i
+}
+
+// Convert pos into the name of the record it's in and the position in it
+func (index *Index) Locate(pos int) (string, int, error) {
+	i := index.findRecord(pos)
+	if i == -1 {
+		return "", 0, errors.New("Off end")
+	}
+	r := index.records[i]
+	return r.Name, pos - r.Offset, nil
+}
+
+// Is all of [pos, pos+length) inside a single record?
+func (index *Index) withinRecord(pos, length int) bool {
+	i := index.findRecord(pos)
+	if i == -1 {
+		return false
+	}
+	r := index.records[i]
+	return pos+length <= r.Offset+r.Length
+}
+
+func (index *Index) loadLegacy() error {
 	fname := fmt.Sprintf("%s/info", index.root)
-	f := utils.NewFileReader(fname)
+	f, err := utils.OpenFileReader(fname)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	line, err := f.ReadString('\n')
 	if err != nil {
-		log.Fatal("Can't read index metadata")
+		return fmt.Errorf("Can't read index metadata: %w", err)
 	}
 
-	line = strings.TrimSpace(line)
-	fields := strings.Fields(line)
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) < 4 {
+		return fmt.Errorf("%w: bad metadata in %s", ErrBadIndex, fname)
+	}
 	index.genomeLen = utils.Atoi(fields[1])
 	index.wordLen = utils.Atoi(fields[3])
+	index.records = []IndexRecord{{"", 0, index.genomeLen}}
+	index.legacy = true
+	return nil
 }
 
-/*
-Write the index out to files and clear it
-*/
-func (index *Index) save() {
-	for k, v := range index.data {
-		fname := fmt.Sprintf("%s/%s", index.root, k)
-		fd, err := os.OpenFile(fname,
-			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatalf("Can't open file %s", fname)
+func (index *Index) load() error {
+	fname := filepath.Join(index.root, INDEX_NAME)
+	fd, err := os.Open(fname)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(index.root, "info")); err == nil {
+			return index.loadLegacy()
 		}
-		defer fd.Close()
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
 
-		fp := bufio.NewWriter(fd)
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := int(info.Size())
+	if size < indexHeaderLen {
+		return fmt.Errorf("%w: %s is truncated", ErrBadIndex, fname)
+	}
 
-		for i := 0; i < len(v); i++ {
-			fmt.Fprintln(fp, v[i])
-		}
+	m, err := mapFile(fd, size, false)
+	if err != nil {
+		return err
+	}
+	data := m.Data
+
+	if string(data[:4]) != INDEX_MAGIC {
+		m.Close()
+		return fmt.Errorf("%w: %s isn't an index", ErrBadIndex, fname)
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version != INDEX_VERSION {
+		m.Close()
+		return fmt.Errorf("%w: %s is version %d (expected %d)",
+			ErrBadIndex, fname, version, INDEX_VERSION)
+	}
 
-		fp.Flush()
-		fd.Close()
+	index.wordLen = int(binary.LittleEndian.Uint32(data[8:]))
+	index.posWidth = int(binary.LittleEndian.Uint32(data[12:]))
+	index.genomeLen = int(binary.LittleEndian.Uint64(data[16:]))
+	index.numWords = int(binary.LittleEndian.Uint64(data[24:]))
+	numRecords := int(binary.LittleEndian.Uint64(data[32:]))
+	recordsStart := int(binary.LittleEndian.Uint64(data[40:]))
+
+	corrupt := fmt.Errorf("%w: %s is corrupt", ErrBadIndex, fname)
+	tableEnd := indexHeaderLen + index.numWords*index.entryLen()
+	if tableEnd > recordsStart || recordsStart > size ||
+		(index.posWidth != 4 && index.posWidth != 8) {
+		m.Close()
+		return corrupt
 	}
 
-	index.data = make(indexData)
-	index.count = 0
+	index.records = make([]IndexRecord, numRecords)
+	records := data[recordsStart:]
+	for i := 0; i < numRecords; i++ {
+		if len(records) < 20 {
+			m.Close()
+			return corrupt
+		}
+		offset := int(binary.LittleEndian.Uint64(records))
+		length := int(binary.LittleEndian.Uint64(records[8:]))
+		nameLen := int(binary.LittleEndian.Uint32(records[16:]))
+		if len(records) < 20+nameLen {
+			m.Close()
+			return corrupt
+		}
+		name := string(records[20 : 20+nameLen])
+		index.records[i] = IndexRecord{name, offset, length}
+		records = records[20+nameLen:]
+	}
+
+	index.file = m
+	index.table = data[indexHeaderLen:tableEnd]
+	index.positions = data[tableEnd:recordsStart]
+	return nil
 }
 
-func (index *Index) add(pat string, pos int) {
-	_, there := index.data[pat]
-	if !there {
-		index.data[pat] = make([]int, 0)
+// Open an index for searching
+func OpenIndex(root string) (*Index, error) {
+	index := &Index{root: root}
+	err := index.load()
+	if err != nil {
+		return nil, err
 	}
-	index.data[pat] = append(index.data[pat], pos)
-	index.count++
+	return index, nil
+}
 
-	if index.count == 1024*1024 {
-		index.save()
+func (index *Index) Close() error {
+	if index.file != nil {
+		return index.file.Close()
 	}
+	return nil
 }
 
-func (index *Index) Build(genome *Genomes,
-	root string, length int, verbose bool) {
-	index.root = root
-	index.data = make(indexData)
-	index.wordLen = length
-	index.genomeLen = genome.Length()
-	n := genome.Length() - length
+/*
+We keep indices open once something has searched them, since there's usually
+one search per pattern and there may be a great many patterns.
+*/
+var (
+	openIndices      = make(map[string]*Index)
+	openIndicesMutex sync.Mutex
+)
 
-	nts := genome.Nts[0]
-	for i := 0; i < n; i++ {
-		pat := string(nts[i : i+length])
-		index.add(pat, i)
+func getIndex(root string) (*Index, error) {
+	openIndicesMutex.Lock()
+	defer openIndicesMutex.Unlock()
 
-		if verbose && i%10000 == 0 {
-			fmt.Printf("%.2f%%\n", float64(i*100)/float64(n))
-		}
+	if index, there := openIndices[root]; there {
+		return index, nil
+	}
+	index, err := OpenIndex(root)
+	if err != nil {
+		return nil, err
 	}
+	openIndices[root] = index
+	return index, nil
 }
 
-func (index *Index) Save() {
-	index.save()
-	index.saveMetadata()
+// All the positions where word (which must be wordLen long) is found
+func (index *Index) lookup(word []byte) positionList {
+	if index.legacy {
+		return newPositionList(readFile(index.root, string(word)))
+	}
+
+	entryLen := index.entryLen()
+	i := sort.Search(index.numWords, func(i int) bool {
+		entry := index.table[i*entryLen : i*entryLen+index.wordLen]
+		return bytes.Compare(entry, word) >= 0
+	})
+	if i == index.numWords {
+		return positionList{}
+	}
+
+	entry := index.table[i*entryLen : (i+1)*entryLen]
+	if !bytes.Equal(entry[:index.wordLen], word) {
+		return positionList{}
+	}
+
+	start := int(binary.LittleEndian.Uint64(entry[index.wordLen:]))
+	count := int(binary.LittleEndian.Uint64(entry[index.wordLen+8:]))
+	w := index.posWidth
+	return positionList{index.positions[start*w : (start+count)*w], w}
 }
 
-func (index *Index) Init(root string, wordLen int) {
-	index.root = root
-	index.wordLen = wordLen
+/*
+All the positions where word (which must be WordLen long) is found. For
+building your own searches on top of the index.
+*/
+func (index *Index) Lookup(word []byte) []int {
+	if len(word) != index.wordLen {
+		return nil
+	}
+	positions := index.lookup(word)
+	ret := make([]int, positions.Len())
+	for i := range ret {
+		ret[i] = positions.At(i)
+	}
+	return ret
 }
 
 type IndexSearch struct {
@@ -127,7 +578,7 @@ type IndexSearch struct {
 
 	// The places where the first wordLen nts are found, then the second
 	// wordLen nts, etc.
-	positions [][]int
+	positions []positionList
 
 	// Where we are in our iteration through the first list of positions
 	iterator int
@@ -145,8 +596,9 @@ type IndexSearch struct {
 }
 
 /*
-Read in one of our cache files. This contains all the positions of a
-particular pattern, like CCGGGT or whatever. Return the positions.
+Read in one of the cache files from an old-style index. This contains all the
+positions of a particular pattern, like CCGGGT or whatever. Return the
+positions.
 */
 func readFile(root string, pattern string) []int {
 	ret := make([]int, 0)
@@ -192,18 +644,21 @@ func (s *IndexSearch) Init(root string, needle []byte) {
 		log.Fatal("Refusing to build an index this long.")
 	}
 
-	s.index = &Index{root: root}
-	s.index.loadMetadata()
+	var err error
+	s.index, err = getIndex(root)
+	if err != nil {
+		log.Fatalf("Can't open index: %s", err)
+	}
 
 	m := s.index.wordLen
 	depth := n / m
 
 	// Capacity of +1 because if there is an overhang we will add another list
 	// of positions below.
-	s.positions = make([][]int, depth, depth+1)
+	s.positions = make([]positionList, depth, depth+1)
 
 	for i := 0; i < depth; i++ {
-		s.positions[i] = readFile(s.index.root, string(needle[i*m:i*m+m]))
+		s.positions[i] = s.index.lookup(needle[i*m : i*m+m])
 	}
 
 	/*
@@ -216,8 +671,7 @@ func (s *IndexSearch) Init(root string, needle []byte) {
 	overhang := n - depth*m
 	if overhang > 0 {
 		s.lastOffset = -m + overhang
-		s.positions = append(s.positions,
-			readFile(s.index.root, string(needle[n-m:n])))
+		s.positions = append(s.positions, s.index.lookup(needle[n-m:n]))
 	}
 
 	s.Start()
@@ -226,14 +680,15 @@ func (s *IndexSearch) Init(root string, needle []byte) {
 func (s *IndexSearch) Start() {
 	s.lastFound = -1
 	s.iterator = 0
+	s.end = false
 	s.Next()
 }
 
 func (s *IndexSearch) incr() bool {
 	nWords := len(s.positions)
 
-	for s.iterator < len(s.positions[0]) {
-		prev := s.positions[0][s.iterator]
+	for s.iterator < s.positions[0].Len() {
+		prev := s.positions[0].At(s.iterator)
 		found := true
 
 		for i := 1; i < nWords; i++ {
@@ -242,19 +697,25 @@ func (s *IndexSearch) incr() bool {
 				target += s.lastOffset
 			}
 
-			n := len(s.positions[i])
+			n := s.positions[i].Len()
 			pos := sort.Search(n, func(j int) bool {
-				return s.positions[i][j] >= target
+				return s.positions[i].At(j) >= target
 			})
 			if pos == n {
 				found = false
 				break
 			}
-			if s.positions[i][pos] != target {
+			if s.positions[i].At(pos) != target {
 				found = false
 				break
 			}
-			prev = s.positions[i][pos]
+			prev = s.positions[i].At(pos)
+		}
+
+		// Matches that span two records aren't real
+		if found && !s.index.withinRecord(s.positions[0].At(s.iterator),
+			len(s.needle)) {
+			found = false
 		}
 
 		if found {
@@ -276,11 +737,23 @@ func (s *IndexSearch) Next() {
 
 func (s *IndexSearch) Get() (int, error) {
 	if s.lastFound != -1 {
-		return s.positions[0][s.lastFound], nil
+		return s.positions[0].At(s.lastFound), nil
 	}
 	return 0, errors.New("Off end")
 }
 
+/*
+Like Get but tells you which record the match is in and where it is in that
+record, rather than giving you an offset into all of them concatenated.
+*/
+func (s *IndexSearch) GetRecord() (string, int, error) {
+	pos, err := s.Get()
+	if err != nil {
+		return "", 0, err
+	}
+	return s.index.Locate(pos)
+}
+
 func (s *IndexSearch) IsForwards() bool {
 	return true
 }
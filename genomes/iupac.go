@@ -0,0 +1,122 @@
+package genomes
+
+import (
+	"strings"
+)
+
+// What each IUPAC nucleotide code could actually be
+var iupacNts = map[byte]string{
+	'A': "A",
+	'C': "C",
+	'G': "G",
+	'T': "T",
+	'U': "T",
+	'R': "AG",
+	'Y': "CT",
+	'S': "CG",
+	'W': "AT",
+	'K': "GT",
+	'M': "AC",
+	'B': "CGT",
+	'D': "AGT",
+	'H': "ACT",
+	'V': "ACG",
+	'N': "ACGT",
+}
+
+// And the same for the few ambiguity codes you see in proteins
+var iupacAas = map[byte]string{
+	'B': "DN",
+	'Z': "EQ",
+	'J': "IL",
+}
+
+/*
+The nts an IUPAC code could stand for, so ACGT for N, AG for R and so on. You
+get an empty string for anything that isn't a nucleotide (like '-').
+*/
+func ExpandNt(nt byte) string {
+	return iupacNts[nt]
+}
+
+// The complement of each code (S, W and N are their own)
+var iupacComplements = map[byte]byte{
+	'A': 'T', 'T': 'A', 'U': 'A', 'G': 'C', 'C': 'G',
+	'R': 'Y', 'Y': 'R', 'K': 'M', 'M': 'K',
+	'B': 'V', 'V': 'B', 'D': 'H', 'H': 'D',
+	'S': 'S', 'W': 'W', 'N': 'N',
+}
+
+/*
+Like utils.ReverseComplement but it understands the ambiguity codes, so YTT
+becomes AAR, and it keeps gaps and anything else it doesn't know as they are
+rather than turning them into 0s. Reversing twice gets you back where you
+started (apart from U, which comes back as T).
+*/
+func ReverseComplement(nts []byte) []byte {
+	ret := make([]byte, len(nts))
+	for i, nt := range nts {
+		if c, there := iupacComplements[nt]; there {
+			nt = c
+		}
+		ret[len(nts)-i-1] = nt
+	}
+	return ret
+}
+
+// Is this one of the IUPAC ambiguity codes (as opposed to A, C, G or T)?
+func IsAmbiguousNt(nt byte) bool {
+	return len(iupacNts[nt]) > 1
+}
+
+// Could a and b be the same nucleotide?
+func NtsCompatible(a, b byte) bool {
+	if a == b {
+		return true
+	}
+	aNts, bNts := ExpandNt(a), ExpandNt(b)
+	return aNts != "" && strings.ContainsAny(aNts, bNts)
+}
+
+// Could a and b be the same amino acid? X is compatible with anything.
+func AasCompatible(a, b byte) bool {
+	if a == b {
+		return true
+	}
+	if a == '-' || b == '-' {
+		return false
+	}
+	if a == 'X' || b == 'X' {
+		return true
+	}
+
+	expand := func(aa byte) string {
+		if s, there := iupacAas[aa]; there {
+			return s
+		}
+		return string(aa)
+	}
+	return strings.ContainsAny(expand(a), expand(b))
+}
+
+/*
+All the unambiguous codons an ambiguous one could be. So AAR gives you AAA and
+AAG. Returns nil if any of the nts isn't a nucleotide at all.
+*/
+func ExpandCodon(codon string) []string {
+	ret := []string{""}
+	for i := 0; i < len(codon); i++ {
+		nts := ExpandNt(codon[i])
+		if nts == "" {
+			return nil
+		}
+		expanded := make([]string, 0, len(ret)*len(nts))
+		for _, prefix := range ret {
+			for j := 0; j < len(nts); j++ {
+				expanded = append(expanded, prefix+nts[j:j+1])
+			}
+		}
+		ret = expanded
+	}
+	return ret
+}
@@ -0,0 +1,70 @@
+package genomes
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandCodon(t *testing.T) {
+	for _, c := range []struct {
+		codon    string
+		expected []string
+	}{
+		{"ATG", []string{"ATG"}},
+		{"AAR", []string{"AAA", "AAG"}},
+		{"YTG", []string{"CTG", "TTG"}},
+		{"A-G", nil},
+	} {
+		if got := ExpandCodon(c.codon); !slices.Equal(got, c.expected) {
+			t.Errorf("%s expanded to %v", c.codon, got)
+		}
+	}
+}
+
+func TestReverseComplement(t *testing.T) {
+	for _, c := range []struct{ nts, expected string }{
+		{"ACGT", "ACGT"},
+		{"YTT", "AAR"},
+		{"KMBVDH", "DHBVKM"},
+		{"AC-NSW", "WSN-GT"},
+		{"", ""},
+	} {
+		got := string(ReverseComplement([]byte(c.nts)))
+		if got != c.expected {
+			t.Errorf("%s reverse complemented to %s", c.nts, got)
+		}
+		if back := string(ReverseComplement([]byte(got))); back != c.nts {
+			t.Errorf("%s didn't come back (%s)", c.nts, back)
+		}
+	}
+}
+
+func TestTranslateAmbiguous(t *testing.T) {
+	for _, c := range []struct {
+		nts      string
+		reverse  bool
+		expected string
+	}{
+		{"ATGAAR", false, "MK"},
+		{"YTGAAN", false, "L-"},
+		{"ATG-AA", false, "M-"},
+
+		// The same codons the other way round
+		{"YTTCAT", true, "MK"},
+		{"NTTCAR", true, "L-"},
+		{"TT-CAT", true, "M-"},
+	} {
+		g := NewGenomes(Orfs{{Start: 0, End: len(c.nts), Name: "orf",
+			Reverse: c.reverse}}, 1)
+		g.Nts[0] = []byte(c.nts)
+
+		var got []byte
+		for _, codon := range Translate(g, 0) {
+			got = append(got, codon.Aa)
+		}
+		if string(got) != c.expected {
+			t.Errorf("%s (reverse %t) translated to %s", c.nts, c.reverse,
+				got)
+		}
+	}
+}
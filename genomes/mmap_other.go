@@ -0,0 +1,38 @@
+//go:build !unix
+
+package genomes
+
+import (
+	"io"
+	"os"
+)
+
+/*
+Where there's no mmap we just read the whole thing in, and write it back out
+on Close if it was writable.
+*/
+type mappedFile struct {
+	Data []byte
+	fd   *os.File // nil unless writable
+}
+
+func mapFile(fd *os.File, size int, writable bool) (*mappedFile, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(fd, data); err != nil && !writable {
+		return nil, err
+	}
+	ret := &mappedFile{Data: data}
+	if writable {
+		ret.fd = fd
+	}
+	return ret, nil
+}
+
+func (m *mappedFile) Close() error {
+	var err error
+	if m.fd != nil {
+		_, err = m.fd.WriteAt(m.Data, 0)
+	}
+	m.Data = nil
+	return err
+}
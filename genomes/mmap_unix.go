@@ -0,0 +1,37 @@
+//go:build unix
+
+package genomes
+
+import (
+	"os"
+	"syscall"
+)
+
+// A file mapped into memory. Changes are written back if it's writable.
+type mappedFile struct {
+	Data []byte
+}
+
+func mapFile(fd *os.File, size int, writable bool) (*mappedFile, error) {
+	if size == 0 {
+		return &mappedFile{[]byte{}}, nil
+	}
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(fd.Fd()), 0, size, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data}, nil
+}
+
+func (m *mappedFile) Close() error {
+	if len(m.Data) == 0 {
+		return nil
+	}
+	err := syscall.Munmap(m.Data)
+	m.Data = nil
+	return err
+}
@@ -0,0 +1,197 @@
+package genomes
+
+import (
+	"genomics/utils"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// Where one of the patterns given to a MultiSearch was found
+type PatternMatch struct {
+	Pattern  int // Which one (its index in the patterns you gave us)
+	Genome   int // Which genome it was in
+	Pos      int // Where it starts
+	Forwards bool
+}
+
+type acOutput struct {
+	pattern  int
+	length   int
+	forwards bool
+}
+
+/*
+Finds all the occurrences of a set of patterns in one pass over each genome,
+using an Aho-Corasick automaton. Use this instead of doing a separate
+LinearSearch for each pattern.
+*/
+type MultiSearch struct {
+	patterns [][]byte
+	bidi     bool
+
+	// Maps each byte to its column in delta, or -1 if it's in no pattern
+	symbols [256]int
+
+	// The automaton's transitions for each state, with the failure links
+	// already followed, so searching is just one lookup per nt.
+	delta   [][]int32
+	outputs [][]acOutput
+}
+
+/*
+Make a MultiSearch for patterns. If bidi, look for the reverse complements of
+the patterns as well, reporting those matches with Forwards false and the
+position of the start of the reverse complement. Patterns that are their own
+reverse complement are only reported once, as forwards.
+*/
+func NewMultiSearch(patterns [][]byte, bidi bool) *MultiSearch {
+	var ret MultiSearch
+	ret.Init(patterns, bidi)
+	return &ret
+}
+
+func (m *MultiSearch) Init(patterns [][]byte, bidi bool) {
+	m.patterns = patterns
+	m.bidi = bidi
+
+	for i, _ := range m.symbols {
+		m.symbols[i] = -1
+	}
+	var nSymbols int
+	for _, pat := range patterns {
+		for _, c := range pat {
+			if m.symbols[c] == -1 {
+				m.symbols[c] = nSymbols
+				nSymbols++
+			}
+		}
+	}
+	if bidi {
+		for _, pat := range patterns {
+			for _, c := range utils.ReverseComplement(pat) {
+				if m.symbols[c] == -1 {
+					m.symbols[c] = nSymbols
+					nSymbols++
+				}
+			}
+		}
+	}
+
+	newState := func() int32 {
+		m.delta = append(m.delta, make([]int32, nSymbols))
+		m.outputs = append(m.outputs, nil)
+		return int32(len(m.delta) - 1)
+	}
+	newState()
+
+	// First build the trie. 0 means no transition yet, which is fine since
+	// nothing goes back to the root in a trie.
+	add := func(pat []byte, output acOutput) {
+		var state int32
+		for _, c := range pat {
+			s := m.symbols[c]
+			if m.delta[state][s] == 0 {
+				next := newState()
+				m.delta[state][s] = next
+			}
+			state = m.delta[state][s]
+		}
+		m.outputs[state] = append(m.outputs[state], output)
+	}
+
+	for i, pat := range patterns {
+		if len(pat) == 0 {
+			continue
+		}
+		add(pat, acOutput{i, len(pat), true})
+		if bidi {
+			rc := utils.ReverseComplement(pat)
+			if !slices.Equal(rc, pat) {
+				add(rc, acOutput{i, len(pat), false})
+			}
+		}
+	}
+
+	// Now go breadth first filling in the missing transitions from the
+	// failure links, and collecting the outputs of the states they lead to.
+	fail := make([]int32, len(m.delta))
+	queue := make([]int32, 0)
+	for s := 0; s < nSymbols; s++ {
+		if next := m.delta[0][s]; next != 0 {
+			queue = append(queue, next)
+		}
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for s := 0; s < nSymbols; s++ {
+			next := m.delta[state][s]
+			if next == 0 {
+				m.delta[state][s] = m.delta[fail[state]][s]
+				continue
+			}
+			fail[next] = m.delta[fail[state]][s]
+			m.outputs[next] = append(m.outputs[next],
+				m.outputs[fail[next]]...)
+			queue = append(queue, next)
+		}
+	}
+}
+
+// Call fun with each match in the which'th genome, in order of their ends
+func (m *MultiSearch) SearchGenome(g *Genomes,
+	which int, fun func(match PatternMatch)) {
+	var state int32
+	for i, c := range g.Nts[which] {
+		s := m.symbols[c]
+		if s == -1 {
+			state = 0
+			continue
+		}
+		state = m.delta[state][s]
+		for _, o := range m.outputs[state] {
+			fun(PatternMatch{o.pattern, which, i - o.length + 1, o.forwards})
+		}
+	}
+}
+
+/*
+Find every match in every genome in g, searching the genomes in parallel. The
+results are sorted by genome, then position, then pattern.
+*/
+func (m *MultiSearch) SearchAll(g *Genomes) []PatternMatch {
+	results := make([][]PatternMatch, g.NumGenomes())
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, runtime.NumCPU())
+
+	for i := 0; i < g.NumGenomes(); i++ {
+		wg.Add(1)
+		sem <- true
+		go func() {
+			defer wg.Done()
+			matches := make([]PatternMatch, 0)
+			m.SearchGenome(g, i, func(match PatternMatch) {
+				matches = append(matches, match)
+			})
+			slices.SortFunc(matches, func(a, b PatternMatch) int {
+				if a.Pos != b.Pos {
+					return a.Pos - b.Pos
+				}
+				return a.Pattern - b.Pattern
+			})
+			results[i] = matches
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	ret := make([]PatternMatch, 0)
+	for _, r := range results {
+		ret = append(ret, r...)
+	}
+	return ret
+}
@@ -0,0 +1,382 @@
+package genomes
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Scores for aligning each pair of residues
+type ScoringMatrix struct {
+	Name   string
+	scores [256][256]int16
+}
+
+func (m *ScoringMatrix) Score(a, b byte) int {
+	return int(m.scores[a][b])
+}
+
+/*
+For nucleotides: matches score 2, mismatches -3 (like blastn). IUPAC ambiguity
+codes score 0 against anything they're compatible with, and Ns always score 0.
+*/
+var NucleotideScores = newNucleotideScores()
+
+// The usual matrix for proteins
+var Blosum62 = newBlosum62()
+
+const blosum62Order = "ARNDCQEGHILKMFPSTWYVBZX*"
+
+var blosum62Rows = [...]string{
+	" 4 -1 -2 -2  0 -1 -1  0 -2 -1 -1 -1 -1 -2 -1  1  0 -3 -2  0 -2 -1  0 -4",
+	"-1  5  0 -2 -3  1  0 -2  0 -3 -2  2 -1 -3 -2 -1 -1 -3 -2 -3 -1  0 -1 -4",
+	"-2  0  6  1 -3  0  0  0  1 -3 -3  0 -2 -3 -2  1  0 -4 -2 -3  3  0 -1 -4",
+	"-2 -2  1  6 -3  0  2 -1 -1 -3 -4 -1 -3 -3 -1  0 -1 -4 -3 -3  4  1 -1 -4",
+	" 0 -3 -3 -3  9 -3 -4 -3 -3 -1 -1 -3 -1 -2 -3 -1 -1 -2 -2 -1 -3 -3 -2 -4",
+	"-1  1  0  0 -3  5  2 -2  0 -3 -2  1  0 -3 -1  0 -1 -2 -1 -2  0  3 -1 -4",
+	"-1  0  0  2 -4  2  5 -2  0 -3 -3  1 -2 -3 -1  0 -1 -3 -2 -2  1  4 -1 -4",
+	" 0 -2  0 -1 -3 -2 -2  6 -2 -4 -4 -2 -3 -3 -2  0 -2 -2 -3 -3 -1 -2 -1 -4",
+	"-2  0  1 -1 -3  0  0 -2  8 -3 -3 -1 -2 -1 -2 -1 -2 -2  2 -3  0  0 -1 -4",
+	"-1 -3 -3 -3 -1 -3 -3 -4 -3  4  2 -3  1  0 -3 -2 -1 -3 -1  3 -3 -3 -1 -4",
+	"-1 -2 -3 -4 -1 -2 -3 -4 -3  2  4 -2  2  0 -3 -2 -1 -2 -1  1 -4 -3 -1 -4",
+	"-1  2  0 -1 -3  1  1 -2 -1 -3 -2  5 -1 -3 -1  0 -1 -3 -2 -2  0  1 -1 -4",
+	"-1 -1 -2 -3 -1  0 -2 -3 -2  1  2 -1  5  0 -2 -1 -1 -1 -1  1 -3 -1 -1 -4",
+	"-2 -3 -3 -3 -2 -3 -3 -3 -1  0  0 -3  0  6 -4 -2 -2  1  3 -1 -3 -3 -1 -4",
+	"-1 -2 -2 -1 -3 -1 -1 -2 -2 -3 -3 -1 -2 -4  7 -1 -1 -4 -3 -2 -2 -1 -2 -4",
+	" 1 -1  1  0 -1  0  0  0 -1 -2 -2  0 -1 -2 -1  4  1 -3 -2 -2  0  0  0 -4",
+	" 0 -1  0 -1 -1 -1 -1 -2 -2 -1 -1 -1 -1 -2 -1  1  5 -2 -2  0 -1 -1  0 -4",
+	"-3 -3 -4 -4 -2 -2 -3 -2 -2 -3 -2 -3 -1  1 -4 -3 -2 11  2 -3 -4 -3 -2 -4",
+	"-2 -2 -2 -3 -2 -1 -2 -3  2 -1 -1 -2 -1  3 -3 -2 -2  2  7 -1 -3 -2 -1 -4",
+	" 0 -3 -3 -3 -1 -2 -2 -3 -3  3  1 -2  1 -1 -2 -2  0 -3 -1  4 -3 -2 -1 -4",
+	"-2 -1  3  4 -3  0  1 -1  0 -3 -4  0 -3 -3 -2  0 -1 -4 -3 -3  4  1 -1 -4",
+	"-1  0  0  1 -3  3  4 -2  0 -3 -3  1 -1 -3 -1  0 -1 -3 -2 -2  1  4 -1 -4",
+	" 0 -1 -1 -1 -2 -1 -1 -1 -1 -1 -1 -1 -1 -1 -2  0  0 -2 -1 -1 -1 -1 -1 -4",
+	"-4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4 -4  1",
+}
+
+func newNucleotideScores() *ScoringMatrix {
+	ret := &ScoringMatrix{Name: "nucleotide"}
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			var score int16
+			switch {
+			case a == 'N' || b == 'N':
+				score = 0
+			case a == b && !IsAmbiguousNt(byte(a)) && ExpandNt(byte(a)) != "":
+				score = 2
+			case IsAmbiguousNt(byte(a)) || IsAmbiguousNt(byte(b)):
+				if NtsCompatible(byte(a), byte(b)) {
+					score = 0
+				} else {
+					score = -3
+				}
+			default:
+				score = -3
+			}
+			ret.scores[a][b] = score
+		}
+	}
+	return ret
+}
+
+func newBlosum62() *ScoringMatrix {
+	ret := &ScoringMatrix{Name: "BLOSUM62"}
+
+	// Anything we don't know about scores like X vs X
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			ret.scores[a][b] = -1
+		}
+	}
+	for i, row := range blosum62Rows {
+		for j, field := range strings.Fields(row) {
+			var score int
+			fmt.Sscan(field, &score)
+			ret.scores[blosum62Order[i]][blosum62Order[j]] = int16(score)
+		}
+	}
+	return ret
+}
+
+/*
+How to do a pairwise alignment. A gap of length n costs GapOpen + n *
+GapExtend. We only look at cells within Band of the diagonal (on top of
+however much longer one sequence is than the other). If FreeEndGaps, gaps at
+either end of either sequence cost nothing, which is what you want if one of
+them might be partial.
+*/
+type AlignParams struct {
+	Matrix      *ScoringMatrix
+	GapOpen     int
+	GapExtend   int
+	Band        int
+	FreeEndGaps bool
+}
+
+var NucleotideAlignParams = AlignParams{NucleotideScores, 5, 2, 100, true}
+var ProteinAlignParams = AlignParams{Blosum62, 11, 1, 50, true}
+
+/*
+The result of aligning a and b. A and B are the sequences with gaps put in.
+The CIGAR string is relative to a, so I means there's something in b that
+isn't in a, and D means something in a is missing from b.
+*/
+type PairwiseAlignment struct {
+	A, B  []byte
+	Score int
+	Cigar string
+}
+
+// The three states of Gotoh's algorithm
+const (
+	pwMatch = iota // a and b both have a residue
+	pwDel          // a has one, b has a gap
+	pwIns          // a has a gap, b has a residue
+)
+
+const pwMinusInf = math.MinInt32 / 2
+
+// Which columns of row i are in the band
+func bandLimits(i, n, m, w int) (int, int) {
+	centre := 0
+	if n > 0 {
+		centre = i * m / n
+	}
+	return max(0, centre-w), min(m, centre+w)
+}
+
+/*
+Align a and b with affine gap penalties (Gotoh's version of Needleman-Wunsch),
+only looking within a band around the diagonal so that whole genomes are
+practical.
+*/
+func AlignPair(a, b []byte, params *AlignParams) (*PairwiseAlignment, error) {
+	if params.Matrix == nil {
+		return nil, errors.New("No scoring matrix")
+	}
+	n, m := len(a), len(b)
+
+	w := params.Band
+	if n > 0 {
+		// The band has to be wide enough that consecutive rows overlap
+		w = max(w, m/n+2)
+	} else {
+		w = max(w, m)
+	}
+
+	open, extend := params.GapOpen, params.GapExtend
+	gapCost := func(length int) int {
+		if params.FreeEndGaps || length == 0 {
+			return 0
+		}
+		return -(open + length*extend)
+	}
+
+	// Traceback pointers for each cell in the band. For each state (2 bits
+	// each) which state we came from.
+	rowStart := make([]int, n+2)
+	for i := 0; i <= n; i++ {
+		lo, hi := bandLimits(i, n, m, w)
+		rowStart[i+1] = rowStart[i] + hi - lo + 1
+	}
+	pointers := make([]byte, rowStart[n+1])
+
+	score := func(s [3][]int32, j, lo, hi, state int) int {
+		if j < lo || j > hi {
+			return pwMinusInf
+		}
+		return int(s[state][j])
+	}
+
+	var prev, cur [3][]int32
+	for s := 0; s < 3; s++ {
+		prev[s] = make([]int32, m+1)
+		cur[s] = make([]int32, m+1)
+	}
+
+	// Row 0 is all insertions
+	plo, phi := bandLimits(0, n, m, w)
+	for j := plo; j <= phi; j++ {
+		prev[pwMatch][j] = pwMinusInf
+		prev[pwDel][j] = pwMinusInf
+		prev[pwIns][j] = int32(gapCost(j))
+		pointers[j-plo] = pwIns << 4
+	}
+	prev[pwMatch][0] = 0
+	prev[pwIns][0] = pwMinusInf
+
+	best := func(candidates [3]int) (int, byte) {
+		ret, from := candidates[0], byte(0)
+		for s := 1; s < 3; s++ {
+			if candidates[s] > ret {
+				ret, from = candidates[s], byte(s)
+			}
+		}
+		return ret, from
+	}
+
+	// The best score in the last column of each row, for when trailing gaps
+	// in b are free.
+	type cellScore struct {
+		i, score int
+		state    byte
+	}
+	lastCol := make([]cellScore, 0)
+
+	for i := 1; i <= n; i++ {
+		lo, hi := bandLimits(i, n, m, w)
+		row := pointers[rowStart[i]:rowStart[i+1]]
+
+		for j := lo; j <= hi; j++ {
+			var ptr byte
+
+			if j == 0 {
+				cur[pwMatch][0] = pwMinusInf
+				cur[pwIns][0] = pwMinusInf
+				cur[pwDel][0] = int32(gapCost(i))
+				row[0] = pwDel << 2
+				continue
+			}
+
+			// Match
+			var s int
+			if j-1 >= plo && j-1 <= phi {
+				var from byte
+				s, from = best([3]int{
+					int(prev[pwMatch][j-1]),
+					int(prev[pwDel][j-1]),
+					int(prev[pwIns][j-1])})
+				s += params.Matrix.Score(a[i-1], b[j-1])
+				ptr |= from
+			} else {
+				s = pwMinusInf
+			}
+			cur[pwMatch][j] = int32(max(s, pwMinusInf))
+
+			// Deletion (a[i-1] against a gap) comes from the row above
+			s, from := best([3]int{
+				score(prev, j, plo, phi, pwMatch) - open - extend,
+				score(prev, j, plo, phi, pwDel) - extend,
+				score(prev, j, plo, phi, pwIns) - open - extend})
+			cur[pwDel][j] = int32(max(s, pwMinusInf))
+			ptr |= from << 2
+
+			// Insertion (b[j-1] against a gap) comes from the left
+			s, from = best([3]int{
+				score(cur, j-1, lo, j-1, pwMatch) - open - extend,
+				score(cur, j-1, lo, j-1, pwDel) - open - extend,
+				score(cur, j-1, lo, j-1, pwIns) - extend})
+			cur[pwIns][j] = int32(max(s, pwMinusInf))
+			ptr |= from << 4
+
+			row[j-lo] = ptr
+		}
+		if hi == m && i < n {
+			s, state := best([3]int{int(cur[pwMatch][m]),
+				int(cur[pwDel][m]), int(cur[pwIns][m])})
+			lastCol = append(lastCol, cellScore{i, s, state})
+		}
+		prev, cur = cur, prev
+		plo, phi = lo, hi
+	}
+
+	// prev now holds the last row, whose band always ends at m since it's
+	// centred on the diagonal. Find where to start the traceback.
+	endI, endJ := n, m
+	finalScore, state := best([3]int{
+		int(prev[pwMatch][m]), int(prev[pwDel][m]), int(prev[pwIns][m])})
+
+	if params.FreeEndGaps {
+		// We can stop early in b and have the rest be free insertions...
+		for j := plo; j <= phi; j++ {
+			s, st := best([3]int{int(prev[pwMatch][j]),
+				int(prev[pwDel][j]), int(prev[pwIns][j])})
+			if s > finalScore {
+				finalScore, state, endI, endJ = s, st, n, j
+			}
+		}
+		// ...or early in a with the rest free deletions
+		for _, c := range lastCol {
+			if c.score > finalScore {
+				finalScore, state, endI, endJ = c.score, c.state, c.i, m
+			}
+		}
+	}
+
+	ptrAt := func(i, j int) byte {
+		lo, _ := bandLimits(i, n, m, w)
+		return pointers[rowStart[i]+j-lo]
+	}
+
+	// Trailing free gaps
+	ops := make([]byte, 0, n+m)
+	for i := n; i > endI; i-- {
+		ops = append(ops, 'D')
+	}
+	for j := m; j > endJ; j-- {
+		ops = append(ops, 'I')
+	}
+
+	i, j := endI, endJ
+	for i > 0 || j > 0 {
+		if i == 0 {
+			ops = append(ops, 'I')
+			j--
+			continue
+		}
+		if j == 0 {
+			ops = append(ops, 'D')
+			i--
+			continue
+		}
+		ptr := ptrAt(i, j)
+		switch state {
+		case pwMatch:
+			ops = append(ops, 'M')
+			state = ptr & 3
+			i--
+			j--
+		case pwDel:
+			ops = append(ops, 'D')
+			state = (ptr >> 2) & 3
+			i--
+		case pwIns:
+			ops = append(ops, 'I')
+			state = (ptr >> 4) & 3
+			j--
+		}
+	}
+	slices.Reverse(ops)
+
+	ret := PairwiseAlignment{make([]byte, 0, len(ops)),
+		make([]byte, 0, len(ops)), finalScore, ""}
+	var cigar strings.Builder
+	i, j = 0, 0
+	for k := 0; k < len(ops); {
+		op := ops[k]
+		run := 0
+		for ; k < len(ops) && ops[k] == op; k++ {
+			run++
+			switch op {
+			case 'M':
+				ret.A = append(ret.A, a[i])
+				ret.B = append(ret.B, b[j])
+				i++
+				j++
+			case 'D':
+				ret.A = append(ret.A, a[i])
+				ret.B = append(ret.B, '-')
+				i++
+			case 'I':
+				ret.A = append(ret.A, '-')
+				ret.B = append(ret.B, b[j])
+				j++
+			}
+		}
+		fmt.Fprintf(&cigar, "%d%c", run, op)
+	}
+	ret.Cigar = cigar.String()
+	return &ret, nil
+}
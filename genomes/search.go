@@ -45,6 +45,16 @@ func (s *LinearSearch) Init(haystack *Genomes, which int, needle []byte,
 	s.Start()
 }
 
+/*
+The most mismatches LinearSearch accepts for a given tolerance, so you can
+get the same results from an FMSearch. It has to be fewer than tolerance times
+the length of the needle, except that a tolerance that small still allows an
+exact match.
+*/
+func ToleranceMismatches(tolerance float64, needleLen int) int {
+	return max(int(tolerance*float64(needleLen))-1, 0)
+}
+
 func (s *LinearSearch) Start() {
 	s.pos = 0
 	s.Next()
@@ -147,6 +157,26 @@ func (s *BidiSearch) Get() (int, error) {
 	}
 }
 
+/*
+If the underlying searches know about records (like IndexSearch does) return
+the record name and position in it of the current match.
+*/
+func (s *BidiSearch) GetRecord() (string, int, error) {
+	var current Search
+	if !s.forwards.End() {
+		current = s.forwards
+	} else {
+		current = s.backwards
+	}
+	rs, ok := current.(interface {
+		GetRecord() (string, int, error)
+	})
+	if !ok {
+		return "", 0, errors.New("Search doesn't know about records")
+	}
+	return rs.GetRecord()
+}
+
 func (s *BidiSearch) IsForwards() bool {
 	return !s.forwards.End()
 }
@@ -172,6 +202,13 @@ func NewIndexSearch(root string, needle []byte) *IndexSearch {
 	return &ret
 }
 
+func NewFMSearch(index *FMIndex,
+	needle []byte, maxMismatches int) *FMSearch {
+	var ret FMSearch
+	ret.Init(index, needle, maxMismatches)
+	return &ret
+}
+
 func NewBidiLinearSearch(haystack *Genomes,
 	which int, needle []byte, tolerance float64) *BidiSearch {
 	var forwards, backwards LinearSearch
@@ -188,3 +225,12 @@ func NewBidiIndexSearch(root string, needle []byte) *BidiSearch {
 	backwards.Init(root, utils.ReverseComplement(needle))
 	return &BidiSearch{&forwards, &backwards, forwards.GenomeLength()}
 }
+
+func NewBidiFMSearch(index *FMIndex,
+	needle []byte, maxMismatches int) *BidiSearch {
+	var forwards, backwards FMSearch
+
+	forwards.Init(index, needle, maxMismatches)
+	backwards.Init(index, utils.ReverseComplement(needle), maxMismatches)
+	return &BidiSearch{&forwards, &backwards, index.Length()}
+}
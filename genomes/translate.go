@@ -106,49 +106,111 @@ var CodonTable = map[string]byte{
 
 var ReverseCodonTable map[byte][]string
 
+// A contiguous piece of a spliced or frameshifted ORF
+type Segment struct {
+	Start, End int
+}
+
 type Orf struct {
 	Start, End int
 	Name       string
 	Reverse    bool // Reverse Complement
+
+	/*
+		nil for an ordinary ORF that's just Start..End. Otherwise the pieces
+		that get read, in the order they are read, like join(a..b,c..d) in
+		GenBank. They can overlap, which is how you represent ORF1ab's -1
+		ribosomal frameshift, and Start and End are then the extent of the
+		whole thing. The frame carries on from one segment to the next.
+	*/
+	Segments []Segment
+
+	// nil means use the Genomes' code (which is usually the standard one)
+	Code *GeneticCode
 }
 
 type Orfs []Orf
 
 func LoadOrfs(fname string) Orfs {
+	ret, err := TryLoadOrfs(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+// Like LoadOrfs but returns an error (usually a *LoadError) instead of
+// exiting if the file is missing or can't be parsed.
+func TryLoadOrfs(fname string) (Orfs, error) {
 	ret := make(Orfs, 0)
 
 	fd, err := os.Open(fname)
 	if err != nil {
-		log.Fatalf("Can't open file %s", fname)
+		return nil, &LoadError{fname, 0, err}
 	}
 	defer fd.Close()
 
 	fp := bufio.NewReader(fd)
+	pat := regexp.MustCompile(`complement\(([^)]*)\)`)
+
+	parseError := func(lineNum int, line string) error {
+		return &LoadError{fname, lineNum,
+			fmt.Errorf("%w in ORFs: <%s>", ErrParse, line)}
+	}
 
 loop:
-	for {
+	for lineNum := 1; ; lineNum++ {
 		line, err := fp.ReadString('\n')
 		switch err {
 		case io.EOF:
-			break loop
+			if line == "" {
+				break loop
+			}
 		case nil:
 			break
 		default:
-			log.Fatal("Can't read file")
+			return nil, &LoadError{fname, lineNum, err}
 		}
 
 		var reverse bool
-		pat := regexp.MustCompile(`complement\((.*)\)`)
 
 		line = strings.TrimSpace(line)
-		m := pat.FindSubmatch([]byte(line))
-		if len(m) != 0 {
-			reverse = true
-			line = string(m[1])
+		if line == "" {
+			continue
 		}
 
 		fields := strings.Fields(line)
 
+		// GenBank style locations, like join(266..13468,13468..21555),
+		// optionally followed by the name and a transl_table=n
+		if strings.Contains(fields[0], "..") {
+			var name, table string
+			for _, f := range fields[1:] {
+				if t, found := strings.CutPrefix(f, "transl_table="); found {
+					table = t
+				} else if name == "" {
+					name = f
+				}
+			}
+			orf, err := parseLocation(fields[0], name)
+			if err != nil {
+				return nil, &LoadError{fname, lineNum, err}
+			}
+			orf.Code, err = translTable(table)
+			if err != nil {
+				return nil, &LoadError{fname, lineNum, err}
+			}
+			ret = append(ret, orf)
+			continue
+		}
+
+		// Keep whatever follows the complement(...), which is the name
+		if pat.MatchString(line) {
+			reverse = true
+			line = pat.ReplaceAllString(line, "$1")
+			fields = strings.Fields(line)
+		}
+
 		if strings.Contains(fields[0], ".") {
 			subFields := strings.FieldsFunc(fields[0], func(r rune) bool {
 				return r == '.'
@@ -156,9 +218,13 @@ loop:
 			fields = append(subFields, fields[1:]...)
 		}
 
+		if len(fields) < 2 {
+			return nil, parseError(lineNum, line)
+		}
+
 		start, err := strconv.Atoi(fields[0])
 		if err != nil {
-			log.Fatalf("Parse error in ORFs: <%s>\n", line)
+			return nil, parseError(lineNum, line)
 		}
 
 		// ORFs seem to be conventionally 1-based
@@ -166,7 +232,7 @@ loop:
 
 		end, err := strconv.Atoi(fields[1])
 		if err != nil {
-			log.Fatalf("Parse error in ORFs: <%s>", line)
+			return nil, parseError(lineNum, line)
 		}
 
 		var name string
@@ -174,36 +240,117 @@ loop:
 			name = fields[2]
 		}
 
-		ret = append(ret, Orf{start, end, name, reverse})
+		ret = append(ret, Orf{start, end, name, reverse, nil, nil})
 	}
 
+	return ret, nil
+}
+
+func (o *Orf) segments() []Segment {
+	if o.Segments == nil {
+		return []Segment{{o.Start, o.End}}
+	}
+	return o.Segments
+}
+
+// How many nts get read when you translate the ORF
+func (o *Orf) CodingLength() int {
+	var ret int
+	for _, seg := range o.segments() {
+		ret += seg.End - seg.Start
+	}
 	return ret
 }
 
 /*
-Return the start of the codon and where pos is in it. We just do a linear
-search since there aren't usually that many ORFs and this is probably as
-fast as anything else
+Convert an offset into the ORF's coding sequence into a position in the genome.
+For reverse ORFs each segment is read from its end backwards.
 */
-func (orfs Orfs) GetCodonOffset(pos int) (int, int, error) {
+func (o *Orf) ToGenome(offset int) (int, error) {
+	for _, seg := range o.segments() {
+		n := seg.End - seg.Start
+		if offset < n {
+			if o.Reverse {
+				return seg.End - 1 - offset, nil
+			}
+			return seg.Start + offset, nil
+		}
+		offset -= n
+	}
+	return 0, errors.New("Off end of ORF")
+}
+
+/*
+Convert a position in the genome into an offset into the ORF's coding sequence.
+If pos gets read twice (at a frameshift) you get the first one.
+*/
+func (o *Orf) FromGenome(pos int) (int, error) {
+	var offset int
+	for _, seg := range o.segments() {
+		if pos >= seg.Start && pos < seg.End {
+			if o.Reverse {
+				return offset + seg.End - 1 - pos, nil
+			}
+			return offset + pos - seg.Start, nil
+		}
+		offset += seg.End - seg.Start
+	}
+	return 0, errors.New("Not in ORF")
+}
+
+/*
+Find the ORF pos is in and the offset of pos in its coding sequence. ORFs
+without segments just use pos-Start, whichever direction they go in, which is
+how this has always worked.
+*/
+func (orfs Orfs) findCoding(pos int) (*Orf, int, error) {
 	for i := 0; i < len(orfs); i++ {
 		orf := &orfs[i]
-		if pos >= orf.Start && pos < orf.End {
-			orfPos := pos - orf.Start // pos relative to start of ORF
-			return orf.Start + (orfPos/3)*3, orfPos % 3, nil
+		if pos < orf.Start || pos >= orf.End {
+			continue
+		}
+		if orf.Segments == nil {
+			return orf, pos - orf.Start, nil
+		}
+		if offset, err := orf.FromGenome(pos); err == nil {
+			return orf, offset, nil
 		}
 	}
-	return 0, 0, errors.New("Not in ORF")
+	return nil, 0, errors.New("Not in ORF")
+}
+
+/*
+Return the start of the codon and where pos is in it. We just do a linear
+search since there aren't usually that many ORFs and this is probably as
+fast as anything else. If the ORF is spliced the codon might not be
+contiguous, in which case what you get is the position of its first nt.
+*/
+func (orfs Orfs) GetCodonOffset(pos int) (int, int, error) {
+	orf, orfPos, err := orfs.findCoding(pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if orf.Segments == nil {
+		return orf.Start + (orfPos/3)*3, orfPos % 3, nil
+	}
+	start, err := orf.ToGenome((orfPos / 3) * 3)
+	return start, orfPos % 3, err
 }
 
 /*
 Convert a position into an ORF relative one. Return the index of the ORF and
-the position in it.
+the position in it. For spliced ORFs the position is in the coding sequence, so
+/3 still gives you the codon.
 */
 func (orfs Orfs) GetOrfRelative(pos int) (int, int, error) {
 	for i, orf := range orfs {
 		if pos >= orf.Start && pos < orf.End {
-			return i, pos - orf.Start, nil
+			if orf.Segments == nil {
+				return i, pos - orf.Start, nil
+			}
+			if offset, err := orf.FromGenome(pos); err == nil {
+				return i, offset, nil
+			}
 		}
 	}
 	return 0, 0, nil
@@ -224,9 +371,10 @@ type Environment struct {
 	start  int // Index into the original genome
 	length int // How many nts in the subsequence this represents
 
-	window  []byte // The whole aligned section
-	offset  int    // The offset to the start of the subsequence
-	protein []byte // Its translation
+	window  []byte       // The whole aligned section
+	offset  int          // The offset to the start of the subsequence
+	protein []byte       // Its translation
+	code    *GeneticCode // What we translate it with
 }
 
 // rounded up to the nearest multiple of 3
@@ -236,21 +384,11 @@ func ceil3(n int) int {
 
 /*
 Assume nts are codon aligned and return a translation, with one amino-acid
-letter per nt, so something like LLLRRRIII
+letter per nt, so something like LLLRRRIII. This uses the standard code: call
+TranslateAligned on a GeneticCode if you want a different one.
 */
 func TranslateAligned(nts []byte) []byte {
-	ret := make([]byte, len(nts))
-
-	for i := 0; i < len(nts)-3+1; i += 3 {
-		aa, there := CodonTable[string(nts[i:i+3])]
-		if !there {
-			aa = '-'
-		}
-		for j := 0; j < 3; j++ {
-			ret[i+j] = aa
-		}
-	}
-	return ret
+	return StandardCode.TranslateAligned(nts)
 }
 
 /*
@@ -258,16 +396,7 @@ Assume nts are codon aligned and return a translation, with one amino-acid
 letter per aa, so something like LRI
 */
 func TranslateAlignedShort(nts []byte) []byte {
-	ret := make([]byte, 0)
-
-	for i := 0; i < len(nts)-3+1; i += 3 {
-		aa, there := CodonTable[string(nts[i:i+3])]
-		if !there {
-			aa = '-'
-		}
-		ret = append(ret, aa)
-	}
-	return ret
+	return StandardCode.TranslateAlignedShort(nts)
 }
 
 func (env *Environment) Init(genome *Genomes,
@@ -275,26 +404,64 @@ func (env *Environment) Init(genome *Genomes,
 	env.start = pos
 	env.length = n
 
-	windowStart, codonOffset, err := genome.Orfs.GetCodonOffset(pos)
+	orf, orfPos, err := genome.Orfs.findCoding(pos)
 	if err != nil {
 		return err
 	}
 
+	codonOffset := orfPos % 3
 	windowLen := ceil3(codonOffset + n)
-	windowEnd := windowStart + windowLen
-
 	env.offset = codonOffset
-	env.window = genome.Nts[which][windowStart:windowEnd]
+	env.code = genome.codeFor(orf)
+
+	if orf.Segments == nil {
+		windowStart := orf.Start + orfPos - codonOffset
+		env.window = genome.Nts[which][windowStart : windowStart+windowLen]
+	} else {
+		env.window, err = orf.splicedWindow(genome.Nts[which],
+			orfPos-codonOffset, windowLen, pos, n)
+		if err != nil {
+			return err
+		}
+	}
 
 	if !utils.IsRegularPattern(env.window) {
 		// Usually because of a gap ('-') in an alignment
 		return errors.New("Non-nt in sequence")
 	}
 
-	env.protein = TranslateAligned(env.window)
+	env.protein = env.code.TranslateAligned(env.window)
 	return nil
 }
 
+/*
+Gather the nts of a window of a spliced ORF, starting at offset in its coding
+sequence. The n nts from pos have to be contiguous in the coding sequence too,
+otherwise there's no sensible way to replace them.
+*/
+func (o *Orf) splicedWindow(nts []byte,
+	offset, length int, pos, n int) ([]byte, error) {
+	length = utils.Min(length, o.CodingLength()-offset)
+
+	ret := make([]byte, length)
+	for i := 0; i < length; i++ {
+		p, err := o.ToGenome(offset + i)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = nts[p]
+	}
+
+	start, _ := o.FromGenome(pos)
+	for i := 1; i < n; i++ {
+		p, err := o.ToGenome(start + i)
+		if err != nil || p != pos+i {
+			return nil, errors.New("Spans a splice junction")
+		}
+	}
+	return ret, nil
+}
+
 /*
 Actually rewrite the environment with replacement nts. Not to be confused with
 "Replace" which tells you whether it would be silent if you did rewrite it (but
@@ -313,7 +480,7 @@ func (env *Environment) Rewrite(replacement []byte) error {
 	copy(newWindow[env.offset:env.offset+env.length], replacement)
 
 	env.window = newWindow
-	env.protein = TranslateAligned(env.window)
+	env.protein = env.code.TranslateAligned(env.window)
 	return nil
 }
 
@@ -350,7 +517,7 @@ func (env *Environment) Replace(replacement []byte) (bool, int) {
 	copy(altWindow[env.offset:env.offset+env.length], replacement)
 
 	protein := env.protein
-	altProtein := TranslateAligned(altWindow)
+	altProtein := env.code.TranslateAligned(altWindow)
 
 	silent := true
 	for i := 0; i < len(protein); i += 3 {
@@ -387,11 +554,13 @@ type Alternatives []Alternative
 type altIter struct {
 	protein  []byte // the protein we're finding nts for, as RL not RRRLLL
 	odometer []int  // tracks the codon combinations as we iterate them
+	reverse  map[byte][]string
 }
 
-func (it *altIter) Init(protein []byte) {
+func (it *altIter) Init(protein []byte, code *GeneticCode) {
 	it.protein = protein
 	it.odometer = make([]int, len(protein))
+	it.reverse = code.Reverse
 }
 
 /*
@@ -403,13 +572,13 @@ func (it *altIter) Next() ([]byte, bool) {
 	ret := make([]byte, 0, len(prot)*3)
 
 	for i := 0; i < len(prot); i++ {
-		codons := ReverseCodonTable[prot[i]]
+		codons := it.reverse[prot[i]]
 		ret = append(ret, []byte(codons[it.odometer[i]])...)
 	}
 
 	// Increment the odometer like a sort of odometer
 	for j := 0; j < len(prot); j++ {
-		codons := ReverseCodonTable[prot[j]]
+		codons := it.reverse[prot[j]]
 		if it.odometer[j]+1 < len(codons) {
 			it.odometer[j]++
 			for k := 0; k < j; k++ {
@@ -425,7 +594,7 @@ func (it *altIter) Next() ([]byte, bool) {
 func TestAlternatives() {
 	protein := []byte("RL")
 	var it altIter
-	it.Init(protein)
+	it.Init(protein, StandardCode)
 
 	for {
 		alt, more := it.Next()
@@ -483,7 +652,7 @@ func (env *Environment) FindAlternatives(maxMuts int,
 		protein[i] = env.protein[i*3]
 	}
 
-	it.Init(protein)
+	it.Init(protein, env.code)
 	existing := env.Subsequence()
 
 	for more := true; more; {
@@ -534,61 +703,92 @@ type CodonIter struct {
 	genome *Genomes // Alignment of genomes
 	which  int      // Which one you want to translate
 	orfI   int      // Which ORF we're in
-	pos    int      // Where we are in it
+	pos    int      // Where we are in its coding sequence
+
+	// Where the nts of the last codon came from
+	positions [3]int
 }
 
 func (it *CodonIter) Init(genome *Genomes, which int) {
 	it.genome = genome
 	it.which = which
-	it.pos = genome.Orfs[0].Start
+	it.orfI = 0
+	it.pos = 0
 }
 
 func (it *CodonIter) Next() (pos int, codon string, aa byte, err error) {
 	genome := it.genome
-	nts := genome.Nts
+	nts := genome.Nts[it.which]
 	for ; it.orfI < len(genome.Orfs); it.orfI++ {
-		orf := genome.Orfs[it.orfI]
-		if it.pos == -1 {
-			it.pos = orf.Start
-		}
-		pos = it.pos
-		if pos+3 <= orf.End {
+		orf := &genome.Orfs[it.orfI]
+		if it.pos+3 <= orf.CodingLength() {
+			var short bool
+			for i := 0; i < 3; i++ {
+				it.positions[i], _ = orf.ToGenome(it.pos + i)
+				short = short || it.positions[i] >= len(nts)
+			}
+
+			// This genome is shorter than the ORF
+			if short {
+				it.pos = 0
+				continue
+			}
+
 			if orf.Reverse {
-				rpos := orf.End - (pos - orf.Start) - 3
-				codon = string(utils.ReverseComplement(
-					nts[it.which][rpos : rpos+3]))
+				p := it.positions
+				codon = string(ReverseComplement(
+					[]byte{nts[p[2]], nts[p[1]], nts[p[0]]}))
+
+				// Reverse codons have always been reported at their offset
+				// from the start of the ORF
+				if orf.Segments == nil {
+					pos = orf.Start + it.pos
+				} else {
+					pos = p[2]
+				}
 			} else {
-				codon = string(nts[it.which][pos : pos+3])
-			}
-			var there bool
-			aa, there = CodonTable[codon]
-			if !there {
-				aa = '-'
+				p := it.positions
+				codon = string([]byte{nts[p[0]], nts[p[1]], nts[p[2]]})
+				pos = p[0]
 			}
+
+			aa = genome.codeFor(orf).Translate(codon)
 			err = nil
-			it.pos = pos + 3
+			it.pos += 3
 			return
 		}
-		it.pos = -1 // Marks that we just moved to a new ORF.
+		it.pos = 0 // We just moved to a new ORF.
 	}
 	return 0, "", 0, errors.New("No more ORFs")
 }
 
+/*
+Where the nts of the codon Next just returned are in the genome, in the order
+they're read. Usually that's just pos, pos+1, pos+2 but not when a codon spans
+a splice junction or a frameshift, or the ORF is reversed.
+*/
+func (it *CodonIter) Positions() [3]int {
+	return it.positions
+}
+
 type Codon struct {
 	Pos int
 	Nts string
 	Aa  byte
+
+	// Where each nt came from (see CodonIter.Positions)
+	Positions [3]int
 }
 
 func (c *Codon) Init(pos int, nts string) {
+	c.InitWithCode(pos, nts, StandardCode)
+}
+
+func (c *Codon) InitWithCode(pos int, nts string, code *GeneticCode) {
 	c.Pos = pos
 	c.Nts = nts
-
-	aa, there := CodonTable[c.Nts]
-	if !there {
-		aa = '-'
-	}
-	c.Aa = aa
+	c.Positions = [3]int{pos, pos + 1, pos + 2}
+	c.Aa = code.Translate(c.Nts)
 }
 
 func (c Codon) ToString() string {
@@ -607,7 +807,7 @@ func Translate(genome *Genomes, which int) Translation {
 		if err != nil {
 			break
 		}
-		ret = append(ret, Codon{pos, nts, aa})
+		ret = append(ret, Codon{pos, nts, aa, ci.Positions()})
 	}
 	return ret
 }
@@ -618,8 +818,8 @@ func NewTranslationMap(trans Translation) TranslationMap {
 	ret := make(TranslationMap)
 
 	for _, codon := range trans {
-		for i := 0; i < 3; i++ {
-			ret[codon.Pos+i] = codon
+		for _, pos := range codon.Positions {
+			ret[pos] = codon
 		}
 	}
 
@@ -762,21 +962,3 @@ func ProteinChange(g *Genomes,
 	silent := reflect.DeepEqual(envA.Protein(), envB.Protein())
 	return silent, envB.Protein(), envA.Protein(), nil
 }
-
-func newReverseTable() map[byte][]string {
-	ret := make(map[byte][]string)
-
-	for k := range CodonTable {
-		v, _ := CodonTable[k]
-		codons, there := ret[v]
-		if !there {
-			codons = make([]string, 0)
-		}
-		ret[v] = append(codons, k)
-	}
-	return ret
-}
-
-func init() {
-	ReverseCodonTable = newReverseTable()
-}
@@ -8,8 +8,15 @@ import (
 
 func BuildIndex(fname string, dir string, length int) {
 	fmt.Printf("Loading %s...\n", fname)
-	g := genomes.LoadGenomes(fname, "", true)
-	fmt.Printf("Loaded\n")
+
+	// Keep each record separate so the index knows where they start and end
+	records := genomes.LoadUnaligned(fname, "", false)
+	g := genomes.NewGenomes(nil, len(records))
+	for i, r := range records {
+		g.Nts[i] = r.Nts[0]
+		g.Names[i] = r.Names[0]
+	}
+	fmt.Printf("Loaded %d records\n", len(records))
 
 	var index genomes.Index
 	index.Build(g, dir, length, true)
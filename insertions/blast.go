@@ -16,10 +16,25 @@ type BlastResult struct {
 // organism we're interested in.
 func BlastInsertions(insertions []Insertion, genome string) []BlastResult {
 	bc := stats.BlastDefaultConfig()
+	return blastInsertions(insertions, func(nts []byte) stats.BlastResults {
+		return stats.Blast(bc, genome, nts, 1, 1, stats.NOT_VERBOSE)
+	})
+}
+
+// Like BlastInsertions but doesn't need BLAST+ installed
+func LocalBlastInsertions(insertions []Insertion,
+	lb *stats.LocalBlast) []BlastResult {
+	return blastInsertions(insertions, func(nts []byte) stats.BlastResults {
+		return lb.Search(nts, 1, 1)
+	})
+}
+
+func blastInsertions(insertions []Insertion,
+	search func(nts []byte) stats.BlastResults) []BlastResult {
 	ret := make([]BlastResult, 0)
 
 	for _, ins := range insertions {
-		results := stats.Blast(bc, genome, ins.Nts, 1, 1, stats.NOT_VERBOSE)
+		results := search(ins.Nts)
 		switch len(results) {
 		case 0:
 			continue
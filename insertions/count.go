@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"genomics/config"
 	"genomics/genomes"
 	"genomics/stats"
 	"genomics/utils"
@@ -81,7 +82,7 @@ loop:
 }
 
 func GetSources(class Classification) []Source {
-	root := "/fs/f/genomes/"
+	root := config.Get().Genomes + "/"
 
 	animals := []Source{
 		{ANIMAL, "Human", "human", root + "human/index",
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"flag"
 	"fmt"
+	"genomics/config"
 	"genomics/genomes"
 	"genomics/mutations"
 	"genomics/stats"
@@ -351,7 +352,7 @@ func findInVirus(insertions []Insertion, minLength, maxLength int) {
 		}
 		count++
 
-		Search(ins, "/fs/f/genomes/viruses/SARS2/index", func(ins *Insertion,
+		Search(ins, config.Get().Index, func(ins *Insertion,
 			pos int, forwards bool) {
 			reportFound(ins)
 			found++
@@ -364,7 +365,8 @@ func findInVirus(insertions []Insertion, minLength, maxLength int) {
 
 func loadHuman() *genomes.Genomes {
 	fmt.Printf("Loading...\n")
-	g := genomes.LoadGenomes("/fs/f/genomes/human/GRCh38_latest_genomic.fna.gz",
+	g := genomes.LoadGenomes(
+		config.Get().GenomesPath("human", "GRCh38_latest_genomic.fna.gz"),
 		"", true)
 	fmt.Printf("Loaded human\n")
 	return g
@@ -390,8 +392,8 @@ func findInHuman(insertions []Insertion, minLength, maxLength int) {
 			continue
 		}
 
-		Search(ins, "/fs/f/genomes/human/index", func(ins *Insertion,
-			pos int, forwards bool) {
+		index := config.Get().GenomesPath("human", "index")
+		Search(ins, index, func(ins *Insertion, pos int, forwards bool) {
 			fmt.Printf("%d (length %d) is in human\n", ins.Id, len(ins.Nts))
 			ins.InHuman = true
 			if forwards {
@@ -602,7 +604,7 @@ func makeNotInWH1Filter() filterFunc {
 	// This is assuming your insertions aren't already marked with inWH1. If
 	// they are you can use the flag filter for more speed.
 	return func(ins *Insertion) bool {
-		for s := genomes.NewBidiIndexSearch("/fs/f/genomes/viruses/SARS2/index",
+		for s := genomes.NewBidiIndexSearch(config.Get().Index,
 			ins.Nts); !s.End(); s.Next() {
 			return false
 		}
@@ -1106,7 +1108,7 @@ func UpdateHomology(wh1 *genomes.Genomes,
 }
 
 func findExpectedHomology() {
-	root := "/fs/f/genomes/bacteria/"
+	root := config.Get().GenomesPath("bacteria") + "/"
 	/*
 		bacteria := make([]string, 3)
 		for i, s := range []string{"ANaesl", "AVisc", "AIsrael"} {
@@ -1122,7 +1124,7 @@ func findExpectedHomology() {
 		}
 	*/
 
-	root = "/fs/f/genomes/"
+	root = config.Get().Genomes + "/"
 	animals := []string{"cod", "human", "pangolin", "rabbit", "bat", "lizard"}
 	for _, animal := range animals {
 		fmt.Println(animal)
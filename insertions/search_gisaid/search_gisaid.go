@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"genomics/config"
 	"genomics/database"
 	"genomics/genomes"
 	"path"
@@ -25,8 +27,13 @@ func main() {
 	fname := "gisaid_hcov-19_2025_11_03_08.fasta.gz"
 	fname := "2021-08-22.fasta.gz"
 	*/
-	fname := "B.1.1.7.fasta.gz"
-	gs := genomes.LoadUnaligned(path.Join("/fs/f/tmp/GISAID", fname), "", false)
+	var fname string
+	flag.StringVar(&fname, "fasta",
+		path.Join(config.Get().Tmp, "GISAID", "B.1.1.7.fasta.gz"),
+		"GISAID sequences")
+	flag.Parse()
+
+	gs := genomes.LoadUnaligned(fname, "", false)
 	ref := genomes.LoadGenomes("../../fasta/WH1.fasta",
 		"../../fasta/WH1.orfs", false)
 
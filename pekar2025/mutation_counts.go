@@ -214,7 +214,10 @@ func main() {
 		date = &d
 	}
 
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
 	trans := Transition{from, to, silent}
 	distro, zeros, total := Distribution(db, trans, maxMuts, date, verbose)
 	nonZeros := total - zeros
@@ -0,0 +1,182 @@
+package phylogeny
+
+import (
+	"errors"
+	"fmt"
+	"genomics/genomes"
+	"math"
+	"runtime"
+	"sync"
+)
+
+type DistanceModel int
+
+const (
+	P_DISTANCE DistanceModel = iota
+	JUKES_CANTOR
+	KIMURA_2P
+)
+
+func (m DistanceModel) ToString() string {
+	switch m {
+	case P_DISTANCE:
+		return "p-distance"
+	case JUKES_CANTOR:
+		return "Jukes-Cantor"
+	case KIMURA_2P:
+		return "Kimura 2-parameter"
+	}
+	return "Unknown"
+}
+
+/*
+What to do with sites where there's a gap (or an N or other ambiguity code).
+PAIRWISE_DELETION skips them only for the pairs of genomes where one of them
+has it, so each distance uses as much data as possible. COMPLETE_DELETION
+skips the whole column for everyone, so all the distances are over the same
+sites.
+*/
+type GapHandling int
+
+const (
+	PAIRWISE_DELETION GapHandling = iota
+	COMPLETE_DELETION
+)
+
+func isNt(c byte) bool {
+	switch c {
+	case 'A', 'C', 'G', 'T':
+		return true
+	}
+	return false
+}
+
+func isTransition(a, b byte) bool {
+	switch a {
+	case 'A':
+		return b == 'G'
+	case 'G':
+		return b == 'A'
+	case 'C':
+		return b == 'T'
+	case 'T':
+		return b == 'C'
+	}
+	return false
+}
+
+/*
+Work out the distance between two sequences. Only sites in use (if it isn't
+nil) where both have A, C, G or T count.
+*/
+func distance(a, b []byte, use []bool,
+	model DistanceModel) (float64, error) {
+	var sites, transitions, transversions int
+	for i := range a {
+		if use != nil && !use[i] {
+			continue
+		}
+		if !isNt(a[i]) || !isNt(b[i]) {
+			continue
+		}
+		sites++
+		if a[i] != b[i] {
+			if isTransition(a[i], b[i]) {
+				transitions++
+			} else {
+				transversions++
+			}
+		}
+	}
+	if sites == 0 {
+		return 0, errors.New("No sites to compare")
+	}
+
+	n := float64(sites)
+	p := float64(transitions+transversions) / n
+
+	switch model {
+	case P_DISTANCE:
+		return p, nil
+	case JUKES_CANTOR:
+		x := 1 - 4*p/3
+		if x <= 0 {
+			return 0, errors.New("Too divergent")
+		}
+		return -0.75 * math.Log(x), nil
+	case KIMURA_2P:
+		P := float64(transitions) / n
+		Q := float64(transversions) / n
+		x, y := 1-2*P-Q, 1-2*Q
+		if x <= 0 || y <= 0 {
+			return 0, errors.New("Too divergent")
+		}
+		return -0.5*math.Log(x) - 0.25*math.Log(y), nil
+	}
+	return 0, errors.New("Unknown distance model")
+}
+
+/*
+The matrix of distances between every pair of genomes in an alignment, using
+the given model. Returns an error if there's a pair with nothing to compare,
+or one that's too divergent for the model to give a finite distance.
+*/
+func DistanceMatrix(g *genomes.Genomes, model DistanceModel,
+	gaps GapHandling) ([][]float64, error) {
+	n := g.NumGenomes()
+
+	var use []bool
+	if gaps == COMPLETE_DELETION {
+		use = make([]bool, g.Length())
+		for i := range use {
+			use[i] = true
+			for j := 0; j < n; j++ {
+				if !isNt(g.Nts[j][i]) {
+					use[i] = false
+					break
+				}
+			}
+		}
+	}
+
+	ret := make([][]float64, n)
+	for i := range ret {
+		ret[i] = make([]float64, n)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	rows := make(chan int)
+	for t := 0; t < runtime.NumCPU(); t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rows {
+				for j := 0; j < i; j++ {
+					d, err := distance(g.Nts[i], g.Nts[j], use, model)
+					if err != nil {
+						mutex.Lock()
+						if firstErr == nil {
+							firstErr = fmt.Errorf("%s and %s: %w",
+								g.Names[i], g.Names[j], err)
+						}
+						mutex.Unlock()
+					}
+					ret[i][j] = d
+					ret[j][i] = d
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		rows <- i
+	}
+	close(rows)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return ret, nil
+}
@@ -0,0 +1,219 @@
+package phylogeny
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Names with any of these in have to be quoted
+const NEWICK_SPECIAL = "()[]':;, \t\n"
+
+func quoteName(name string) string {
+	if !strings.ContainsAny(name, NEWICK_SPECIAL) {
+		return name
+	}
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'"
+}
+
+func (n *Node) writeNewick(sb *strings.Builder, root bool) {
+	if !n.IsLeaf() {
+		sb.WriteByte('(')
+		for i, c := range n.Children {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			c.writeNewick(sb, false)
+		}
+		sb.WriteByte(')')
+	}
+	sb.WriteString(quoteName(n.Name))
+	if !root {
+		sb.WriteByte(':')
+		sb.WriteString(strconv.FormatFloat(n.Length, 'g', -1, 64))
+	}
+}
+
+// The tree below n in Newick format, with a trailing ;
+func (n *Node) Newick() string {
+	var sb strings.Builder
+	n.writeNewick(&sb, true)
+	sb.WriteByte(';')
+	return sb.String()
+}
+
+func (n *Node) SaveNewick(fname string) error {
+	return os.WriteFile(fname, []byte(n.Newick()+"\n"), 0644)
+}
+
+type newickParser struct {
+	s   string
+	pos int
+}
+
+func (p *newickParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Newick parse error at %d: %s", p.pos,
+		fmt.Sprintf(format, args...))
+}
+
+// Skip whitespace and [comments]
+func (p *newickParser) skip() error {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		case '[':
+			end := strings.IndexByte(p.s[p.pos:], ']')
+			if end == -1 {
+				return p.errorf("unterminated comment")
+			}
+			p.pos += end + 1
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *newickParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *newickParser) name() (string, error) {
+	err := p.skip()
+	if err != nil {
+		return "", err
+	}
+
+	if p.peek() == '\'' {
+		var sb strings.Builder
+		p.pos++
+		for {
+			if p.pos >= len(p.s) {
+				return "", p.errorf("unterminated quoted name")
+			}
+			c := p.s[p.pos]
+			p.pos++
+			if c == '\'' {
+				if p.peek() != '\'' {
+					break
+				}
+				p.pos++
+			}
+			sb.WriteByte(c)
+		}
+		return sb.String(), nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(NEWICK_SPECIAL,
+		rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos], nil
+}
+
+func (p *newickParser) node() (*Node, error) {
+	ret := &Node{}
+
+	err := p.skip()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '(' {
+		p.pos++
+		for {
+			child, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+			ret.AddChild(child)
+
+			err = p.skip()
+			if err != nil {
+				return nil, err
+			}
+			c := p.peek()
+			p.pos++
+			if c == ')' {
+				break
+			}
+			if c != ',' {
+				p.pos--
+				return nil, p.errorf("expected , or ) but got %q", c)
+			}
+		}
+	}
+
+	ret.Name, err = p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.skip()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == ':' {
+		p.pos++
+		err = p.skip()
+		if err != nil {
+			return nil, err
+		}
+		start := p.pos
+		for p.pos < len(p.s) && strings.IndexByte("0123456789.eE+-",
+			p.s[p.pos]) != -1 {
+			p.pos++
+		}
+		ret.Length, err = strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("bad branch length")
+		}
+	}
+	return ret, nil
+}
+
+/*
+Parse a tree in Newick format. Quoted names, [comments] and internal node
+labels (e.g. bootstrap values, which end up in Name) are all understood.
+Missing branch lengths are 0.
+*/
+func ParseNewick(s string) (*Node, error) {
+	p := newickParser{s, 0}
+	ret, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.skip()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != ';' {
+		return nil, p.errorf("expected ;")
+	}
+	p.pos++
+
+	err = p.skip()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, errors.New("Only one tree per Newick string please")
+	}
+	return ret, nil
+}
+
+func LoadNewick(fname string) (*Node, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNewick(string(data))
+}
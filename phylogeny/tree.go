@@ -0,0 +1,379 @@
+package phylogeny
+
+import (
+	"errors"
+	"fmt"
+	"genomics/genomes"
+	"math"
+)
+
+/*
+A node in a tree. Leaves have a Name and no Children. Length is the length of
+the branch leading to the node from its parent. Internal nodes may have a
+Name too, e.g. a support value read from a Newick file.
+*/
+type Node struct {
+	Name     string
+	Length   float64
+	Children []*Node
+	Parent   *Node
+}
+
+func (n *Node) IsLeaf() bool {
+	return len(n.Children) == 0
+}
+
+func (n *Node) AddChild(child *Node) {
+	child.Parent = n
+	n.Children = append(n.Children, child)
+}
+
+// Call f on every node below (and including) n, parents before children
+func (n *Node) Walk(f func(node *Node)) {
+	f(n)
+	for _, c := range n.Children {
+		c.Walk(f)
+	}
+}
+
+// The leaves below n, in left to right order
+func (n *Node) Leaves() []*Node {
+	ret := make([]*Node, 0)
+	n.Walk(func(node *Node) {
+		if node.IsLeaf() {
+			ret = append(ret, node)
+		}
+	})
+	return ret
+}
+
+// Find the leaf with the given name, or nil if there isn't one
+func (n *Node) Find(name string) *Node {
+	var ret *Node
+	n.Walk(func(node *Node) {
+		if ret == nil && node.IsLeaf() && node.Name == name {
+			ret = node
+		}
+	})
+	return ret
+}
+
+// How far a node is from the root
+func (n *Node) Depth() float64 {
+	var ret float64
+	for node := n; node.Parent != nil; node = node.Parent {
+		ret += node.Length
+	}
+	return ret
+}
+
+/*
+The patristic distance between two nodes in the same tree, i.e. the sum of
+the branch lengths on the path between them.
+*/
+func PathLength(a, b *Node) float64 {
+	ancestors := make(map[*Node]float64)
+	var d float64
+	for node := a; node != nil; node = node.Parent {
+		ancestors[node] = d
+		d += node.Length
+	}
+	d = 0
+	for node := b; node != nil; node = node.Parent {
+		if da, there := ancestors[node]; there {
+			return da + d
+		}
+		d += node.Length
+	}
+	return math.Inf(1)
+}
+
+/*
+Reroot the tree that n is part of at the middle of the branch leading to the
+named leaf, which is the usual thing to do when you know it's an outgroup.
+Returns the new root. The nodes are reused so the old root is no longer
+valid.
+*/
+func (n *Node) Reroot(outgroup string) (*Node, error) {
+	leaf := n.Find(outgroup)
+	if leaf == nil {
+		return nil, fmt.Errorf("Can't find %s in tree", outgroup)
+	}
+	if leaf.Parent == nil {
+		return nil, errors.New("Can't root a tree on its root")
+	}
+
+	// The path from the leaf up to the old root, whose branches all get
+	// reversed
+	path := make([]*Node, 0)
+	for node := leaf.Parent; node != nil; node = node.Parent {
+		path = append(path, node)
+	}
+	lengths := make([]float64, len(path))
+	for i, node := range path {
+		lengths[i] = node.Length
+	}
+
+	removeChild(path[0], leaf)
+	for i := 0; i < len(path)-1; i++ {
+		removeChild(path[i+1], path[i])
+	}
+
+	root := &Node{}
+	half := leaf.Length / 2
+	leaf.Length = half
+	root.AddChild(leaf)
+	path[0].Length = half
+	root.AddChild(path[0])
+	for i := 0; i < len(path)-1; i++ {
+		path[i+1].Length = lengths[i]
+		path[i].AddChild(path[i+1])
+	}
+
+	collapseUnary(root)
+	return root, nil
+}
+
+func removeChild(parent, child *Node) {
+	for i, c := range parent.Children {
+		if c == child {
+			parent.Children = append(parent.Children[:i],
+				parent.Children[i+1:]...)
+			break
+		}
+	}
+	child.Parent = nil
+}
+
+// Get rid of internal nodes with only one child, e.g. an old root
+func collapseUnary(n *Node) {
+	for i, c := range n.Children {
+		for len(c.Children) == 1 {
+			only := c.Children[0]
+			only.Length += c.Length
+			only.Parent = n
+			n.Children[i] = only
+			c = only
+		}
+		collapseUnary(c)
+	}
+}
+
+func checkDistances(distances [][]float64, names []string) error {
+	n := len(distances)
+	if n != len(names) {
+		return errors.New("Need one name per row of the distance matrix")
+	}
+	if n < 2 {
+		return errors.New("Need at least 2 sequences to make a tree")
+	}
+	for i, row := range distances {
+		if len(row) != n {
+			return errors.New("Distance matrix isn't square")
+		}
+		for j, d := range row {
+			if d != distances[j][i] {
+				return errors.New("Distance matrix isn't symmetric")
+			}
+		}
+	}
+	return nil
+}
+
+func copyDistances(distances [][]float64) [][]float64 {
+	ret := make([][]float64, len(distances))
+	for i, row := range distances {
+		ret[i] = make([]float64, len(row))
+		copy(ret[i], row)
+	}
+	return ret
+}
+
+/*
+Build an (unrooted) tree with neighbor-joining (Saitou and Nei 1987). The
+result has a root with 3 children (or 2 if there are only 2 sequences) which
+doesn't mean anything, so use Reroot if you know the outgroup. Negative branch
+lengths are set to 0 with the difference moved to the sibling, as most
+programs do.
+*/
+func NeighborJoining(distances [][]float64, names []string) (*Node, error) {
+	err := checkDistances(distances, names)
+	if err != nil {
+		return nil, err
+	}
+	d := copyDistances(distances)
+
+	nodes := make([]*Node, len(names))
+	for i, name := range names {
+		nodes[i] = &Node{Name: name}
+	}
+
+	// Indices into d and nodes that haven't been joined yet
+	active := make([]int, len(names))
+	for i := range active {
+		active[i] = i
+	}
+
+	for len(active) > 3 {
+		r := float64(len(active))
+		sums := make(map[int]float64)
+		for _, i := range active {
+			for _, j := range active {
+				sums[i] += d[i][j]
+			}
+		}
+
+		// Find the pair with the smallest Q
+		bestI, bestJ := -1, -1
+		var bestQ float64
+		for x, i := range active {
+			for _, j := range active[x+1:] {
+				q := (r-2)*d[i][j] - sums[i] - sums[j]
+				if bestI == -1 || q < bestQ {
+					bestI, bestJ, bestQ = i, j, q
+				}
+			}
+		}
+
+		li := 0.5*d[bestI][bestJ] + (sums[bestI]-sums[bestJ])/(2*(r-2))
+		lj := d[bestI][bestJ] - li
+		if li < 0 {
+			lj += li
+			li = 0
+		} else if lj < 0 {
+			li += lj
+			lj = 0
+		}
+
+		joined := &Node{}
+		nodes[bestI].Length = li
+		nodes[bestJ].Length = lj
+		joined.AddChild(nodes[bestI])
+		joined.AddChild(nodes[bestJ])
+
+		// Reuse bestI's slot for the new node
+		for _, k := range active {
+			if k == bestI || k == bestJ {
+				continue
+			}
+			dk := 0.5 * (d[bestI][k] + d[bestJ][k] - d[bestI][bestJ])
+			d[bestI][k] = dk
+			d[k][bestI] = dk
+		}
+		nodes[bestI] = joined
+
+		for x, k := range active {
+			if k == bestJ {
+				active = append(active[:x], active[x+1:]...)
+				break
+			}
+		}
+	}
+
+	root := &Node{}
+	if len(active) == 2 {
+		i, j := active[0], active[1]
+		nodes[i].Length = d[i][j] / 2
+		nodes[j].Length = d[i][j] / 2
+		root.AddChild(nodes[i])
+		root.AddChild(nodes[j])
+		return root, nil
+	}
+
+	i, j, k := active[0], active[1], active[2]
+	lengths := []float64{
+		0.5 * (d[i][j] + d[i][k] - d[j][k]),
+		0.5 * (d[i][j] + d[j][k] - d[i][k]),
+		0.5 * (d[i][k] + d[j][k] - d[i][j]),
+	}
+	for x, which := range []int{i, j, k} {
+		nodes[which].Length = max(lengths[x], 0)
+		root.AddChild(nodes[which])
+	}
+	return root, nil
+}
+
+/*
+Build a rooted ultrametric tree with UPGMA (average linkage clustering). This
+assumes a molecular clock, so it's mainly useful for closely related
+sequences. Prefer NeighborJoining otherwise.
+*/
+func UPGMA(distances [][]float64, names []string) (*Node, error) {
+	err := checkDistances(distances, names)
+	if err != nil {
+		return nil, err
+	}
+	d := copyDistances(distances)
+
+	nodes := make([]*Node, len(names))
+	sizes := make([]int, len(names))
+	heights := make([]float64, len(names))
+	active := make([]int, len(names))
+	for i, name := range names {
+		nodes[i] = &Node{Name: name}
+		sizes[i] = 1
+		active[i] = i
+	}
+
+	for len(active) > 1 {
+		bestI, bestJ := -1, -1
+		for x, i := range active {
+			for _, j := range active[x+1:] {
+				if bestI == -1 || d[i][j] < d[bestI][bestJ] {
+					bestI, bestJ = i, j
+				}
+			}
+		}
+
+		height := d[bestI][bestJ] / 2
+		joined := &Node{}
+		nodes[bestI].Length = max(height-heights[bestI], 0)
+		nodes[bestJ].Length = max(height-heights[bestJ], 0)
+		joined.AddChild(nodes[bestI])
+		joined.AddChild(nodes[bestJ])
+
+		si, sj := float64(sizes[bestI]), float64(sizes[bestJ])
+		for _, k := range active {
+			if k == bestI || k == bestJ {
+				continue
+			}
+			dk := (d[bestI][k]*si + d[bestJ][k]*sj) / (si + sj)
+			d[bestI][k] = dk
+			d[k][bestI] = dk
+		}
+		nodes[bestI] = joined
+		sizes[bestI] += sizes[bestJ]
+		heights[bestI] = height
+
+		for x, k := range active {
+			if k == bestJ {
+				active = append(active[:x], active[x+1:]...)
+				break
+			}
+		}
+	}
+	return nodes[active[0]], nil
+}
+
+type TreeMethod int
+
+const (
+	NEIGHBOR_JOINING TreeMethod = iota
+	UPGMA_TREE
+)
+
+// Make a tree from an alignment in one go
+func BuildTree(g *genomes.Genomes, model DistanceModel,
+	gaps GapHandling, method TreeMethod) (*Node, error) {
+	distances, err := DistanceMatrix(g, model, gaps)
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case NEIGHBOR_JOINING:
+		return NeighborJoining(distances, g.Names)
+	case UPGMA_TREE:
+		return UPGMA(distances, g.Names)
+	}
+	return nil, errors.New("Unknown tree method")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"genomics/config"
 	"genomics/genomes"
 	"genomics/mutations"
 	"genomics/stats"
@@ -106,7 +107,7 @@ func TestAlign() {
 		"../fasta/WH1.orfs", false)
 	g = g.Filter(0, 7)
 	d := g.Dealign()
-	realigned, _ := align.Align(d, "/fs/f/tmp")
+	realigned, _ := align.Align(d, config.Get().Tmp)
 	realigned.SaveMulti("realigned.fasta")
 }
 
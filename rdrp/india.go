@@ -48,7 +48,7 @@ func ShowSequences(db *database.Database) {
 		}
 		fmt.Println()
 
-		matches := db.SearchByAAMut(muts, 1)
+		matches := db.SearchByAAMut(muts, 1, database.EXACT_MATCH)
 		for _, match := range matches {
 			r := db.Get(match.Id)
 			ourMuts := utils.ToSet(r.AAChanges)
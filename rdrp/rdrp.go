@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"genomics/database"
 	"genomics/utils"
+	"log"
 	"slices"
 )
 
@@ -149,7 +150,10 @@ func (m *RdRPMutations) PrintById() {
 }
 
 func main() {
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
 	ShowSequences(db)
 	// muts := NewRdRPMutations(db)
 	// muts.Print()
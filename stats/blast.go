@@ -2,22 +2,41 @@ package stats
 
 import (
 	"bufio"
-	"crypto/md5"
-    "math/rand"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"genomics/utils"
+	"genomics/config"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 )
 
+type BlastFormat int
+
+const (
+	BLAST_TABULAR BlastFormat = iota // outfmt 6
+	BLAST_XML                        // outfmt 5
+	BLAST_JSON                       // outfmt 15
+)
+
 type BlastConfig struct {
 	BinDir string // where your blast binaries are
 	TmpDir string // where to put query files
 	Prefix string // Path prefix for finding genomes
 	Suffix string // Path from genome dir to blast dbname
+
+	// These are all optional. By default we use blastn-short for queries
+	// shorter than 50 nts and blastn's default otherwise, and get the
+	// results back as tabular output.
+	Task     string
+	WordSize int
+	Format   BlastFormat
 }
 
 func (c *BlastConfig) Init(binDir, tmpDir, prefix, suffix string) {
@@ -27,136 +46,387 @@ func (c *BlastConfig) Init(binDir, tmpDir, prefix, suffix string) {
 	c.Suffix = suffix
 }
 
+// Set up from the paths in config.Config
 func BlastDefaultConfig() *BlastConfig {
 	var ret BlastConfig
-	ret.Init("/fs/f/Downloads/ncbi-blast-2.16.0+/bin",
-		"/fs/f/tmp", "/fs/f/genomes", "blast/nucl/nt")
+	c := config.Get()
+	ret.Init(c.BlastBin, c.Tmp, c.BlastDbDir, c.BlastDb)
 	return &ret
 }
 
+/*
+One HSP. Organism is the subject's id. The positions are 1-based and
+inclusive, like blast reports them, and if the match is on the reverse strand
+of the subject SubjectStart > SubjectEnd. The sequences and the title are only
+filled in for the XML and JSON formats.
+*/
 type BlastResult struct {
 	Organism    string
 	PctIdentity float64
 	Length      int
 	Mismatches  int
 	E           float64
-	Score       float64
+	Score       float64 // bits
+
+	QueryId      string
+	GapOpens     int
+	QueryStart   int
+	QueryEnd     int
+	SubjectStart int
+	SubjectEnd   int
+
+	Title      string
+	QuerySeq   []byte
+	SubjectSeq []byte
 }
 
 type BlastResults []BlastResult
 
-func makeName(query []byte) string {
-    buf := make([]byte, len(query))
+type BlastVerbosity int
+
+const (
+	VERBOSE BlastVerbosity = iota
+	NOT_VERBOSE
+)
+
+// Parse tabular (outfmt 6) output with the standard 12 columns
+func ParseBlastTabular(r io.Reader) (BlastResults, error) {
+	ret := make(BlastResults, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 12 {
+			return nil, fmt.Errorf("Line %d: expected 12 columns, got %d",
+				lineNum, len(fields))
+		}
+
+		var result BlastResult
+		var err error
+		atoi := func(i int, dest *int) {
+			if err == nil {
+				*dest, err = strconv.Atoi(strings.TrimSpace(fields[i]))
+			}
+		}
+		atof := func(i int, dest *float64) {
+			if err == nil {
+				*dest, err = strconv.ParseFloat(strings.TrimSpace(fields[i]), 64)
+			}
+		}
+
+		atof(2, &result.PctIdentity)
+		atoi(3, &result.Length)
+		atoi(4, &result.Mismatches)
+		atoi(5, &result.GapOpens)
+		atoi(6, &result.QueryStart)
+		atoi(7, &result.QueryEnd)
+		atoi(8, &result.SubjectStart)
+		atoi(9, &result.SubjectEnd)
+		atof(10, &result.E)
+		atof(11, &result.Score)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", lineNum, err)
+		}
+		result.QueryId, result.Organism = fields[0], fields[1]
+
+		ret = append(ret, result)
+	}
+	return ret, scanner.Err()
+}
+
+// How many runs of gaps there are in either sequence
+func countGapOpens(a, b []byte) int {
+	var ret int
+	for _, seq := range [][]byte{a, b} {
+		for i, c := range seq {
+			if c == '-' && (i == 0 || seq[i-1] != '-') {
+				ret++
+			}
+		}
+	}
+	return ret
+}
+
+// The first word of the first of s that has one
+func firstWord(s ...string) string {
+	for _, v := range s {
+		if fields := strings.Fields(v); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// Fill in the fields we can work out from the others in XML and JSON output
+func (r *BlastResult) complete(identical, gaps int) {
+	if r.Length > 0 {
+		r.PctIdentity = 100 * float64(identical) / float64(r.Length)
+	}
+	r.Mismatches = r.Length - identical - gaps
+	r.GapOpens = countGapOpens(r.QuerySeq, r.SubjectSeq)
+}
+
+type blastXMLHsp struct {
+	BitScore   float64 `xml:"Hsp_bit-score"`
+	Evalue     float64 `xml:"Hsp_evalue"`
+	QueryFrom  int     `xml:"Hsp_query-from"`
+	QueryTo    int     `xml:"Hsp_query-to"`
+	HitFrom    int     `xml:"Hsp_hit-from"`
+	HitTo      int     `xml:"Hsp_hit-to"`
+	Identity   int     `xml:"Hsp_identity"`
+	Gaps       int     `xml:"Hsp_gaps"`
+	AlignLen   int     `xml:"Hsp_align-len"`
+	QuerySeq   string  `xml:"Hsp_qseq"`
+	SubjectSeq string  `xml:"Hsp_hseq"`
+}
 
-    rand.Read(buf)
+type blastXMLHit struct {
+	Id   string        `xml:"Hit_id"`
+	Def  string        `xml:"Hit_def"`
+	Hsps []blastXMLHsp `xml:"Hit_hsps>Hsp"`
+}
 
-    // Overkill-- the random buffer would be fine
-    for i := 0; i < len(buf); i++ {
-        buf[i] ^= query[i]
-    }
+type blastXMLIteration struct {
+	QueryId  string        `xml:"Iteration_query-ID"`
+	QueryDef string        `xml:"Iteration_query-def"`
+	Hits     []blastXMLHit `xml:"Iteration_hits>Hit"`
+}
 
-	return fmt.Sprintf("%x", md5.Sum(buf))
+type blastXMLOutput struct {
+	Iterations []blastXMLIteration `xml:"BlastOutput_iterations>Iteration"`
 }
 
-func writeFasta(c *BlastConfig, query []byte) string {
-	name := makeName(query)
-	fname := name + ".fasta"
-	fd, err := os.Create(path.Join(c.TmpDir, fname))
+// Parse XML (outfmt 5) output
+func ParseBlastXML(r io.Reader) (BlastResults, error) {
+	var output blastXMLOutput
+	err := xml.NewDecoder(r).Decode(&output)
 	if err != nil {
-		log.Fatal("Can't create temporary file")
+		return nil, err
+	}
+
+	ret := make(BlastResults, 0)
+	for _, it := range output.Iterations {
+		queryId := firstWord(it.QueryDef, it.QueryId)
+		for _, hit := range it.Hits {
+			for _, hsp := range hit.Hsps {
+				result := BlastResult{
+					Organism:     hit.Id,
+					Length:       hsp.AlignLen,
+					E:            hsp.Evalue,
+					Score:        hsp.BitScore,
+					QueryId:      queryId,
+					QueryStart:   hsp.QueryFrom,
+					QueryEnd:     hsp.QueryTo,
+					SubjectStart: hsp.HitFrom,
+					SubjectEnd:   hsp.HitTo,
+					Title:        hit.Def,
+					QuerySeq:     []byte(hsp.QuerySeq),
+					SubjectSeq:   []byte(hsp.SubjectSeq),
+				}
+				result.complete(hsp.Identity, hsp.Gaps)
+				ret = append(ret, result)
+			}
+		}
+	}
+	return ret, nil
+}
+
+type blastJSONHsp struct {
+	BitScore   float64 `json:"bit_score"`
+	Evalue     float64 `json:"evalue"`
+	Identity   int     `json:"identity"`
+	QueryFrom  int     `json:"query_from"`
+	QueryTo    int     `json:"query_to"`
+	HitFrom    int     `json:"hit_from"`
+	HitTo      int     `json:"hit_to"`
+	HitStrand  string  `json:"hit_strand"`
+	AlignLen   int     `json:"align_len"`
+	Gaps       int     `json:"gaps"`
+	QuerySeq   string  `json:"qseq"`
+	SubjectSeq string  `json:"hseq"`
+}
+
+type blastJSONHit struct {
+	Description []struct {
+		Id    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"description"`
+	Hsps []blastJSONHsp `json:"hsps"`
+}
+
+type blastJSONSearch struct {
+	QueryId    string         `json:"query_id"`
+	QueryTitle string         `json:"query_title"`
+	Hits       []blastJSONHit `json:"hits"`
+}
+
+type blastJSONOutput struct {
+	BlastOutput2 []struct {
+		Report struct {
+			Results struct {
+				Search blastJSONSearch `json:"search"`
+			} `json:"results"`
+		} `json:"report"`
+	} `json:"BlastOutput2"`
+}
+
+// Parse single-file JSON (outfmt 15) output
+func ParseBlastJSON(r io.Reader) (BlastResults, error) {
+	var output blastJSONOutput
+	err := json.NewDecoder(r).Decode(&output)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(BlastResults, 0)
+	for _, report := range output.BlastOutput2 {
+		search := report.Report.Results.Search
+		queryId := firstWord(search.QueryTitle, search.QueryId)
+		for _, hit := range search.Hits {
+			var id, title string
+			if len(hit.Description) > 0 {
+				id, title = hit.Description[0].Id, hit.Description[0].Title
+			}
+			for _, hsp := range hit.Hsps {
+				result := BlastResult{
+					Organism:     id,
+					Length:       hsp.AlignLen,
+					E:            hsp.Evalue,
+					Score:        hsp.BitScore,
+					QueryId:      queryId,
+					QueryStart:   hsp.QueryFrom,
+					QueryEnd:     hsp.QueryTo,
+					SubjectStart: hsp.HitFrom,
+					SubjectEnd:   hsp.HitTo,
+					Title:        title,
+					QuerySeq:     []byte(hsp.QuerySeq),
+					SubjectSeq:   []byte(hsp.SubjectSeq),
+				}
+
+				// Make sure minus strand matches go backwards like they do
+				// in the other formats
+				if hsp.HitStrand == "Minus" && hsp.HitFrom < hsp.HitTo {
+					result.SubjectStart, result.SubjectEnd = hsp.HitTo, hsp.HitFrom
+				}
+				result.complete(hsp.Identity, hsp.Gaps)
+				ret = append(ret, result)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func writeFasta(c *BlastConfig, query []byte) (string, error) {
+	fd, err := os.CreateTemp(c.TmpDir, "query-*.fasta")
+	if err != nil {
+		return "", err
 	}
 	defer fd.Close()
 
 	fp := bufio.NewWriter(fd)
-	fmt.Fprintf(fp, ">%s\n", name)
+	fmt.Fprintf(fp, ">query\n")
 	fmt.Fprintln(fp, string(query))
-	fp.Flush()
-	return fname
+	err = fp.Flush()
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return fd.Name(), nil
 }
 
-type BlastVerbosity int
-
-const (
-	VERBOSE BlastVerbosity = iota
-	NOT_VERBOSE
-)
-
 /*
-maxHSP is the maximum number of "high scoring pairs". I think it basically just
-means the maximum number of results you want back. If verbose, print the
-commands out and don't delete the temporary files.
+Like Blast but returns an error if anything goes wrong, including what blast
+wrote to stderr if it failed.
 */
-func Blast(c *BlastConfig, genome string,
+func TryBlast(c *BlastConfig, genome string,
 	query []byte, maxE float64, maxHSP int,
-	verbosity BlastVerbosity) BlastResults {
+	verbosity BlastVerbosity) (BlastResults, error) {
 	verbose := verbosity == VERBOSE
-	tmpName := path.Join(c.TmpDir, writeFasta(c, query))
+	outfmts := []string{"6", "5", "15"}
+	if c.Format < 0 || int(c.Format) >= len(outfmts) {
+		return nil, errors.New("Unknown blast output format")
+	}
+
+	tmpName, err := writeFasta(c, query)
+	if err != nil {
+		return nil, err
+	}
+	if !verbose {
+		defer os.Remove(tmpName)
+	}
+
 	args := []string{
 		fmt.Sprintf("-db=%s", path.Join(c.Prefix, genome, c.Suffix)),
 		fmt.Sprintf("-max_hsps=%d", maxHSP),
-		fmt.Sprintf("-evalue=%f", maxE),
+		fmt.Sprintf("-evalue=%g", maxE),
 		fmt.Sprintf("-query=%s", tmpName),
-		"-outfmt=6",
+		fmt.Sprintf("-outfmt=%s", outfmts[c.Format]),
 	}
 
-	if len(query) < 50 {
-		args = append(args, "-task=blastn-short")
+	task := c.Task
+	if task == "" && len(query) < 50 {
+		task = "blastn-short"
 	}
-
-	binary := path.Join(c.BinDir, "blastn")
-
-	printCmd := func() {
-		fmt.Printf("%s ", binary)
-		for _, arg := range args {
-			fmt.Printf("%s ", arg)
-		}
-		fmt.Printf("\n")
+	if task != "" {
+		args = append(args, fmt.Sprintf("-task=%s", task))
+	}
+	if c.WordSize != 0 {
+		args = append(args, fmt.Sprintf("-word_size=%d", c.WordSize))
 	}
-	cmd := exec.Command(binary, args...)
 
+	binary := path.Join(c.BinDir, "blastn")
+	cmdLine := binary + " " + strings.Join(args, " ")
 	if verbose {
-		printCmd()
+		fmt.Println(cmdLine)
 	}
 
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	cmd.Start()
-
-	utils.ReaderLines(stderr, func(line string, err error) bool {
-		fmt.Fprintln(os.Stderr, line)
-		return true
-	})
-
-	ret := make(BlastResults, 0)
-	utils.ReaderLines(stdout, func(line string, err error) bool {
-		if err != nil {
-			log.Fatal(err)
-		}
-		fields := strings.Fields(line)
-		result := BlastResult{
-			fields[1],
-			utils.Atof(fields[2]),
-			utils.Atoi(fields[3]),
-			utils.Atoi(fields[4]),
-			utils.Atof(fields[10]),
-			utils.Atof(fields[11]),
-		}
-		ret = append(ret, result)
-		return true
-	})
+	// Let exec drain both pipes at once, so blast can't block writing to
+	// one while we're waiting on the other.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
-	err := cmd.Wait()
+	err = cmd.Run()
+	if verbose && stderr.Len() > 0 {
+		fmt.Fprint(os.Stderr, stderr.String())
+	}
 	if err != nil {
-		printCmd()
-		log.Fatal("blast returned error")
-	} else {
-		if !verbose {
-			err = os.Remove(tmpName)
-			if err != nil {
-				log.Fatal(err)
-			}
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", cmdLine, err, msg)
 		}
+		return nil, fmt.Errorf("%s: %w", cmdLine, err)
+	}
+
+	switch c.Format {
+	case BLAST_XML:
+		return ParseBlastXML(&stdout)
+	case BLAST_JSON:
+		return ParseBlastJSON(&stdout)
+	default:
+		return ParseBlastTabular(&stdout)
 	}
+}
 
+/*
+maxHSP is the maximum number of "high scoring pairs". I think it basically just
+means the maximum number of results you want back. If verbose, print the
+commands out and don't delete the temporary files.
+*/
+func Blast(c *BlastConfig, genome string,
+	query []byte, maxE float64, maxHSP int,
+	verbosity BlastVerbosity) BlastResults {
+	ret, err := TryBlast(c, genome, query, maxE, maxHSP, verbosity)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return ret
 }
@@ -86,7 +86,7 @@ class Handler(socketserver.StreamRequestHandler):
 					for f in pca.explained_variance_ratio_]
 				transformed_data = pca.transform(data)
 
-				self.wfile.write(bytes("{} {} {}".format(*ev,
+				self.wfile.write(bytes("{} {}\n".format(" ".join(ev),
 						   encode_array(transformed_data)), 'ascii'))
 
 
@@ -0,0 +1,285 @@
+package stats
+
+import (
+	"errors"
+	"math"
+)
+
+// log(n!)
+func logFactorial(n int) float64 {
+	ret, _ := math.Lgamma(float64(n + 1))
+	return ret
+}
+
+/*
+The hypergeometric distribution of the top left cell of a 2x2 table with the
+same margins as ct. Returns the log probability of each possible value, and
+the smallest one.
+*/
+func (ct *ContingencyTable) hypergeometric() ([]float64, int) {
+	row1, row2 := ct.A+ct.B, ct.C+ct.D
+	col1 := ct.A + ct.C
+	n := row1 + row2
+
+	lo := max(0, col1-row2)
+	hi := min(row1, col1)
+
+	// Everything but the bit that depends on x
+	k := logFactorial(row1) + logFactorial(row2) +
+		logFactorial(col1) + logFactorial(n-col1) - logFactorial(n)
+
+	ret := make([]float64, hi-lo+1)
+	for x := lo; x <= hi; x++ {
+		ret[x-lo] = k - logFactorial(x) - logFactorial(row1-x) -
+			logFactorial(col1-x) - logFactorial(row2-col1+x)
+	}
+	return ret, lo
+}
+
+/*
+The sample odds ratio, (A*D)/(B*C), which is what scipy's fisher_exact
+returns. Unlike CalcOR this can be +Inf, or NaN if both B*C and A*D are 0.
+*/
+func (ct *ContingencyTable) SampleOR() float64 {
+	num := float64(ct.A) * float64(ct.D)
+	den := float64(ct.B) * float64(ct.C)
+	if den == 0 {
+		if num == 0 {
+			return math.NaN()
+		}
+		return math.Inf(1)
+	}
+	return num / den
+}
+
+/*
+Fisher's exact test, done natively. Returns the sample OR and the p-value, and
+also sets them in ct. LESS is the probability of an OR this small or smaller,
+GREATER of one this big or bigger, and TWO_SIDED adds up all the tables that
+are no more likely than this one (which is what scipy does).
+*/
+func (ct *ContingencyTable) FisherExact(alternative FisherAlternative) (float64,
+	float64) {
+	probs, lo := ct.hypergeometric()
+	observed := ct.A - lo
+
+	var p float64
+	switch alternative {
+	case LESS:
+		for i := 0; i <= observed; i++ {
+			p += math.Exp(probs[i])
+		}
+	case GREATER:
+		for i := observed; i < len(probs); i++ {
+			p += math.Exp(probs[i])
+		}
+	case TWO_SIDED:
+		// Allow a bit of slack so tables that are exactly as likely as this
+		// one aren't left out because of rounding.
+		threshold := probs[observed] + math.Log1p(1e-7)
+		for _, prob := range probs {
+			if prob <= threshold {
+				p += math.Exp(prob)
+			}
+		}
+	}
+
+	ct.OR, ct.P = ct.SampleOR(), min(p, 1)
+	return ct.OR, ct.P
+}
+
+// Survival function of the chi-square distribution with df degrees of freedom
+func chiSquareSF(x float64, df int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return upperIncompleteGamma(float64(df)/2, x/2)
+}
+
+/*
+The regularized upper incomplete gamma function Q(a, x), using the series for
+small x and the continued fraction otherwise, like Numerical Recipes does.
+*/
+func upperIncompleteGamma(a, x float64) float64 {
+	const (
+		maxIterations = 1000
+		epsilon       = 1e-15
+		tiny          = 1e-300
+	)
+	lg, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lg)
+
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < maxIterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return max(0, 1-sum*prefix)
+	}
+
+	// Lentz's method
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < maxIterations; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return prefix * h
+}
+
+/*
+The expected counts for an r x c table of observed counts if the rows and
+columns are independent.
+*/
+func expectedCounts(observed [][]float64) ([][]float64, error) {
+	rows := len(observed)
+	if rows < 2 {
+		return nil, errors.New("Need at least 2 rows")
+	}
+	cols := len(observed[0])
+	if cols < 2 {
+		return nil, errors.New("Need at least 2 columns")
+	}
+
+	rowTotals := make([]float64, rows)
+	colTotals := make([]float64, cols)
+	var total float64
+	for i, row := range observed {
+		if len(row) != cols {
+			return nil, errors.New("Rows are different lengths")
+		}
+		for j, v := range row {
+			if v < 0 {
+				return nil, errors.New("Negative count")
+			}
+			rowTotals[i] += v
+			colTotals[j] += v
+			total += v
+		}
+	}
+
+	ret := make([][]float64, rows)
+	for i := range ret {
+		ret[i] = make([]float64, cols)
+		for j := range ret[i] {
+			ret[i][j] = rowTotals[i] * colTotals[j] / total
+			if ret[i][j] == 0 {
+				return nil, errors.New("A row or column is all zeros")
+			}
+		}
+	}
+	return ret, nil
+}
+
+/*
+Pearson's chi-square test of independence for an r x c table of counts.
+Returns the statistic, its degrees of freedom and the p-value. If yates, apply
+Yates' continuity correction (only for 2x2 tables, like scipy's
+chi2_contingency).
+*/
+func ChiSquareTest(observed [][]float64,
+	yates bool) (float64, int, float64, error) {
+	expected, err := expectedCounts(observed)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	df := (len(observed) - 1) * (len(observed[0]) - 1)
+	correct := yates && df == 1
+
+	var stat float64
+	for i, row := range observed {
+		for j, o := range row {
+			diff := math.Abs(o - expected[i][j])
+			if correct {
+				diff = max(0, diff-0.5)
+			}
+			stat += diff * diff / expected[i][j]
+		}
+	}
+	return stat, df, chiSquareSF(stat, df), nil
+}
+
+/*
+The G-test (log-likelihood ratio test) of independence for an r x c table of
+counts. Returns the statistic, its degrees of freedom and the p-value.
+*/
+func GTest(observed [][]float64) (float64, int, float64, error) {
+	expected, err := expectedCounts(observed)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	df := (len(observed) - 1) * (len(observed[0]) - 1)
+
+	var stat float64
+	for i, row := range observed {
+		for j, o := range row {
+			if o > 0 {
+				stat += 2 * o * math.Log(o/expected[i][j])
+			}
+		}
+	}
+	return stat, df, chiSquareSF(stat, df), nil
+}
+
+func (ct *ContingencyTable) matrix() [][]float64 {
+	return [][]float64{
+		{float64(ct.A), float64(ct.B)},
+		{float64(ct.C), float64(ct.D)},
+	}
+}
+
+// Chi-square test on ct (see ChiSquareTest). Returns the statistic and p.
+func (ct *ContingencyTable) ChiSquare(yates bool) (float64, float64, error) {
+	stat, _, p, err := ChiSquareTest(ct.matrix(), yates)
+	return stat, p, err
+}
+
+// G-test on ct. Returns the statistic and p.
+func (ct *ContingencyTable) GTest() (float64, float64, error) {
+	stat, _, p, err := GTest(ct.matrix())
+	return stat, p, err
+}
+
+/*
+Confidence interval for the odds ratio at the given level (e.g. 0.95), using
+Woolf's method (normal approximation to the log OR). If any of the cells are
+0 we add 0.5 to all of them first (the Haldane-Anscombe correction) so there
+is an answer.
+*/
+func (ct *ContingencyTable) ORConfidenceInterval(level float64) (float64,
+	float64, error) {
+	if level <= 0 || level >= 1 {
+		return 0, 0, errors.New("Confidence level must be between 0 and 1")
+	}
+
+	a, b, c, d := float64(ct.A), float64(ct.B), float64(ct.C), float64(ct.D)
+	if a == 0 || b == 0 || c == 0 || d == 0 {
+		a, b, c, d = a+0.5, b+0.5, c+0.5, d+0.5
+	}
+
+	logOR := math.Log((a * d) / (b * c))
+	se := math.Sqrt(1/a + 1/b + 1/c + 1/d)
+	z := math.Sqrt2 * math.Erfinv(level)
+
+	return math.Exp(logOR - z*se), math.Exp(logOR + z*se), nil
+}
@@ -0,0 +1,450 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"genomics/genomes"
+	"genomics/utils"
+	"math"
+	"slices"
+	"sort"
+)
+
+/*
+A BLAST-like search that runs in-process, so you don't need BLAST+ installed.
+It finds seeds with a genomes.Index, extends them without gaps and then (if
+they look promising) with gaps, both with X-drop, and works out E-values with
+the Karlin-Altschul formula. Scoring is like blastn's defaults (see
+genomes.NucleotideAlignParams). It won't find exactly the same things as
+blastn but it's close for the sort of thing we use it for.
+*/
+type LocalBlast struct {
+	index   *genomes.Index
+	subject []byte // All the records concatenated, like the index has them
+	names   []string
+	offsets []int // Where each record starts in subject, plus the end
+
+	Params        genomes.AlignParams
+	UngappedXDrop int // Raw score
+	GappedXDrop   int
+	GapTrigger    int     // Ungapped score needed to try a gapped extension
+	Lambda, K     float64 // Karlin-Altschul parameters for Params
+}
+
+/*
+Search the sequences in fasta, which must have been indexed (with each one as a
+separate record, as the index tool does) into indexRoot.
+*/
+func NewLocalBlast(indexRoot, fasta string) (*LocalBlast, error) {
+	records, err := genomes.TryLoadUnaligned(fasta, "", false)
+	if err != nil {
+		return nil, err
+	}
+	index, err := genomes.OpenIndex(indexRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret LocalBlast
+	ret.index = index
+	ret.offsets = make([]int, 0, len(records)+1)
+	for _, r := range records {
+		ret.offsets = append(ret.offsets, len(ret.subject))
+		ret.subject = append(ret.subject, r.Nts[0]...)
+		ret.names = append(ret.names, r.Names[0])
+	}
+	ret.offsets = append(ret.offsets, len(ret.subject))
+
+	if len(ret.subject) != index.GenomeLength() {
+		return nil, errors.New("Index doesn't match the sequences")
+	}
+
+	// These are what blastn uses for match 2, mismatch -3, gaps 5/2
+	ret.Params = genomes.NucleotideAlignParams
+	ret.UngappedXDrop = 20
+	ret.GappedXDrop = 30
+	ret.GapTrigger = 2*index.WordLen() + 8
+	ret.Lambda, ret.K = 0.625, 0.41
+
+	return &ret, nil
+}
+
+// Which record pos is in
+func (b *LocalBlast) findRecord(pos int) int {
+	return sort.Search(len(b.names), func(i int) bool {
+		return b.offsets[i+1] > pos
+	})
+}
+
+// One alignment between the query and part of the subject
+type localHSP struct {
+	record       int
+	qStart, qEnd int
+	sStart, sEnd int // In subject
+	score        int
+	ops          []byte // M, I (in subject only) and D (in query only)
+}
+
+// How far an ungapped extension in one direction gets, and its score
+func (b *LocalBlast) ungappedExtend(q, s []byte) (int, int) {
+	var score, best, bestLen int
+	for i := 0; i < len(q) && i < len(s); i++ {
+		score += b.Params.Matrix.Score(q[i], s[i])
+		if score > best {
+			best, bestLen = score, i+1
+		} else if score < best-b.UngappedXDrop {
+			break
+		}
+	}
+	return best, bestLen
+}
+
+const (
+	xdMatch = iota
+	xdIns   // Consumes s only
+	xdDel   // Consumes q only
+
+	xdDead = math.MinInt32 / 2
+)
+
+/*
+The best scoring alignment of a prefix of q with a prefix of s, giving up on
+cells that score more than GappedXDrop below the best so far. Returns the
+score, how much of q and s it used and the operations.
+*/
+func (b *LocalBlast) gappedExtend(q, s []byte) (int, int, int, []byte) {
+	open, extend := b.Params.GapOpen, b.Params.GapExtend
+	x := b.GappedXDrop
+
+	// Traceback for each live cell. The bottom 2 bits are the best state
+	// there, then a bit each for whether the Ins and Del states got there by
+	// extending a gap rather than opening one.
+	trace := make([][]byte, 0)
+	los := make([]int, 0)
+
+	var best, bestI, bestJ int
+
+	// Row 0 is just insertions
+	h := []int{0}
+	e := []int{xdDead}
+	f := []int{xdDead}
+	row := []byte{xdMatch}
+	for j := 1; j <= len(s); j++ {
+		score := -(open + j*extend)
+		if score < best-x {
+			break
+		}
+		h = append(h, score)
+		e = append(e, score)
+		f = append(f, xdDead)
+		t := byte(xdIns)
+		if j > 1 {
+			t |= 4
+		}
+		row = append(row, t)
+	}
+	trace = append(trace, row)
+	los = append(los, 0)
+	lo, hi := 0, len(h)-1
+
+	for i := 1; i <= len(q); i++ {
+		prevH, prevF := h, f
+		prevLo, prevHi := lo, hi
+		h, e, f = make([]int, 0), make([]int, 0), make([]int, 0)
+		row = make([]byte, 0)
+		newLo, newHi := -1, -1
+
+		get := func(arr []int, j int) int {
+			if j < prevLo || j > prevHi {
+				return xdDead
+			}
+			return arr[j-prevLo]
+		}
+
+		for j := prevLo; j <= len(s); j++ {
+			var t byte
+
+			m := xdDead
+			if j > 0 {
+				if diag := get(prevH, j-1); diag != xdDead {
+					m = diag + b.Params.Matrix.Score(q[i-1], s[j-1])
+				}
+			}
+
+			ff := xdDead
+			if up := get(prevH, j); up != xdDead {
+				ff = up - open - extend
+			}
+			if up := get(prevF, j); up != xdDead && up-extend > ff {
+				ff = up - extend
+				t |= 8
+			}
+
+			ee := xdDead
+			if k := len(h) - 1; k >= 0 {
+				ee = h[k] - open - extend
+				if e[k] != xdDead && e[k]-extend > ee {
+					ee = e[k] - extend
+					t |= 4
+				}
+			}
+
+			hh, state := m, byte(xdMatch)
+			if ee > hh {
+				hh, state = ee, xdIns
+			}
+			if ff > hh {
+				hh, state = ff, xdDel
+			}
+			t |= state
+
+			if hh < best-x {
+				hh, ee, ff = xdDead, xdDead, xdDead
+				if j > prevHi+1 {
+					// Nothing more to the right can be alive
+					break
+				}
+			} else {
+				if newLo == -1 {
+					newLo = j
+				}
+				newHi = j
+				if hh > best {
+					best, bestI, bestJ = hh, i, j
+				}
+			}
+
+			// Only keep cells from the first live one
+			if newLo == -1 {
+				continue
+			}
+			h = append(h, hh)
+			e = append(e, ee)
+			f = append(f, ff)
+			row = append(row, t)
+		}
+
+		if newLo == -1 {
+			break
+		}
+		h, e, f = h[:newHi-newLo+1], e[:newHi-newLo+1], f[:newHi-newLo+1]
+		trace = append(trace, row[:newHi-newLo+1])
+		los = append(los, newLo)
+		lo, hi = newLo, newHi
+	}
+
+	// Trace back from the best cell
+	ops := make([]byte, 0)
+	i, j := bestI, bestJ
+	state := trace[i][j-los[i]] & 3
+	for i > 0 || j > 0 {
+		t := trace[i][j-los[i]]
+		switch state {
+		case xdMatch:
+			ops = append(ops, 'M')
+			i, j = i-1, j-1
+			state = trace[i][j-los[i]] & 3
+		case xdIns:
+			ops = append(ops, 'I')
+			j--
+			if t&4 == 0 {
+				state = trace[i][j-los[i]] & 3
+			}
+		case xdDel:
+			ops = append(ops, 'D')
+			i--
+			if t&8 == 0 {
+				state = trace[i][j-los[i]] & 3
+			}
+		}
+	}
+	slices.Reverse(ops)
+	return best, bestI, bestJ, ops
+}
+
+/*
+Extend the seed at query position qPos and subject position sPos in both
+directions.
+*/
+func (b *LocalBlast) extend(query []byte, qPos, sPos, record int) localHSP {
+	recStart, recEnd := b.offsets[record], b.offsets[record+1]
+
+	// Don't let it wander further into the subject than it could usefully go
+	slack := len(query)/2 + 50
+
+	s := b.subject[sPos:min(recEnd, sPos+len(query)-qPos+slack)]
+	rightScore, rightQ, rightS, rightOps := b.gappedExtend(query[qPos:], s)
+
+	q := slices.Clone(query[:qPos])
+	slices.Reverse(q)
+	s = slices.Clone(b.subject[max(recStart, sPos-qPos-slack):sPos])
+	slices.Reverse(s)
+	leftScore, leftQ, leftS, leftOps := b.gappedExtend(q, s)
+	slices.Reverse(leftOps)
+
+	return localHSP{record,
+		qPos - leftQ, qPos + rightQ,
+		sPos - leftS, sPos + rightS,
+		leftScore + rightScore,
+		append(leftOps, rightOps...)}
+}
+
+// Find all the HSPs for one strand of the query
+func (b *LocalBlast) searchStrand(query []byte) []localHSP {
+	w := b.index.WordLen()
+	ret := make([]localHSP, 0)
+
+	// For each diagonal, how far along the query we've already extended
+	extended := make(map[int]int)
+
+	covered := func(qPos, sPos int) bool {
+		for _, hsp := range ret {
+			if qPos >= hsp.qStart && qPos < hsp.qEnd &&
+				sPos >= hsp.sStart && sPos < hsp.sEnd {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i+w <= len(query); i++ {
+		for _, pos := range b.index.Lookup(query[i : i+w]) {
+			diag := pos - i
+			if end, there := extended[diag]; there && i < end {
+				continue
+			}
+			if covered(i, pos) {
+				continue
+			}
+
+			record := b.findRecord(pos)
+			recStart, recEnd := b.offsets[record], b.offsets[record+1]
+
+			// Ungapped first, to see if it's worth going any further
+			right, rightLen := b.ungappedExtend(query[i:], b.subject[pos:recEnd])
+			q := slices.Clone(query[:i])
+			slices.Reverse(q)
+			s := slices.Clone(b.subject[max(recStart, pos-i):pos])
+			slices.Reverse(s)
+			left, _ := b.ungappedExtend(q, s)
+
+			extended[diag] = i + rightLen
+			if left+right < b.GapTrigger {
+				continue
+			}
+
+			hsp := b.extend(query, i, pos, record)
+			extended[diag] = max(extended[diag], hsp.qEnd)
+			ret = append(ret, hsp)
+		}
+	}
+	return ret
+}
+
+// E-value and bit score for a raw score
+func (b *LocalBlast) evaluate(score, queryLen int) (float64, float64) {
+	s := float64(score)
+	e := b.K * float64(queryLen) * float64(len(b.subject)) *
+		math.Exp(-b.Lambda*s)
+	bits := (b.Lambda*s - math.Log(b.K)) / math.Ln2
+	return e, bits
+}
+
+/*
+Turn an HSP into what blast would report. If reverse is true query is the
+reverse complement of what we were asked to search for, so the match is on the
+subject's minus strand, and the coordinates are converted back the way blast
+does it: the query ones are on the original query, and SubjectStart >
+SubjectEnd.
+*/
+func (b *LocalBlast) toResult(hsp *localHSP, query []byte,
+	reverse bool) BlastResult {
+	var identical, mismatches int
+	qi, si := hsp.qStart, hsp.sStart
+	for _, op := range hsp.ops {
+		switch op {
+		case 'M':
+			if query[qi] == b.subject[si] {
+				identical++
+			} else {
+				mismatches++
+			}
+			qi++
+			si++
+		case 'I':
+			si++
+		case 'D':
+			qi++
+		}
+	}
+
+	length := len(hsp.ops)
+	e, bits := b.evaluate(hsp.score, len(query))
+	ret := BlastResult{
+		Organism:     b.names[hsp.record],
+		PctIdentity:  100 * float64(identical) / float64(length),
+		Length:       length,
+		Mismatches:   mismatches,
+		E:            e,
+		Score:        bits,
+		QueryStart:   hsp.qStart + 1,
+		QueryEnd:     hsp.qEnd,
+		SubjectStart: hsp.sStart - b.offsets[hsp.record] + 1,
+		SubjectEnd:   hsp.sEnd - b.offsets[hsp.record],
+	}
+	if reverse {
+		ret.QueryStart, ret.QueryEnd = len(query)-hsp.qEnd+1,
+			len(query)-hsp.qStart
+		ret.SubjectStart, ret.SubjectEnd = ret.SubjectEnd, ret.SubjectStart
+	}
+	for i, op := range hsp.ops {
+		if op != 'M' && (i == 0 || hsp.ops[i-1] != op) {
+			ret.GapOpens++
+		}
+	}
+	return ret
+}
+
+/*
+Search for query on both strands. Returns up to maxHSP results for each
+record with E-values no more than maxE, best first, like Blast.
+*/
+func (b *LocalBlast) Search(query []byte, maxE float64,
+	maxHSP int) BlastResults {
+	query = bytes.ToUpper(query)
+	ret := make(BlastResults, 0)
+
+	for i, q := range [][]byte{query, utils.ReverseComplement(query)} {
+		for _, hsp := range b.searchStrand(q) {
+			result := b.toResult(&hsp, q, i == 1)
+			if result.E <= maxE {
+				ret = append(ret, result)
+			}
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b BlastResult) int {
+		switch {
+		case a.E < b.E:
+			return -1
+		case a.E > b.E:
+			return 1
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+
+	// Only keep the best ones for each record
+	counts := make(map[string]int)
+	filtered := make(BlastResults, 0, len(ret))
+	for _, r := range ret {
+		if counts[r.Organism] < maxHSP {
+			filtered = append(filtered, r)
+			counts[r.Organism]++
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,171 @@
+package stats
+
+import (
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type Correction int
+
+const (
+	BONFERRONI Correction = iota
+	HOLM
+	BENJAMINI_HOCHBERG
+)
+
+/*
+Adjust a set of p-values for multiple testing. Returns the adjusted p-values
+in the same order, so you can compare them directly with your alpha.
+BONFERRONI and HOLM control the family-wise error rate, BENJAMINI_HOCHBERG the
+false discovery rate. They all give the same answers as R's p.adjust.
+*/
+func AdjustPValues(p []float64, method Correction) []float64 {
+	n := len(p)
+	ret := make([]float64, n)
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return p[order[i]] < p[order[j]]
+	})
+
+	switch method {
+	case BONFERRONI:
+		for i, v := range p {
+			ret[i] = min(1, v*float64(n))
+		}
+	case HOLM:
+		// Step down from the smallest, never letting it decrease
+		var running float64
+		for rank, i := range order {
+			running = max(running, min(1, p[i]*float64(n-rank)))
+			ret[i] = running
+		}
+	case BENJAMINI_HOCHBERG:
+		// Step up from the biggest, never letting it increase
+		running := 1.0
+		for rank := n - 1; rank >= 0; rank-- {
+			i := order[rank]
+			running = min(running, p[i]*float64(n)/float64(rank+1))
+			ret[i] = running
+		}
+	}
+	return ret
+}
+
+/*
+Adjust the p-values of a set of tables (which you must already have done the
+tests on) for multiple testing. Returns the adjusted p-values in the same
+order; the tables' own P are left alone.
+*/
+func AdjustTables(cts []ContingencyTable, method Correction) []float64 {
+	p := make([]float64, len(cts))
+	for i, ct := range cts {
+		p[i] = ct.P
+	}
+	return AdjustPValues(p, method)
+}
+
+/*
+A permutation or Monte Carlo test. Statistic works out the test statistic, and
+Shuffle makes a new random version of the data under the null hypothesis (it
+mustn't change the data it's given since several trials run at once). Each
+trial has its own random number generator seeded from Seed and the trial
+number, so you get the same answer for the same Seed however many threads
+there are. Alternative says which direction counts as extreme: GREATER means
+trials with a statistic at least as big as the real one, and TWO_SIDED
+compares absolute values, so make sure the statistic is centred on 0 under
+the null for that.
+*/
+type PermutationTest[T any] struct {
+	Data        T
+	Statistic   func(data T) float64
+	Shuffle     func(data T, rng *rand.Rand) T
+	Trials      int
+	Seed        uint64
+	Alternative FisherAlternative
+	Threads     int     // 0 means one per CPU
+	Level       float64 // of the confidence interval. 0 means 0.95
+}
+
+type PermutationResult struct {
+	Observed float64
+	Trials   int
+	Extreme  int     // How many trials were at least as extreme as Observed
+	P        float64 // (Extreme + 1) / (Trials + 1)
+
+	// Confidence interval for the true p given we only did Trials of them
+	// (Wilson score interval)
+	Lower, Upper float64
+}
+
+func (t *PermutationTest[T]) isExtreme(stat, observed float64) bool {
+	switch t.Alternative {
+	case LESS:
+		return stat <= observed
+	case GREATER:
+		return stat >= observed
+	default:
+		return math.Abs(stat) >= math.Abs(observed)
+	}
+}
+
+func (t *PermutationTest[T]) Run() PermutationResult {
+	observed := t.Statistic(t.Data)
+
+	threads := t.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	var wg sync.WaitGroup
+	counts := make([]int, threads)
+	for w := 0; w < threads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < t.Trials; i += threads {
+				rng := rand.New(rand.NewPCG(t.Seed, uint64(i)))
+				stat := t.Statistic(t.Shuffle(t.Data, rng))
+				if t.isExtreme(stat, observed) {
+					counts[w]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var extreme int
+	for _, c := range counts {
+		extreme += c
+	}
+
+	level := t.Level
+	if level == 0 {
+		level = 0.95
+	}
+	lower, upper := wilsonInterval(extreme, t.Trials, level)
+
+	return PermutationResult{observed, t.Trials, extreme,
+		float64(extreme+1) / float64(t.Trials+1), lower, upper}
+}
+
+// Wilson score interval for a proportion of successes out of n
+func wilsonInterval(successes, n int, level float64) (float64, float64) {
+	if n == 0 {
+		return 0, 1
+	}
+	z := math.Sqrt2 * math.Erfinv(level)
+	nF := float64(n)
+	p := float64(successes) / nF
+
+	denom := 1 + z*z/nF
+	centre := (p + z*z/(2*nF)) / denom
+	halfWidth := z * math.Sqrt(p*(1-p)/nF+z*z/(4*nF*nF)) / denom
+	return max(0, centre-halfWidth), min(1, centre+halfWidth)
+}
@@ -0,0 +1,222 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+)
+
+type PCAResult struct {
+	VarianceRatio []float64   // one per component
+	ReducedData   [][]float64 // one row per input row, one column per component
+	Variance      []float64   // explained variance, one per component
+	Loadings      [][]float64 // one row per component, one column per feature
+	Mean          []float64   // of each feature, which we subtracted
+}
+
+/*
+Principal component analysis of data (one row per observation, one column per
+feature), done natively with an SVD. Gives the same answers as sklearn's PCA,
+except that the signs of the components might be different: we make the
+biggest loading of each one positive.
+*/
+func TryPCA(components int, data [][]float64) (PCAResult, error) {
+	var ret PCAResult
+	n := len(data)
+	if n < 2 {
+		return ret, errors.New("Need at least 2 rows for PCA")
+	}
+	p := len(data[0])
+	if p == 0 {
+		return ret, errors.New("Invalid PCA Data")
+	}
+	for _, row := range data {
+		if len(row) != p {
+			return ret, errors.New("PCA rows are different lengths")
+		}
+	}
+	if components < 1 || components > min(n, p) {
+		return ret, fmt.Errorf("Can't have %d components from a %dx%d matrix",
+			components, n, p)
+	}
+
+	ret.Mean = make([]float64, p)
+	for _, row := range data {
+		for j, v := range row {
+			ret.Mean[j] += v
+		}
+	}
+	for j := range ret.Mean {
+		ret.Mean[j] /= float64(n)
+	}
+
+	centred := make([][]float64, n)
+	for i, row := range data {
+		centred[i] = make([]float64, p)
+		for j, v := range row {
+			centred[i][j] = v - ret.Mean[j]
+		}
+	}
+
+	/*
+		The squares of the singular values of centred are the eigenvalues of
+		whichever of centred * centred' and centred' * centred is smaller, and
+		we can get the other set of singular vectors from the ones we find.
+	*/
+	var values []float64
+	var vectors [][]float64
+	wide := n <= p
+	if wide {
+		values, vectors = symmetricEigen(gramMatrix(centred))
+	} else {
+		values, vectors = symmetricEigen(gramMatrix(transpose(centred)))
+	}
+
+	var total float64
+	for _, v := range values {
+		total += max(v, 0)
+	}
+
+	ret.Variance = make([]float64, components)
+	ret.VarianceRatio = make([]float64, components)
+	ret.Loadings = make([][]float64, components)
+	for c := 0; c < components; c++ {
+		value := max(values[c], 0)
+		ret.Variance[c] = value / float64(n-1)
+		if total > 0 {
+			ret.VarianceRatio[c] = value / total
+		}
+
+		if wide {
+			// vectors are the left singular vectors so we need to go back
+			// through the data to get the loadings
+			s := math.Sqrt(value)
+			loading := make([]float64, p)
+			if s > 0 {
+				for i, row := range centred {
+					u := vectors[c][i] / s
+					for j, v := range row {
+						loading[j] += u * v
+					}
+				}
+			}
+			ret.Loadings[c] = loading
+		} else {
+			ret.Loadings[c] = vectors[c]
+		}
+
+		// Fix the sign so that we always get the same answer
+		var biggest float64
+		for _, v := range ret.Loadings[c] {
+			if math.Abs(v) > math.Abs(biggest) {
+				biggest = v
+			}
+		}
+		if biggest < 0 {
+			for j := range ret.Loadings[c] {
+				ret.Loadings[c][j] = -ret.Loadings[c][j]
+			}
+		}
+	}
+
+	ret.ReducedData = make([][]float64, n)
+	for i, row := range centred {
+		ret.ReducedData[i] = make([]float64, components)
+		for c, loading := range ret.Loadings {
+			var sum float64
+			for j, v := range row {
+				sum += v * loading[j]
+			}
+			ret.ReducedData[i][c] = sum
+		}
+	}
+	return ret, nil
+}
+
+func PCA(components int, data [][]float64) PCAResult {
+	ret, err := TryPCA(components, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+type MDSResult struct {
+	Coords      [][]float64 // one row per item, one column per dimension
+	Eigenvalues []float64   // one per dimension
+	Ratio       []float64   // of the sum of the positive eigenvalues
+}
+
+/*
+Classical (Torgerson) multidimensional scaling: find coordinates in the given
+number of dimensions whose Euclidean distances are as close as possible to
+distances, which should be a symmetric matrix with zeros on the diagonal. If
+the distances really are Euclidean this is the same as PCA. Dimensions with
+non-positive eigenvalues (which happens when they aren't) get 0 coordinates.
+*/
+func MDS(dimensions int, distances [][]float64) (MDSResult, error) {
+	var ret MDSResult
+	n := len(distances)
+	if dimensions < 1 || dimensions > n {
+		return ret, fmt.Errorf("Can't have %d dimensions from %d items",
+			dimensions, n)
+	}
+	for i, row := range distances {
+		if len(row) != n {
+			return ret, errors.New("Distance matrix isn't square")
+		}
+		for j, d := range row {
+			if d != distances[j][i] {
+				return ret, errors.New("Distance matrix isn't symmetric")
+			}
+		}
+	}
+
+	// Double centre the squared distances
+	b := make([][]float64, n)
+	rowMeans := make([]float64, n)
+	var mean float64
+	for i, row := range distances {
+		b[i] = make([]float64, n)
+		for j, d := range row {
+			b[i][j] = d * d
+			rowMeans[i] += d * d
+		}
+		mean += rowMeans[i]
+		rowMeans[i] /= float64(n)
+	}
+	mean /= float64(n * n)
+
+	for i := range b {
+		for j := range b[i] {
+			// The column means are the same as the row means
+			b[i][j] = -0.5 * (b[i][j] - rowMeans[i] - rowMeans[j] + mean)
+		}
+	}
+
+	values, vectors := symmetricEigen(b)
+
+	var total float64
+	for _, v := range values {
+		total += max(v, 0)
+	}
+
+	ret.Eigenvalues = values[:dimensions]
+	ret.Ratio = make([]float64, dimensions)
+	ret.Coords = make([][]float64, n)
+	for i := range ret.Coords {
+		ret.Coords[i] = make([]float64, dimensions)
+	}
+	for c := 0; c < dimensions; c++ {
+		if values[c] <= 0 {
+			continue
+		}
+		ret.Ratio[c] = values[c] / total
+		s := math.Sqrt(values[c])
+		for i := 0; i < n; i++ {
+			ret.Coords[i][c] = vectors[c][i] * s
+		}
+	}
+	return ret, nil
+}
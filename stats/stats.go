@@ -1,11 +1,14 @@
 package stats
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"strings"
+	"sync"
 )
 
 type ContingencyTable struct {
@@ -25,82 +28,64 @@ const (
 	GREATER
 )
 
-type FisherInput struct {
-	ct          *ContingencyTable
-	alternative FisherAlternative
-}
-
-var fisherInput chan *FisherInput
-var fisherOutput chan FisherResult
-
-func parseFloats(buf string, n int) ([]float64, string) {
+func parseFloats(buf string, n int) ([]float64, string, error) {
 	components := strings.SplitN(buf, " ", n+1)
-	ret := make([]float64, len(components)-1)
+	if len(components) != n+1 {
+		return nil, "", errors.New("Not enough values in reply")
+	}
+	ret := make([]float64, n)
 	for i := 0; i < n; i++ {
 		var x uint64
 		_, err := fmt.Sscanf(components[i], "%x", &x)
 		if err != nil {
-			log.Fatal(err)
+			return nil, "", err
 		}
 		ret[i] = math.Float64frombits(x)
 	}
-	return ret, components[n]
+	return ret, components[n], nil
 }
 
-func StatsClient() {
-	conn, err := net.Dial("unix", "/tmp/call_scipy.sock")
-	if err != nil {
-		log.Fatalf("Did you start call_scipy.py?")
-	}
-	defer conn.Close()
+/*
+Where call_scipy.py listens. We only use it if asked to (to cross-check the
+native implementations) so it doesn't need to be running otherwise.
+*/
+const SCIPY_SOCKET = "/tmp/call_scipy.sock"
 
-	/*
-		Currently this buffer needs to be big enough for everything we expect back
-		in one shot
-	*/
-	buf := make([]byte, 1024*1024)
+type scipyClient struct {
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
 
-	alternatives := []string{
-		"two-sided",
-		"less",
-		"greater",
-	}
+var scipy scipyClient
+
+// Send msg to call_scipy.py and return its one line reply
+func (s *scipyClient) call(msg string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
 
-	read := func() {
-		_, err := conn.Read(buf)
+	if s.conn == nil {
+		conn, err := net.Dial("unix", SCIPY_SOCKET)
 		if err != nil {
-			log.Fatal(err)
+			return "", fmt.Errorf("Did you start call_scipy.py? %w", err)
 		}
+		s.conn = conn
+		s.reader = bufio.NewReader(conn)
 	}
 
-	for {
-		select {
-		case fi := <-fisherInput:
-			msg := fmt.Sprintf("fisher %s %s\n",
-				fi.ct.String(), alternatives[fi.alternative])
-			conn.Write([]byte(msg))
-			read()
-			var result FisherResult
-			fmt.Sscanf(string(buf), "%g %g", &result.OR, &result.p)
-			fisherOutput <- result
-		case pi := <-pcaInput:
-			msg := fmt.Sprintf("pca %d %s\n", pi.components,
-				pi.EncodeData())
-			conn.Write([]byte(msg))
-			read()
-			s := string(buf)
-			variance, s := parseFloats(s, 2)
-			result := PCAResult{variance, nil}
-			result.DecodeData(s)
-
-			if len(result.ReducedData) != len(pi.data) {
-				// This would happen if your buffer was too small (for example)
-				log.Fatalf("Received %d reduced rows from %d rows\n",
-					len(result.ReducedData), len(pi.data))
-			}
-			pcaOutput <- result
+	_, err := s.conn.Write([]byte(msg))
+	if err == nil {
+		var reply string
+		reply, err = s.reader.ReadString('\n')
+		if err == nil {
+			return strings.TrimSpace(reply), nil
 		}
 	}
+
+	// Start again next time
+	s.conn.Close()
+	s.conn = nil
+	return "", err
 }
 
 func (ct *ContingencyTable) Init(a, b, c, d int) {
@@ -120,13 +105,29 @@ func (c *ContingencyTable) CalcOR() float64 {
 	return c.OR
 }
 
-// But if we want to know the p-value we'll get that from our Python server.
-func (c *ContingencyTable) FisherExact(alternative FisherAlternative) (float64,
-	float64) {
-	fisherInput <- &FisherInput{c, alternative}
-	result := <-fisherOutput
-	c.OR, c.P = result.OR, result.p
-	return c.OR, c.P
+/*
+Like FisherExact but asks scipy (via call_scipy.py, which you need to have
+started). Only really useful for checking the native version.
+*/
+func (c *ContingencyTable) ScipyFisherExact(
+	alternative FisherAlternative) (float64, float64, error) {
+	alternatives := []string{
+		"two-sided",
+		"less",
+		"greater",
+	}
+	reply, err := scipy.call(fmt.Sprintf("fisher %s %s\n",
+		c.String(), alternatives[alternative]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var OR, p float64
+	_, err = fmt.Sscanf(reply, "%g %g", &OR, &p)
+	if err != nil {
+		return 0, 0, err
+	}
+	return OR, p, nil
 }
 
 // A string in the format we pass it to scipy
@@ -171,11 +172,6 @@ func (p *PCAInput) EncodeData() string {
 	return strings.Join(matrixS, ";")
 }
 
-type PCAResult struct {
-	VarianceRatio []float64 // one per component
-	ReducedData   [][]float64
-}
-
 /*
 s is a string representing a matrix in the same format we used in EncodeData: ,
 separate items in a row and ; separates rows
@@ -195,25 +191,28 @@ func (p *PCAResult) DecodeData(s string) {
 	}
 }
 
-var pcaInput chan *PCAInput
-var pcaOutput chan PCAResult
-
-func PCA(components int, data [][]float64) PCAResult {
-	// We only parse a 2x matrix out of the result
-	if components != 2 {
-		log.Fatal("Currently only 2 components are supported\n")
+/*
+PCA done by sklearn (via call_scipy.py, which you need to have started). Only
+fills in VarianceRatio and ReducedData. Use PCA unless you're checking it.
+*/
+func ScipyPCA(components int, data [][]float64) (PCAResult, error) {
+	pi := PCAInput{components, data}
+	reply, err := scipy.call(fmt.Sprintf("pca %d %s\n",
+		pi.components, pi.EncodeData()))
+	if err != nil {
+		return PCAResult{}, err
 	}
-	pcaInput <- &PCAInput{components, data}
-	result := <-pcaOutput
-	return result
-}
 
-func init() {
-	fisherInput = make(chan *FisherInput)
-	fisherOutput = make(chan FisherResult)
-
-	pcaInput = make(chan *PCAInput)
-	pcaOutput = make(chan PCAResult)
+	variance, s, err := parseFloats(reply, components)
+	if err != nil {
+		return PCAResult{}, err
+	}
+	result := PCAResult{VarianceRatio: variance}
+	result.DecodeData(s)
 
-	go StatsClient()
+	if len(result.ReducedData) != len(pi.data) {
+		return PCAResult{}, fmt.Errorf("Received %d reduced rows from %d rows",
+			len(result.ReducedData), len(pi.data))
+	}
+	return result, nil
 }
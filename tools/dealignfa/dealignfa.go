@@ -1,10 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"flag"
+	"fmt"
 	"genomics/genomes"
-	"genomics/utils"
+	"log"
 )
 
 func main() {
@@ -14,17 +14,35 @@ func main() {
 	flag.Parse()
 
 	fname := flag.Args()[0]
-	g := genomes.LoadGenomes(fname, "", false)
-	dealigned := g.Dealign()
 
-	fd, fp := utils.WriteFile(outname)
-	defer fd.Close()
+	w, err := genomes.CreateFasta(outname)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Do this one record at a time so it works on huge alignments
+	var writeErr error
+	err = genomes.ForEachFasta(fname, func(r *genomes.FastaRecord) bool {
+		nts := make([]byte, 0, len(r.Nts))
+		for _, nt := range r.Nts {
+			if nt != '-' {
+				nts = append(nts, nt)
+			}
+		}
+		writeErr = w.WriteNts(r.Name, nts)
+		return writeErr == nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if writeErr != nil {
+		log.Fatal(writeErr)
+	}
 
-	for _, g := range dealigned {
-		fmt.Fprintf(fp, ">%s\n", g.Names[0])
-		utils.Wrap(fp, g.Nts[0])
+	err = w.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
-	fp.Flush()
 
 	fmt.Printf("Wrote %s\n", outname)
 }
@@ -71,6 +71,7 @@ func main() {
 		location  int
 		reverse   bool
 		tolerance float64
+		useFM     bool
 	)
 
 	flag.StringVar(&patString, "p", "", "Pattern to look for")
@@ -79,6 +80,8 @@ func main() {
 	flag.IntVar(&location, "l", 0, "One-based location (rather than pattern)")
 	flag.BoolVar(&reverse, "r", false, "Reverse (if you used location)")
 	flag.Float64Var(&tolerance, "tol", 0.0, "Search tolerance")
+	flag.BoolVar(&useFM, "fm", false,
+		"Search with an FM-index (faster for big genomes)")
 	flag.Parse()
 
 	pattern := []byte(patString)
@@ -92,6 +95,18 @@ func main() {
 
 			if location != -1 {
 				search = &LocationSearch{location, reverse, false, g.Length()}
+			} else if useFM {
+				index, err := genomes.NewFMIndex(g, i)
+				if err != nil {
+					log.Fatal(err)
+				}
+				mismatches := genomes.ToleranceMismatches(tolerance,
+					len(pattern))
+				if bidi {
+					search = genomes.NewBidiFMSearch(index, pattern, mismatches)
+				} else {
+					search = genomes.NewFMSearch(index, pattern, mismatches)
+				}
 			} else if bidi {
 				search = genomes.NewBidiLinearSearch(g, i, pattern, tolerance)
 			} else {
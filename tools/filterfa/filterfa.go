@@ -93,14 +93,29 @@ func main() {
 		"rp", -1, "Remove genomes with more than this many Ns")
 	flag.Parse()
 
-	g := genomes.LoadGenomes(flag.Arg(0), "", false)
-
 	if summary {
-		fmt.Printf("%d nucleotides\n", g.Length())
-		g.PrintSummary()
+		// Stream this so it works on files too big to load
+		var i int
+		err := genomes.ForEachFasta(flag.Arg(0),
+			func(r *genomes.FastaRecord) bool {
+				if i == 0 {
+					fmt.Printf("%d nucleotides\n", len(r.Nts))
+				}
+				fmt.Printf("%d: %s\n", i, r.Name)
+				i++
+				return true
+			})
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
+	g, err := genomes.TryLoadGenomes(flag.Arg(0), "", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if ss {
 		for i, n := range g.Names {
 			ss := g.SequenceSimilarity(i, ref, protein)
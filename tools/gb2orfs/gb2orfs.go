@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"genomics/genomes"
+	"genomics/utils"
+	"log"
+)
+
+/*
+Convert the CDS annotations in a GenBank (.gb) or GFF3 (.gff3) file into our
+.orfs format.
+*/
+func main() {
+	var outName string
+
+	flag.StringVar(&outName, "o", "", "Output filename (default based "+
+		"on the input name)")
+	flag.Parse()
+
+	fname := flag.Arg(0)
+	base, ext := utils.SplitExt(fname)
+	if ext == ".gz" {
+		base, ext = utils.SplitExt(base)
+	}
+
+	var orfs genomes.Orfs
+	var err error
+
+	switch ext {
+	case ".gff", ".gff3":
+		orfs, err = genomes.LoadGff3Orfs(fname)
+	default:
+		orfs, err = genomes.LoadGenBankOrfs(fname)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if outName == "" {
+		outName = base + ".orfs"
+	}
+
+	err = orfs.Save(outName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %d ORFs to %s\n", len(orfs), outName)
+}
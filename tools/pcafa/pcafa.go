@@ -9,6 +9,7 @@ import (
 	"genomics/stats"
 	"genomics/utils"
 	"log"
+	"math"
 	"path"
 	"strings"
 )
@@ -497,20 +498,53 @@ func (p *PCA) AddData(rows [][]float64, name string) {
 	p.rowLabels = append(p.rowLabels, rowLabels...)
 }
 
-func (p *PCA) Reduce() {
+func (p *PCA) Reduce(components int) {
 	fmt.Printf("Reducing %dx%d matrix...\n", len(p.data), len(p.data[0]))
-	p.result = stats.PCA(2, p.data)
+	p.result = stats.PCA(components, p.data)
 	fmt.Println("Explained variance ratio:", p.result.VarianceRatio)
 }
 
+/*
+Instead of PCA do classical MDS on the Manhattan distances between the rows,
+which for the one-hot prot and nt modes is twice the number of places they
+differ.
+*/
+func (p *PCA) ReduceMDS(components int) {
+	n := len(p.data)
+	fmt.Printf("Scaling %d rows...\n", n)
+	distances := make([][]float64, n)
+	for i := 0; i < n; i++ {
+		distances[i] = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < i; j++ {
+			var d float64
+			for k, v := range p.data[i] {
+				d += math.Abs(v - p.data[j][k])
+			}
+			distances[i][j], distances[j][i] = d, d
+		}
+	}
+
+	result, err := stats.MDS(components, distances)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.result.ReducedData = result.Coords
+	p.result.VarianceRatio = result.Ratio
+	fmt.Println("Eigenvalue ratio:", result.Ratio)
+}
+
 func (p *PCA) WritePlotData(analysis Analysis) {
 	writeFile := func(fname string, start, end int) {
 		fd, fp := utils.WriteFile(fname)
 		defer fd.Close()
 
 		for i, row := range p.result.ReducedData[start:end] {
-			fmt.Fprintf(fp, "%f %f # %s\n",
-				row[0], row[1], p.rowLabels[start+i])
+			for _, v := range row {
+				fmt.Fprintf(fp, "%f ", v)
+			}
+			fmt.Fprintf(fp, "# %s\n", p.rowLabels[start+i])
 		}
 
 		fp.Flush()
@@ -546,6 +580,8 @@ func main() {
 		sepIndicesS string
 		separate    string
 		analysis    Analysis
+		components  int
+		mds         bool
 	)
 
 	pca := NewPCA()
@@ -558,6 +594,8 @@ func main() {
 	flag.Var(&sepKeys, "separate", "Strings to separate on (e.g. 'Pangolin')")
 	flag.StringVar(&sepIndicesS, "sepint", "", "Indices to separate")
 	flag.StringVar(&exclude, "e", "", "Genomes to exclude")
+	flag.IntVar(&components, "n", 2, "Number of components")
+	flag.BoolVar(&mds, "mds", false, "Use classical MDS instead of PCA")
 	flag.Parse()
 
 	switch analysisS {
@@ -647,6 +685,10 @@ func main() {
 		}
 	}
 
-	pca.Reduce()
+	if mds {
+		pca.ReduceMDS(components)
+	} else {
+		pca.Reduce(components)
+	}
 	pca.WritePlotData(analysis)
 }
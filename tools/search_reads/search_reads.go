@@ -10,6 +10,7 @@ import (
 	"genomics/stats"
 	"log"
 	"os"
+	"strings"
 )
 
 func ParseFastq(fname string, cb func(name string, readData []byte)) {
@@ -116,6 +117,7 @@ func main() {
 		subseqRange string
 		outName     string
 		blast		string
+		localBlast  string
 	)
 
 	flag.BoolVar(&verbose, "v", false, "Verbose")
@@ -126,6 +128,8 @@ func main() {
 	flag.IntVar(&minMatches, "m", 1, "Minimum number of matches")
 	flag.StringVar(&outName, "o", "", "Output matching reads to fname")
 	flag.StringVar(&blast, "b", "", "Genome directory for blast")
+	flag.StringVar(&localBlast, "lb", "",
+		"Index directory,fasta file for blasting without BLAST+")
 	flag.Parse()
 
 	if len(flag.Args()) < 1 {
@@ -155,6 +159,19 @@ func main() {
 		bc = stats.BlastDefaultConfig()
 	}
 
+	var lb *stats.LocalBlast
+	if localBlast != "" {
+		fields := strings.Split(localBlast, ",")
+		if len(fields) != 2 {
+			log.Fatal("Use -lb indexdir,fasta")
+		}
+		var err error
+		lb, err = stats.NewLocalBlast(fields[0], fields[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	var outFp *bufio.Writer
 	if outName != "" {
 		fd, err := os.Create(outName)
@@ -190,9 +207,14 @@ func main() {
 					readData.Output(outFp)
 				}
 
-				if bc != nil {
-					results := stats.Blast(bc,
-						blast, readData.Nts, 1, 1, stats.NOT_VERBOSE)
+				if bc != nil || lb != nil {
+					var results stats.BlastResults
+					if lb != nil {
+						results = lb.Search(readData.Nts, 1, 1)
+					} else {
+						results = stats.Blast(bc,
+							blast, readData.Nts, 1, 1, stats.NOT_VERBOSE)
+					}
 					fmt.Printf("%d BLAST hits\n", len(results))
 					if len(results) > 0 {
 					blastHits++
@@ -210,7 +232,7 @@ func main() {
 		os.Exit(-1)
 	}
 	if verbose {
-		if bc != nil {
+		if bc != nil || lb != nil {
 			fmt.Printf("%d reads have a blast hit\n", blastHits)
 		}
 		fmt.Printf("%d reads match\n\n", matches)
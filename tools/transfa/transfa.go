@@ -56,6 +56,23 @@ func translate(g *genomes.Genomes, w *bufio.Writer) {
 	}
 }
 
+/*
+Translate each record on its own as we read it, rather than loading the whole
+file as an alignment first. Use this for files too big to fit in memory.
+*/
+func translateStream(fname string, orfs genomes.Orfs,
+	code *genomes.GeneticCode, w *bufio.Writer) {
+	err := genomes.ForEachFasta(fname, func(r *genomes.FastaRecord) bool {
+		g := r.ToGenomes(orfs)
+		g.Code = code
+		translate(g, w)
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 type CodonFreq struct {
 	nts   string
 	count int
@@ -129,10 +146,11 @@ func main() {
 	}
 	var (
 		modeName, orfs, outName string
-		offset                  int
+		offset, codeId          int
 		reverse                 bool
 		include                 string
 		removeGaps              bool
+		stream                  bool
 	)
 
 	flag.StringVar(&modeName, "mode", "translate", "Translation mode")
@@ -142,9 +160,35 @@ func main() {
 	flag.BoolVar(&reverse, "reverse", false, "Treat as reverse complement")
 	flag.StringVar(&include, "i", "", "Genomes to include")
 	flag.BoolVar(&removeGaps, "g", true, "Remove gaps from first genome")
+	flag.IntVar(&codeId, "code", 1, "NCBI genetic code (translation table)")
+	flag.BoolVar(&stream, "stream", false, "Translate each record "+
+		"independently without loading the whole file (translate mode only)")
 	flag.Parse()
 
+	code, err := genomes.GetGeneticCode(codeId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if stream {
+		if modeName != "translate" {
+			log.Fatal("Streaming only works in translate mode")
+		}
+		var o genomes.Orfs
+		if orfs != "" {
+			o = genomes.LoadOrfs(orfs)
+		}
+		writeFile(outName, nil, func(_ *genomes.Genomes, w *bufio.Writer) {
+			translateStream(flag.Arg(0), o, code, w)
+		})
+		if outName != "" {
+			fmt.Printf("Wrote %s\n", outName)
+		}
+		return
+	}
+
 	g := genomes.LoadGenomes(flag.Arg(0), orfs, false)
+	g.Code = code
 	if removeGaps {
 		g.RemoveGaps()
 	}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"genomics/genomes"
+	"genomics/phylogeny"
+	"log"
+)
+
+func main() {
+	var (
+		outName  string
+		modelS   string
+		methodS  string
+		complete bool
+		outgroup int
+	)
+
+	flag.StringVar(&outName, "o", "tree.nwk", "Output file")
+	flag.StringVar(&modelS, "model", "k2p", "p|jc|k2p")
+	flag.StringVar(&methodS, "method", "nj", "nj|upgma")
+	flag.BoolVar(&complete, "complete", false,
+		"Ignore columns where any genome has a gap or ambiguity")
+	flag.IntVar(&outgroup, "outgroup", -1, "Which genome to root on (nj only)")
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		log.Fatal("Usage: treefa [options] alignment.fasta")
+	}
+
+	var model phylogeny.DistanceModel
+	switch modelS {
+	case "p":
+		model = phylogeny.P_DISTANCE
+	case "jc":
+		model = phylogeny.JUKES_CANTOR
+	case "k2p":
+		model = phylogeny.KIMURA_2P
+	default:
+		log.Fatal("Unrecognized distance model")
+	}
+
+	var method phylogeny.TreeMethod
+	switch methodS {
+	case "nj":
+		method = phylogeny.NEIGHBOR_JOINING
+	case "upgma":
+		method = phylogeny.UPGMA_TREE
+	default:
+		log.Fatal("Unrecognized tree method")
+	}
+
+	gaps := phylogeny.PAIRWISE_DELETION
+	if complete {
+		gaps = phylogeny.COMPLETE_DELETION
+	}
+
+	g := genomes.LoadGenomes(flag.Arg(0), "", false)
+
+	tree, err := phylogeny.BuildTree(g, model, gaps, method)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if outgroup != -1 {
+		if outgroup >= g.NumGenomes() {
+			log.Fatal("Invalid outgroup")
+		}
+		tree, err = tree.Reroot(g.Names[outgroup])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = tree.SaveNewick(outName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %s (%s, %s)\n", outName, model.ToString(), methodS)
+}
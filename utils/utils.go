@@ -85,26 +85,42 @@ type FileReader struct {
 
 func NewFileReader(fname string) *FileReader {
 	var ret FileReader
-	ret.Open(fname)
+	err := ret.Open(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &ret
 }
 
-func (f *FileReader) Open(fname string) {
+// Like NewFileReader but returns an error rather than exiting if the file
+// can't be opened.
+func OpenFileReader(fname string) (*FileReader, error) {
+	var ret FileReader
+	err := ret.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (f *FileReader) Open(fname string) error {
 	var err error
 	f.fd, err = os.Open(fname)
 	if err != nil {
-		log.Fatalf("Can't open %s", fname)
+		return err
 	}
 
 	if strings.HasSuffix(fname, ".gz") {
 		f.gzipFd, err = gzip.NewReader(f.fd)
 		if err != nil {
-			log.Fatalf("Can't gunzip %s", fname)
+			f.fd.Close()
+			return fmt.Errorf("Can't gunzip %s: %w", fname, err)
 		}
 		f.Reader = bufio.NewReader(f.gzipFd)
 	} else {
 		f.Reader = bufio.NewReader(f.fd)
 	}
+	return nil
 }
 
 func (f *FileReader) Close() {
@@ -126,11 +142,11 @@ loop:
 		case nil:
 			line = strings.TrimRight(line, "\n")
 			if !fun(line, nil) {
-				break
+				break loop
 			}
 		default:
 			fun("", err)
-			break
+			break loop
 		}
 	}
 }
@@ -142,6 +158,17 @@ func Lines(fname string, fun LineFun) {
 	lines(fp.Reader, fun)
 }
 
+// Like Lines but returns an error if the file can't be opened.
+func TryLines(fname string, fun LineFun) error {
+	fp, err := OpenFileReader(fname)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	lines(fp.Reader, fun)
+	return nil
+}
+
 // Call fun for all the lines in a Reader
 func ReaderLines(reader io.Reader, fun LineFun) {
 	r := bufio.NewReader(reader)
@@ -177,13 +204,22 @@ func Atof(s string) float64 {
 }
 
 func Wrap(w io.Writer, nts []byte) {
+	TryWrap(w, nts)
+}
+
+// Like Wrap but returns the first write error
+func TryWrap(w io.Writer, nts []byte) error {
 	ll := 60
 
 	var i int
 	for i = 0; i < len(nts)-ll; i += ll {
-		fmt.Fprintf(w, "%s\n", string(nts[i:i+ll]))
+		_, err := fmt.Fprintf(w, "%s\n", string(nts[i:i+ll]))
+		if err != nil {
+			return err
+		}
 	}
-	fmt.Fprintf(w, "%s\n", string(nts[i:]))
+	_, err := fmt.Fprintf(w, "%s\n", string(nts[i:]))
+	return err
 }
 
 func IsRegularNt(nt byte) bool {
@@ -5,6 +5,7 @@ import (
 	"genomics/database"
 	"genomics/genomes"
 	"genomics/utils"
+	"log"
 )
 
 type Result struct {
@@ -18,7 +19,11 @@ type Result struct {
 type Results map[byte]Result
 
 func main() {
-	db := database.NewDatabase()
+	db, err := database.NewDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.EnsureMutationIndices()
 	results := make(Results)
 
 	g := genomes.LoadGenomes("../fasta/WH1.fasta", "../fasta/WH1.orfs", false)